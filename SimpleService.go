@@ -1,9 +1,14 @@
 package main
 
 import (
-	"bytes"
-	"io"
+	"errors"
+	"fmt"
+	"net/http"
 	"reflectsvc/misc"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const SEP = "/* ************************** */"
@@ -12,8 +17,9 @@ const SEP = "/* ************************** */"
 type SimpleService interface {
 	Reverse(string) (string, error)
 	Reflect(request reflectRequest) reflectResponse
-	Convert(request ConvertRequest) (string, error)
-	Xml2Json(request xml2JsonRequest) x2jProxyData
+	Convert(request ConvertRequest) (conversion, error)
+	Xml2Json(request xml2JsonRequest) xml2JsonResponse
+	Json2Xml(request json2XmlRequest) ([]byte, error)
 	Validate(request validateRequest) validateRequest
 	// Success(string) string
 }
@@ -31,40 +37,284 @@ func (simpleService) Validate(v validateRequest) (vr validateRequest) {
 	return v
 }
 
-func (simpleService) Xml2Json(req xml2JsonRequest) (xjProxy x2jProxyData) {
+// What --batch-events does with a callback of more than one event
+const (
+	batchSeparate = "separate" // convert and deliver each event on its own
+	batchArray    = "array"    // deliver them together, as one JSON array
+)
+
+func (s simpleService) Xml2Json(req xml2JsonRequest) (xjProxy xml2JsonResponse) {
 	if FlagDebug {
 		xLog.Printf("enter Xml2Json send request %s", req.MagicInternalGuid)
 	}
+	if len(req.More) > 0 && batchSeparate == FlagBatchEvents {
+		return s.xml2JsonEvents(req)
+	}
+	var lowConfidence []string
+	defer func() {
+		xjProxy.Mode = requestResponseMode(req.Headers)
+		xjProxy.Sequence = req.MagicInternalGuid
+		xjProxy.LowConfidence = lowConfidence
+	}()
+	routes := []*route{defaultRoute()}
+	if nil != xRoutes {
+		var err error
+		if routes, err = xRoutes.MatchEvents(XtractaEvents(req)); nil != err {
+			xLog.Printf("callback [%s] of %d events not delivered because %s",
+				req.MagicInternalGuid, len(req.More)+1, err.Error())
+			xjProxy.Code = http.StatusUnprocessableEntity
+			xjProxy.Status = err.Error()
+			return xjProxy
+		}
+		if len(routes) == 0 {
+			xLog.Printf("document %s (workflow %s) did not match any route",
+				req.Event.Document.DocumentID, req.Event.Document.WorkflowID)
+			xjProxy.Code = http.StatusUnprocessableEntity
+			xjProxy.Status = ErrNoRoute.Error()
+			return xjProxy
+		}
+	}
+
+	// converted now, even when it is delivered later
+	bodies := make([]string, len(routes))
+	seen := make(map[string]bool)
+	for ix, rt := range routes {
+		c, err := XtractaEvents(req).ConvertAll(rt.remap)
+		bodies[ix] = c.Body
+		for _, name := range c.LowConfidence {
+			if !seen[name] {
+				seen[name] = true
+				lowConfidence = append(lowConfidence, name)
+			}
+		}
+		if err = c.refused(err); nil != err {
+			xLog.Printf("document %s [%s] not delivered to %s because %s",
+				req.Event.Document.DocumentID, req.MagicInternalGuid, rt.Name, err.Error())
+			xjProxy.Code = http.StatusUnprocessableEntity
+			xjProxy.Status = err.Error()
+			var ce conversionError
+			if errors.As(err, &ce) {
+				xjProxy.Failures = ce.Failures
+			}
+			return xjProxy
+		}
+	}
+
+	if len(lowConfidence) > 0 {
+		xLog.Printf("document %s [%s] has %d field(s) below their extraction confidence threshold: %s",
+			req.Event.Document.DocumentID, req.MagicInternalGuid, len(lowConfidence),
+			strings.Join(lowConfidence, ", "))
+	}
+
+	async := FlagAsync || prefersAsync(req.Headers)
+	if async && nil != xJobs {
+		deliver := func() x2jProxyData {
+			return xml2JsonDeliver(req, routes, bodies, false)
+		}
+		var queued x2jProxyData
+		if nil != xQueue {
+			// on disk before the caller is answered; the job follows it there
+			queued = xml2JsonDeliver(req, routes, bodies, true)
+			if queued.Code < 200 || queued.Code >= 300 {
+				xjProxy.x2jProxyData = queued
+				return xjProxy
+			}
+			deliver = func() x2jProxyData {
+				return followQueued(queued)
+			}
+		}
+		id, err := xJobs.Submit(req.Event.Document.DocumentID, req.MagicInternalGuid, deliver)
+		if nil != err {
+			xLog.Printf("could not start delivery of document %s [%s] because %s",
+				req.Event.Document.DocumentID, req.MagicInternalGuid, err.Error())
+			if nil != xQueue {
+				// queued all the same, just not followed by a job
+				xjProxy.x2jProxyData = queued
+				return xjProxy
+			}
+			xjProxy.Code = http.StatusServiceUnavailable
+			xjProxy.Status = err.Error()
+			return xjProxy
+		}
+		xjProxy.Code = http.StatusAccepted
+		xjProxy.Status = "202 Accepted"
+		xjProxy.JobID = id
+		return xjProxy
+	}
+	xjProxy.x2jProxyData = xml2JsonDeliver(req, routes, bodies, async)
+	return xjProxy
+}
+
+// xml2JsonEvents delivers each event of a batch by itself, one after
+// the other, as though Xtracta had sent them one per callback. The
+// first event keeps the callback's P3id-Sequence; the others get their
+// own. The result is 200 (202 if any are only queued) when every event
+// was delivered, the events' own status when they all agree, and 207
+// Multi-Status otherwise.
+func (s simpleService) xml2JsonEvents(req xml2JsonRequest) (xjProxy xml2JsonResponse) {
+	events := XtractaEvents(req).Split()
+	xLog.Printf("callback [%s] has %d events -- delivering each one on its own",
+		req.MagicInternalGuid, len(events))
+
+	xjProxy.Events = make([]x2jEventResponse, len(events))
+	for ix, one := range events {
+		if ix > 0 {
+			one.MagicInternalGuid = xSequence.Next()
+		}
+		result := s.Xml2Json(xml2JsonRequest(one))
+		for _, name := range result.LowConfidence {
+			xjProxy.LowConfidence = append(xjProxy.LowConfidence, "["+strconv.Itoa(ix)+"]."+name)
+		}
+		xjProxy.Events[ix] = x2jEventResponse{xml2JsonResponse: result, Event: one.Event.Sequence,
+			DocumentID: one.Event.Document.DocumentID}
+	}
+
+	xjProxy.Code = xjProxy.Events[0].Code
+	for _, r := range xjProxy.Events[1:] {
+		if r.Code != xjProxy.Code {
+			xjProxy.Code = 0
+			break
+		}
+	}
+	if 0 == xjProxy.Code {
+		xjProxy.Code = http.StatusOK
+		for _, r := range xjProxy.Events {
+			if r.Code < 200 || r.Code >= 300 {
+				xjProxy.Code = http.StatusMultiStatus
+				break
+			}
+			if r.Code == http.StatusAccepted {
+				xjProxy.Code = http.StatusAccepted
+			}
+		}
+	}
+	xjProxy.Status = http.StatusText(xjProxy.Code)
+	xjProxy.Mode = requestResponseMode(req.Headers)
+	xjProxy.Sequence = req.MagicInternalGuid
+	return xjProxy
+}
+
+// xml2JsonDeliver sends the converted bodies to their routes. Without
+// a routing table there is one route and its result is returned as
+// is; otherwise the routes are delivered to in parallel and the result
+// summarizes them. With queueAsync set, queued documents are not
+// waited on.
+func xml2JsonDeliver(req xml2JsonRequest, routes []*route, bodies []string, queueAsync bool) (xjProxy x2jProxyData) {
+	if nil == xRoutes {
+		return xml2JsonRoute(routes[0], req, bodies[0], queueAsync)
+	}
+
+	xjProxy.Results = make([]x2jProxyData, len(routes))
+	var wg sync.WaitGroup
+	for ix, rt := range routes {
+		wg.Add(1)
+		go func(ix int, rt *route) {
+			defer wg.Done()
+			xjProxy.Results[ix] = xml2JsonRoute(rt, req, bodies[ix], queueAsync)
+		}(ix, rt)
+	}
+	wg.Wait()
+	xjProxy.summarize()
+	return xjProxy
+}
+
+// summarize sets the code of a routed document from its results: all
+// delivered, 200 (202 if any are only queued); otherwise 502
+func (xj *x2jProxyData) summarize() {
+	xj.Code = http.StatusOK
+	for _, r := range xj.Results {
+		if r.Code < 200 || r.Code >= 300 {
+			xj.Code = http.StatusBadGateway
+			break
+		}
+		if r.Code == http.StatusAccepted {
+			xj.Code = http.StatusAccepted
+		}
+	}
+	xj.Status = http.StatusText(xj.Code)
+}
+
+// xml2JsonRoute delivers the document, already converted with the
+// route's field mapping, (directly, or by way of the queue) to the
+// route's destination.
+func xml2JsonRoute(rt *route, req xml2JsonRequest, jsonBody string, queueAsync bool) (xjProxy x2jProxyData) {
 	xjProxy.Code = 500
 	xjProxy.Status = "500 ERROR"
 	xjProxy.Body = nil
+	defer func() {
+		xjProxy.Route = rt.Name
+		xjProxy.Destination = rt.Destination
+	}()
+
+	send := XtractaEvents(req)
+	var records []*deliveryRecord
+	extra := make(http.Header)
+	if nil != xLedger {
+		var stale string
+		var skip *x2jProxyData
+		if send, records, stale, skip = claimEvents(rt, req); nil != skip {
+			return *skip
+		}
+		if misc.IsStringSet(&stale) {
+			extra.Set(STALEREVISIONHEADER, stale)
+		}
+		if len(send.More) != len(req.More) {
+			c, err := send.ConvertAll(rt.remap)
+			if nil != err {
+				xLog.Printf("huh? could not convert what is left of callback [%s] for %s because %s",
+					req.MagicInternalGuid, rt.Name, err.Error())
+				for _, rec := range records {
+					xLedger.settle(rec, false)
+				}
+				xjProxy.Status = err.Error()
+				return xjProxy
+			}
+			jsonBody = c.Body
+			if len(send.More) == 0 {
+				// still a batch to the destination
+				jsonBody = "[" + jsonBody + "]"
+			}
+		}
+		if nil == xQueue {
+			defer func() {
+				for _, rec := range records {
+					xLedger.settle(rec, xjProxy.Code >= 200 && xjProxy.Code < 300)
+				}
+			}()
+		}
+	}
+	if misc.IsStringSet(&req.MagicInternalGuid) {
+		extra.Set(P3IDSEQUENCEHEADER, req.MagicInternalGuid)
+	}
+	if misc.IsStringSet(&FlagIdempotencyHeader) && misc.IsStringSet(&send.Event.Document.DocumentID) {
+		extra.Set(FlagIdempotencyHeader, idempotencyKey(send))
+	}
 
-	buf := bytes.NewBufferString(req.Json())
-	rsp, err := x2jProxy(req.Headers, buf)
+	if nil != xQueue {
+		// the queue settles the claims once the document is delivered or given up
+		return queueXml2Json(rt, req.Headers, extra, send.Raw, jsonBody, queueAsync, records)
+	}
+	rsp, err := x2jProxy(rt, req.Headers, extra, []byte(jsonBody))
 
 	if nil != err {
-		xLog.Printf("could not proxy json request to %s\n with data\n%s\n because %s",
-			FlagDest, req.Json(), err.Error())
-		if nil != rsp {
-			xLog.Printf("response: %v", rsp)
-			xjProxy.Code = rsp.StatusCode
-			xjProxy.Status = rsp.Status
-		} else {
-			xjProxy.Status = "No response from remote server"
-			return xjProxy
+		xLog.Printf("could not proxy json request [%s] to %s\n with data\n%s\n because %s",
+			req.MagicInternalGuid, rt.Destination, jsonBody, err.Error())
+	}
+	if nil != xDeadLetters && (rsp.Code < 200 || rsp.Code >= 300) {
+		id, dlErr := xDeadLetters.Add(makeDeadLetter(rt, send.Raw, jsonBody, rsp))
+		if nil != dlErr {
+			xLog.Printf("huh? could not dead-letter document %s because %s",
+				req.Event.Document.DocumentID, dlErr.Error())
 		}
+		rsp.DeadLetter = id
+		xjProxy.DeadLetter = id
 	}
-	defer misc.DeferError(rsp.Body.Close)
-	xjProxy.Body, err = io.ReadAll(rsp.Body)
-	if nil != err {
-		xLog.Printf("json request to %s with data\n%s\n"+
-			"\tcould not read response body because %s",
-			FlagDest, req.Json(), err.Error())
-		xjProxy.Status = "failure"
-		xjProxy.Code = 501
+	if nil != err && rsp.Code <= 0 {
+		xjProxy.Status = "No response from remote server"
+		xjProxy.Attempts = rsp.Attempts
+		return xjProxy
 	}
-	xjProxy.Status = rsp.Status
-	xjProxy.Code = rsp.StatusCode
+	xjProxy = rsp
 
 	if FlagDebug || FlagVerbose {
 		xLog.Printf("\n%s\n%s\n%s", SEP, string(xjProxy.Body), SEP)
@@ -73,6 +323,88 @@ func (simpleService) Xml2Json(req xml2JsonRequest) (xjProxy x2jProxyData) {
 	return xjProxy
 }
 
+// claimEvents claims each event of the callback for the route in the
+// ledger. What is left to send has lost the duplicate and stale events
+// of a batch (--batch-events array); skip is the answer instead when
+// nothing is left, or when an event is already being delivered (and
+// nothing is claimed). stale is the P3id-Stale-Revision of events sent
+// flagged as stale: the newer revision, or for a batch each stale
+// document's id=revision.
+func claimEvents(rt *route, req xml2JsonRequest) (send XtractaEvents, records []*deliveryRecord,
+	stale string, skip *x2jProxyData) {
+	each := XtractaEvents(req).eachEvent()
+	keep := make([]int, 0, len(each))
+	var flagged []string
+	for ix, one := range each {
+		verdict, prev := xLedger.claim(rt.Name, one)
+		switch verdict {
+		case ledgerInFlight:
+			for _, rec := range records {
+				xLedger.settle(rec, false)
+			}
+			busy := skippedDelivery(rt, xml2JsonRequest(one), verdict, prev)
+			return send, nil, "", &busy
+		case ledgerStale:
+			if FlagStaleRevisions == "flag" {
+				doc := one.Event.Document
+				xLog.Printf("document %s revision %s is older than revision %s already delivered to %s "+
+					"-- delivering it flagged as stale", doc.DocumentID, doc.Revision, prev.Revision, rt.Name)
+				if len(each) > 1 {
+					flagged = append(flagged, doc.DocumentID+"="+prev.Revision)
+				} else {
+					flagged = append(flagged, prev.Revision)
+				}
+				break
+			}
+			fallthrough
+		case ledgerDuplicate:
+			if nil == skip {
+				skipped := skippedDelivery(rt, xml2JsonRequest(one), verdict, prev)
+				skip = &skipped
+			}
+			continue
+		}
+		keep = append(keep, ix)
+		if rec := newDeliveryRecord(rt.Name, one); nil != rec {
+			records = append(records, rec)
+		}
+	}
+	if len(keep) == 0 {
+		return send, nil, "", skip
+	}
+	send = XtractaEvents(req)
+	if len(keep) < len(each) {
+		xLog.Printf("sending %d of the %d events of callback [%s] to %s; the others were delivered before",
+			len(keep), len(each), req.MagicInternalGuid, rt.Name)
+		send = send.Subset(keep)
+	}
+	return send, records, strings.Join(flagged, ","), nil
+}
+
+// skippedDelivery acknowledges a document the ledger says not to send
+func skippedDelivery(rt *route, req xml2JsonRequest, verdict ledgerVerdict, prev *deliveryRecord) (xjProxy x2jProxyData) {
+	doc := req.Event.Document
+	switch verdict {
+	case ledgerDuplicate:
+		xLog.Printf("document %s revision %s was already delivered to %s at %s -- not sending it again",
+			doc.DocumentID, doc.Revision, rt.Name, prev.Delivered.Format(time.RFC3339))
+		xjProxy.Code = http.StatusOK
+		xjProxy.Status = "duplicate"
+		xjProxy.Skipped = "duplicate"
+	case ledgerStale:
+		xLog.Printf("document %s revision %s is older than revision %s already delivered to %s -- dropping it",
+			doc.DocumentID, doc.Revision, prev.Revision, rt.Name)
+		xjProxy.Code = http.StatusOK
+		xjProxy.Status = "stale revision"
+		xjProxy.Skipped = "stale"
+	default:
+		// the first copy may yet fail, so have the sender try again later
+		xjProxy.Code = http.StatusConflict
+		xjProxy.Status = "document " + doc.DocumentID + " is already being delivered"
+	}
+	return xjProxy
+}
+
 func (simpleService) Reflect(request reflectRequest) reflectResponse {
 	if FlagDebug {
 		xLog.Printf("reflecting request:\n\t/* *** */\n%s\n\t/* *** */\n", string(request.Body))
@@ -80,9 +412,36 @@ func (simpleService) Reflect(request reflectRequest) reflectResponse {
 	return reflectResponse{Body: request.Body}
 }
 
-func (simpleService) Convert(req ConvertRequest) (string, error) {
-	xLog.Printf("\n%s\n%s\n%s\n%s\n", SEP, req.String(), req.Json(), SEP)
-	return req.Json(), nil
+// Convert reports the validation rules the document breaks, but only
+// fails for fields that do not convert under the reject policy
+func (simpleService) Convert(req ConvertRequest) (conversion, error) {
+	c, err := XtractaEvents(req).Convert(FlagRemapMap)
+	if nil != err {
+		xLog.Printf("\n%s\n%s\nconversion failed because %s\n%s\n", SEP, req.String(), err.Error(), SEP)
+		return c, err
+	}
+	xLog.Printf("\n%s\n%s\n%s\n%s\n", SEP, req.String(), c.Body, SEP)
+	if len(c.Violations) > 0 {
+		xLog.Printf("document %s breaks %d validation rule(s): %s",
+			req.Event.Document.DocumentID, len(c.Violations), conversionError{c.Violations}.Error())
+	}
+	return c, nil
+}
+
+func (simpleService) Json2Xml(req json2XmlRequest) ([]byte, error) {
+	remap := FlagRemapMap
+	if misc.IsStringSet(&req.Route) {
+		rt, ok := lookupRoute(req.Route)
+		if !ok {
+			return nil, fmt.Errorf("there is no route %s", req.Route)
+		}
+		remap = rt.remap
+	}
+	out, err := jsonToXtracta(req.Body, remap)
+	if nil != err {
+		xLog.Printf("could not convert JSON to XML because %s", err.Error())
+	}
+	return out, err
 }
 
 func (simpleService) Reverse(s string) (string, error) {
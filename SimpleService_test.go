@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// destination is a stand-in for a route's destination that keeps what
+// it is sent, and answers 200
+type destination struct {
+	*httptest.Server
+	mx      sync.Mutex
+	bodies  []string
+	headers []http.Header
+}
+
+func newDestination(t *testing.T) *destination {
+	t.Helper()
+	d := &destination{}
+	d.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		d.mx.Lock()
+		d.bodies = append(d.bodies, string(body))
+		d.headers = append(d.headers, r.Header.Clone())
+		d.mx.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(d.Close)
+	return d
+}
+
+func (d *destination) received() []string {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	return append([]string(nil), d.bodies...)
+}
+
+// testRoute is a route to url, for documents of the workflows given,
+// that sends the document id and workflow as documentId and workflowId
+// (and no documentLink)
+func testRoute(t *testing.T, name string, url string, workflowIDs ...string) *route {
+	t.Helper()
+	remap := make(map[string]remapField)
+	for ix, names := range [][2]string{{"@document_id", "documentId"}, {"@workflow_id", "workflowId"},
+		{"@document_url", "-"}} {
+		rm := newRemapField()
+		rm.XMLName, rm.JsonName, rm.Order = names[0], names[1], ix
+		if "-" != rm.JsonName {
+			rm.Path = []jsonStep{{Key: names[1], Index: -1}}
+		}
+		remap[rm.XMLName] = rm
+	}
+	rt := &route{Name: name, Destination: url, remap: remap,
+		Document: routeDocumentMatch{WorkflowID: workflowIDs}}
+	if err := rt.prepareTLS(); nil != err {
+		t.Fatal(err)
+	}
+	return rt
+}
+
+// testBatch is an Xtracta callback of one event per "workflow/document"
+func testBatch(t *testing.T, guid string, docs ...string) xml2JsonRequest {
+	t.Helper()
+	var sb strings.Builder
+	sb.WriteString("<events>")
+	for ix, doc := range docs {
+		workflow, id, _ := strings.Cut(doc, "/")
+		fmt.Fprintf(&sb, `<event sequence="%d"><document revision="1"><workflow_id>%s</workflow_id>`+
+			`<document_id>%s</document_id><field_data/></document></event>`, ix+1, workflow, id)
+	}
+	sb.WriteString("</events>")
+	x, err := readDocuments([]byte(sb.String()))
+	if nil != err {
+		t.Fatal(err)
+	}
+	req := xml2JsonRequest(x)
+	req.Headers = make(http.Header)
+	req.MagicInternalGuid = guid
+	return req
+}
+
+// useBatchArray sends batches as one JSON array, for the test
+func useBatchArray(t *testing.T) {
+	saved := FlagBatchEvents
+	FlagBatchEvents = batchArray
+	t.Cleanup(func() { FlagBatchEvents = saved })
+}
+
+func TestBatchArrayLedger(t *testing.T) {
+	useBatchArray(t)
+	dest := newDestination(t)
+	savedRoute, savedLedger := xDefaultRoute, xLedger
+	defer func() { xDefaultRoute, xLedger = savedRoute, savedLedger }()
+	xDefaultRoute = testRoute(t, "default", dest.URL)
+	var err error
+	if xLedger, err = openLedger(filepath.Join(t.TempDir(), "ledger.json"), 0); nil != err {
+		t.Fatal(err)
+	}
+	svc := simpleService{}
+
+	if xj := svc.Xml2Json(testBatch(t, "t-1", "1/A")); http.StatusOK != xj.Code {
+		t.Fatalf("first callback: got %d %s", xj.Code, xj.Status)
+	}
+
+	// A was delivered: only B goes out, with a key of its own
+	xj := svc.Xml2Json(testBatch(t, "t-2", "1/A", "1/B"))
+	got := dest.received()
+	if http.StatusOK != xj.Code || len(got) != 2 ||
+		`[{"documentId":"B","workflowId":"1"}]` != got[1] {
+		t.Fatalf("second callback: got %d %s, destination saw %q; want B alone", xj.Code, xj.Status, got)
+	}
+	dest.mx.Lock()
+	first, second := dest.headers[0].Get(FlagIdempotencyHeader), dest.headers[1].Get(FlagIdempotencyHeader)
+	dest.mx.Unlock()
+	if first == second || "" == second {
+		t.Errorf("the batch of B was sent with key %q, the delivery of A had %q", second, first)
+	}
+
+	// both delivered: nothing goes out
+	xj = svc.Xml2Json(testBatch(t, "t-3", "1/A", "1/B"))
+	if http.StatusOK != xj.Code || "duplicate" != xj.Skipped || len(dest.received()) != 2 {
+		t.Errorf("third callback: got %d %s (skipped %q) after %d deliveries; want a duplicate, not sent",
+			xj.Code, xj.Status, xj.Skipped, len(dest.received()))
+	}
+
+	// C is new, but D is being delivered right now: try again later, and
+	// C is not left claimed
+	if verdict, _ := xLedger.claim("default", XtractaEvents(testBatch(t, "", "1/D"))); ledgerDeliver != verdict {
+		t.Fatalf("could not claim D: %v", verdict)
+	}
+	xj = svc.Xml2Json(testBatch(t, "t-4", "1/C", "1/D"))
+	if http.StatusConflict != xj.Code || len(dest.received()) != 2 {
+		t.Errorf("callback with D in flight: got %d %s, want 409", xj.Code, xj.Status)
+	}
+	if verdict, _ := xLedger.claim("default", XtractaEvents(testBatch(t, "", "1/C"))); ledgerDeliver != verdict {
+		t.Errorf("C was left claimed by a callback that was not sent")
+	}
+}
+
+func TestBatchArrayRoutes(t *testing.T) {
+	useBatchArray(t)
+	one, two := newDestination(t), newDestination(t)
+	saved := xRoutes
+	defer func() { xRoutes = saved }()
+	xRoutes = &routingTable{Routes: []*route{
+		testRoute(t, "one", one.URL, "1"),
+		testRoute(t, "two", two.URL, "2"),
+	}}
+	svc := simpleService{}
+
+	xj := svc.Xml2Json(testBatch(t, "t-1", "1/A", "2/B"))
+	if http.StatusUnprocessableEntity != xj.Code || ErrBatchRoutes.Error() != xj.Status {
+		t.Errorf("a batch for two routes: got %d %s, want 422", xj.Code, xj.Status)
+	}
+	if len(one.received())+len(two.received()) != 0 {
+		t.Errorf("a refused batch was delivered: %q %q", one.received(), two.received())
+	}
+
+	xj = svc.Xml2Json(testBatch(t, "t-2", "2/C", "2/D"))
+	if http.StatusOK != xj.Code || len(one.received()) != 0 || len(two.received()) != 1 ||
+		`[{"documentId":"C","workflowId":"2"},{"documentId":"D","workflowId":"2"}]` != two.received()[0] {
+		t.Errorf("a batch for route two: got %d %s, routes saw %q and %q",
+			xj.Code, xj.Status, one.received(), two.received())
+	}
+}
@@ -47,7 +47,7 @@ type imageData struct {
 
 func (id *imageData) String() string {
 	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("Height: %d  Width: %d  BPP: %d\n\tImageMeta:"))
+	sb.WriteString(fmt.Sprintf("Height: %d  Width: %d  BPP: %d\n\tImageMeta:", id.Height, id.Width, id.BPP))
 	for _, d := range id.ImageMeta {
 		sb.WriteRune(' ')
 		sb.WriteString(d.String())
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// benchCommand implements `reflectsvc bench [documents] [workers] [file]`.
+// It posts the file to --destination, first building a new client per
+// request (as /xml2json used to), then through the shared, pooled
+// client, and prints the throughput of each.
+func benchCommand(args []string) int {
+	documents, workers, fn := 500, 8, "body.json"
+	var err error
+	if len(args) > 0 {
+		if documents, err = strconv.Atoi(args[0]); nil != err || documents <= 0 {
+			_, _ = fmt.Fprintf(os.Stderr, "bad document count %s\n", args[0])
+			return 2
+		}
+	}
+	if len(args) > 1 {
+		if workers, err = strconv.Atoi(args[1]); nil != err || workers <= 0 {
+			_, _ = fmt.Fprintf(os.Stderr, "bad worker count %s\n", args[1])
+			return 2
+		}
+	}
+	if len(args) > 2 {
+		fn = args[2]
+	}
+	body, err := os.ReadFile(fn)
+	if nil != err {
+		_, _ = fmt.Fprintf(os.Stderr, "could not read %s because %s\n", fn, err.Error())
+		return 1
+	}
+
+	rt := defaultRoute()
+	_, _ = fmt.Fprintf(os.Stdout, "posting %d documents of %d bytes to %s with %d workers\n",
+		documents, len(body), rt.Destination, workers)
+
+	unpooled := func() *http.Client {
+		return &http.Client{Transport: newOutboundTransport(rt.tlsConfig())}
+	}
+	shared := outboundClient(rt)
+	pooled := func() *http.Client { return shared }
+
+	for _, pass := range []struct {
+		name      string
+		client    func() *http.Client
+		throwAway bool
+	}{
+		{"new client per request", unpooled, true},
+		{"shared pooled client", pooled, false},
+	} {
+		elapsed, failures := benchPass(pass.client, pass.throwAway, rt.Destination, body, documents, workers)
+		_, _ = fmt.Fprintf(os.Stdout, "%-24s %8.1f docs/sec  (%s, %d failures)\n",
+			pass.name, float64(documents)/elapsed.Seconds(), elapsed.Round(time.Millisecond), failures)
+	}
+	return 0
+}
+
+// benchPass posts documents copies of body; with throwAway set, each
+// client's connections are closed once its one request is done.
+func benchPass(client func() *http.Client, throwAway bool, dest string, body []byte, documents int, workers int) (time.Duration, int) {
+	var wg sync.WaitGroup
+	var mx sync.Mutex
+	failures := 0
+	work := make(chan struct{}, documents)
+	for ix := 0; ix < documents; ix++ {
+		work <- struct{}{}
+	}
+	close(work)
+
+	start := time.Now()
+	for ix := 0; ix < workers; ix++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range work {
+				c := client()
+				rsp, err := c.Post(dest, "application/json", bytes.NewReader(body))
+				if nil == err {
+					_, _ = io.Copy(io.Discard, rsp.Body)
+					_ = rsp.Body.Close()
+				}
+				if throwAway {
+					c.CloseIdleConnections()
+				}
+				if nil != err || rsp.StatusCode >= 300 {
+					mx.Lock()
+					failures++
+					mx.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return time.Since(start), failures
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// BenchmarkDelivery posts body.json to a local server, building a new
+// client per request (as /xml2json used to) and through the shared,
+// pooled client; `reflectsvc bench` does the same against a real
+// destination.
+func BenchmarkDelivery(b *testing.B) {
+	body, err := os.ReadFile("body.json")
+	if nil != err {
+		b.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	rt := &route{Name: "bench", Destination: srv.URL}
+
+	for _, pass := range []struct {
+		name      string
+		client    func() *http.Client
+		throwAway bool
+	}{
+		{"NewClientPerRequest", func() *http.Client {
+			return &http.Client{Transport: newOutboundTransport(rt.tlsConfig())}
+		}, true},
+		{"SharedPooledClient", func() *http.Client { return outboundClient(rt) }, false},
+	} {
+		b.Run(pass.name, func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c := pass.client()
+					rsp, err := c.Post(rt.Destination, "application/json", bytes.NewReader(body))
+					if nil != err {
+						b.Error(err)
+						return
+					}
+					_, _ = io.Copy(io.Discard, rsp.Body)
+					_ = rsp.Body.Close()
+					if pass.throwAway {
+						c.CloseIdleConnections()
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LOWCONFIDENCEHEADER tells the caller how many fields of the document
+// were below their extraction confidence threshold
+const LOWCONFIDENCEHEADER = "P3id-Low-Confidence"
+
+// lowConfidencePolicy says what happens to a field whose extraction
+// confidence is below its threshold
+type lowConfidencePolicy string
+
+const (
+	lowDrop   lowConfidencePolicy = "drop"   // leave the field out
+	lowNull   lowConfidencePolicy = "null"   // send null in its place
+	lowFlag   lowConfidencePolicy = "flag"   // send it, and list it in --low-confidence-field
+	lowReject lowConfidencePolicy = "reject" // refuse the whole document
+)
+
+func parseLowConfidencePolicy(s string) (lowConfidencePolicy, error) {
+	switch p := lowConfidencePolicy(strings.ToLower(s)); p {
+	case lowDrop, lowNull, lowFlag, lowReject:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown low confidence policy %q (want %s, %s, %s or %s)",
+		s, lowDrop, lowNull, lowFlag, lowReject)
+}
+
+// parseConfidence reads field_extraction_confidence, which Xtracta
+// leaves empty for values it did not extract itself (ok is false then)
+func parseConfidence(s string) (confidence float64, ok bool) {
+	s = strings.TrimSpace(s)
+	if "" == s {
+		return 0, false
+	}
+	confidence, err := strconv.ParseFloat(s, 64)
+	if nil != err {
+		xLog.Printf("huh? extraction confidence %q is not a number -- ignoring it", s)
+		return 0, false
+	}
+	return confidence, true
+}
+
+// minConfidence is the threshold in force for the field; 0 is none
+func (r *remapField) minConfidence() float64 {
+	if r.MinConfidence >= 0 {
+		return r.MinConfidence
+	}
+	return FlagMinConfidence
+}
+
+// onLowConfidence is the low confidence policy in force for the field
+func (r *remapField) onLowConfidence() lowConfidencePolicy {
+	if "" != r.LowConfidence {
+		return r.LowConfidence
+	}
+	return lowConfidencePolicy(FlagLowConfidence)
+}
@@ -3,12 +3,14 @@ package main
 import (
 	"fmt"
 	"github.com/spf13/pflag"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflectsvc/misc"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // wordSepNormalizeFunc all options are lowercase, so
@@ -34,6 +36,13 @@ var FlagDebug bool
 /* program specific flags */
 
 var FlagRemapFieldNames string
+var FlagConversionFailure string
+var FlagBatchEvents string
+var FlagXmlProfile string
+var FlagMinConfidence float64
+var FlagLowConfidence string
+var FlagLowConfidenceField string
+var FlagConfidenceField string
 
 var FlagServiceName string
 var FlagPort string
@@ -43,13 +52,64 @@ var FlagDest string
 var FlagDestInsecure bool
 var FlagTick bool
 var FlagProxySuccess bool
-
-//var FlagHeaderValue []string
-//var FlagHeaderKey []string
-
-func initFlags() {
-	var err error
-
+var FlagResponseMode string
+var FlagRetryMax int
+var FlagRetryBaseDelay time.Duration
+var FlagRetryMaxDelay time.Duration
+var FlagBreakerFailures uint32
+var FlagBreakerCooldown time.Duration
+var FlagQueueDir string
+var FlagRoutes string
+var FlagQueueSyncWait time.Duration
+var FlagQueueMaxAttempts int
+var FlagQueueMaxAge time.Duration
+
+var FlagHeaderPolicy string
+var FlagDestTimeout time.Duration
+var FlagDestDialTimeout time.Duration
+var FlagDestTLSTimeout time.Duration
+var FlagDestIdleTimeout time.Duration
+var FlagDestMaxIdle int
+var FlagDestMaxIdlePerHost int
+var FlagDestMaxConnsPerHost int
+var FlagDestHTTP2 bool
+var FlagDestProxy string
+var FlagDestCert string
+var FlagDestKey string
+var FlagDestCA string
+var FlagDestMinTLS string
+var FlagDestServerName string
+var FlagOAuthTokenURL string
+var FlagOAuthClientID string
+var FlagOAuthSecretFile string
+var FlagOAuthSecretEnv string
+var FlagOAuthScopes []string
+var FlagOAuthAuthStyle string
+var FlagOAuthCA string
+var FlagSignKeys string
+var FlagSignKeyIDs []string
+var FlagSignHeader string
+var FlagSignTimestampHeader string
+var FlagVerifySignatures bool
+var FlagSignatureMaxAge time.Duration
+var FlagIdempotencyFile string
+var FlagIdempotencyRetention time.Duration
+var FlagIdempotencyHeader string
+var FlagStaleRevisions string
+var FlagAsync bool
+var FlagAsyncWorkers int
+var FlagAsyncBacklog int
+var FlagJobRetention time.Duration
+var FlagDeadLetterDir string
+var FlagSequenceFormat string
+var FlagSequenceFile string
+var FlagHeaderValue []string
+var FlagHeaderKey []string
+
+// parseFlags defines the program flags and parses the command line. It
+// runs before the log is open (the command line decides which log to
+// open), so a parse error is returned for initFlags to report.
+func parseFlags() error {
 	hideFlags := make(map[string]string, 8)
 
 	nFlags = pflag.NewFlagSet("default", pflag.ContinueOnError)
@@ -78,16 +138,192 @@ func initFlags() {
 	nFlags.BoolVarP(&FlagProxySuccess, "proxy-success", "", false,
 		"force all proxied xm2json requests to return an explicit success 200 status")
 
+	nFlags.IntVarP(&FlagRetryMax, "retry-max", "", 3,
+		"number of times a failed /xml2json delivery is retried (connection "+
+			"errors, 5xx and 429 responses only); 0 disables retries")
+
+	nFlags.DurationVarP(&FlagRetryBaseDelay, "retry-base-delay", "", 500*time.Millisecond,
+		"starting delay between delivery retries; doubled (with random jitter) for each retry")
+
+	nFlags.DurationVarP(&FlagRetryMaxDelay, "retry-max-delay", "", 30*time.Second,
+		"longest delay between delivery retries, and the longest Retry-After "+
+			"the destination may ask for before the delivery is abandoned")
+
+	nFlags.Uint32VarP(&FlagBreakerFailures, "breaker-failures", "", 5,
+		"consecutive failed deliveries to a destination that open its circuit "+
+			"breaker; 0 disables the breaker")
+
+	nFlags.DurationVarP(&FlagBreakerCooldown, "breaker-cooldown", "", 30*time.Second,
+		"how long an open circuit breaker fails requests immediately before "+
+			"letting a trial request through")
+
+	nFlags.StringVarP(&FlagRoutes, "routes", "", "",
+		"JSON routing table sending each /xml2json document to every matching "+
+			"destination (default: everything goes to --destination)")
+
+	nFlags.StringVarP(&FlagQueueDir, "queue-dir", "", "",
+		"directory for the /xml2json store-and-forward queue; converted documents "+
+			"are written here before delivery and survive a restart (default: no queue)")
+
+	nFlags.DurationVarP(&FlagQueueSyncWait, "queue-sync-wait", "", time.Minute,
+		"how long a synchronous /xml2json caller waits on its queued delivery "+
+			"before being answered 202 Accepted")
+
+	nFlags.IntVarP(&FlagQueueMaxAttempts, "queue-max-attempts", "", 50,
+		"deliveries (each with its retries) of a queued document before it is "+
+			"given up and dead-lettered; 0 for no limit")
+
+	nFlags.DurationVarP(&FlagQueueMaxAge, "queue-max-age", "", 72*time.Hour,
+		"how long a document may stay queued before it is given up and "+
+			"dead-lettered; 0 for no limit")
+
+	nFlags.StringVarP(&FlagResponseMode, "response-mode", "", string(responseSummary),
+		"what /xml2json returns: 'summary' ({\"success\":true}), 'passthrough' "+
+			"(the destination's status, content type and body) or 'envelope' "+
+			"(the destination's body wrapped with sequence id, timing and destination); "+
+			"a caller may override it with a "+RESPONSEMODEHEADER+" header")
+
 	nFlags.BoolVarP(&FlagTick, "tick", "", false, "enable a console tick every few seconds")
 
 	nFlags.StringVarP(&FlagRemapFieldNames, "fieldNames", "", "",
-		"Filename of conversion mapping, one pair per line, [oldName][newName], escape '[' and ']' by doubling them '[[' and ']]'. Case sensitive.")
+		"Filename of the field mapping: YAML or JSON (.yaml, .yml, .json; see `mapping schema`), "+
+			"or lines of `XML name;JSON name;type;omitEmpty[;option=value...]`. Case sensitive.")
+
+	nFlags.StringVarP(&FlagConversionFailure, "conversion-failure", "", string(policyNull),
+		"what /xml2json sends for a mapped field whose value does not convert to its type: "+
+			"null, omit, string (the value as it arrived) or reject (refuse the document, 422); "+
+			"a field's onError= option in --fieldNames overrides it")
+
+	nFlags.StringVarP(&FlagXmlProfile, "xml-profile", "", "xtracta",
+		"how /xml2json and /convert read their XML: xtracta, or a JSON file of selectors "+
+			"for XML of another shape (the --fieldNames XML names are then selectors too)")
+
+	nFlags.StringVarP(&FlagBatchEvents, "batch-events", "", batchSeparate,
+		"when an /xml2json callback has more than one <event>: separate (convert and "+
+			"deliver each event on its own) or array (deliver them together as one JSON array)")
+
+	nFlags.Float64VarP(&FlagMinConfidence, "min-confidence", "", 0,
+		"extraction confidence (0-100) below which an /xml2json field is handled by "+
+			"--low-confidence; 0 is no threshold. A field's minConfidence= option overrides it")
+
+	nFlags.StringVarP(&FlagLowConfidence, "low-confidence", "", string(lowFlag),
+		"what happens to a field below its confidence threshold: drop, null, "+
+			"flag (send it and list it in --low-confidence-field) or reject (refuse the document, 422)")
+
+	nFlags.StringVarP(&FlagLowConfidenceField, "low-confidence-field", "", "_lowConfidence",
+		"name of the JSON object listing the flagged low confidence fields and their confidence")
+
+	nFlags.StringVarP(&FlagConfidenceField, "confidence-field", "", "",
+		"if set, name of a JSON object sent with each document giving the extraction "+
+			"confidence of every field that has one")
 
 	nFlags.BoolVarP(&FlagDestInsecure, "insecure", "", false,
 		"Accesses the remote server without checking the remote "+
 			"certificate's validity. THIS IS FOR TESTING PURPOSES ONLY. DO "+
 			"NOT RUN WITH --insecure IN PRODUCTION.")
 
+	nFlags.StringVarP(&FlagDestCert, "dest-cert", "", "",
+		"client certificate (PEM) presented to the destination for mutual TLS; "+
+			"re-read when the file changes")
+
+	nFlags.StringVarP(&FlagDestKey, "dest-key", "", "",
+		"private key (PEM) for --dest-cert")
+
+	nFlags.StringVarP(&FlagDestCA, "dest-ca", "", "",
+		"CA bundle (PEM) trusted for the destination's certificate, in place of "+
+			"the system roots; re-read when the file changes")
+
+	nFlags.StringVarP(&FlagDestMinTLS, "dest-min-tls", "", "1.2",
+		"lowest TLS version accepted from the destination: 1.0, 1.1, 1.2 or 1.3")
+
+	nFlags.StringVarP(&FlagDestServerName, "dest-server-name", "", "",
+		"server name expected in the destination's certificate (and sent as SNI), "+
+			"when it differs from the host in --destination")
+
+	nFlags.StringVarP(&FlagOAuthTokenURL, "oauth-token-url", "", "",
+		"OAuth2 token endpoint; when set, deliveries carry a bearer token obtained "+
+			"with the client-credentials grant")
+
+	nFlags.StringVarP(&FlagOAuthClientID, "oauth-client-id", "", "",
+		"OAuth2 client id")
+
+	nFlags.StringVarP(&FlagOAuthSecretFile, "oauth-client-secret-file", "", "",
+		"file holding the OAuth2 client secret (re-read for each new token)")
+
+	nFlags.StringVarP(&FlagOAuthSecretEnv, "oauth-client-secret-env", "", "",
+		"environment variable holding the OAuth2 client secret")
+
+	nFlags.StringArrayVarP(&FlagOAuthScopes, "oauth-scope", "", []string{},
+		"OAuth2 scope to request (may be repeated)")
+
+	nFlags.StringVarP(&FlagOAuthAuthStyle, "oauth-auth-style", "", "basic",
+		"how the client authenticates to the token endpoint: 'basic' (HTTP Basic) "+
+			"or 'post' (client_id and client_secret in the form)")
+
+	nFlags.StringVarP(&FlagOAuthCA, "oauth-ca", "", "",
+		"CA bundle trusted for the OAuth2 token endpoint (default: the system roots; "+
+			"the --dest-* TLS settings are not used for it)")
+
+	nFlags.StringVarP(&FlagSignKeys, "sign-keys", "", "",
+		"JSON keyring of HMAC-SHA256 and Ed25519 keys used to sign deliveries "+
+			"and to verify signatures")
+
+	nFlags.StringArrayVarP(&FlagSignKeyIDs, "sign-key-id", "", []string{},
+		"id of the keyring key that signs each delivery (may be repeated, "+
+			"to sign with both keys while rotating)")
+
+	nFlags.StringVarP(&FlagSignHeader, "sign-header", "", "P3id-Signature",
+		"header carrying the delivery signatures")
+
+	nFlags.StringVarP(&FlagSignTimestampHeader, "sign-timestamp-header", "", "P3id-Signature-Timestamp",
+		"header carrying the signing time (unix seconds)")
+
+	nFlags.BoolVarP(&FlagVerifySignatures, "verify-signatures", "", false,
+		"/reflect refuses (401) requests without a valid signature from a keyring key")
+
+	nFlags.DurationVarP(&FlagSignatureMaxAge, "signature-max-age", "", 5*time.Minute,
+		"how far the signing time may be from now before /reflect refuses it")
+
+	nFlags.StringVarP(&FlagIdempotencyFile, "idempotency-file", "", "",
+		"file recording the documents delivered to each destination; when set, "+
+			"a document sent again is acknowledged without being forwarded again")
+
+	nFlags.DurationVarP(&FlagIdempotencyRetention, "idempotency-retention", "", 30*24*time.Hour,
+		"how long a delivery is remembered in --idempotency-file (0 is forever)")
+
+	nFlags.StringVarP(&FlagIdempotencyHeader, "idempotency-header", "", "Idempotency-Key",
+		"header carrying the key derived from the document id, revision and event "+
+			"sequence (empty to not send one)")
+
+	nFlags.StringVarP(&FlagStaleRevisions, "stale-revisions", "", "drop",
+		"what to do with a revision older than one already delivered: 'drop' it, "+
+			"or 'flag' it with a "+STALEREVISIONHEADER+" header and deliver it")
+
+	nFlags.BoolVarP(&FlagAsync, "async", "", false,
+		"answer every /xml2json request 202 Accepted with a job id once it is converted, "+
+			"and deliver it in the background (a request can ask for this with "+
+			"'Prefer: respond-async')")
+
+	nFlags.IntVarP(&FlagAsyncWorkers, "async-workers", "", 8,
+		"how many async deliveries run at once (0 turns async mode off)")
+
+	nFlags.IntVarP(&FlagAsyncBacklog, "async-backlog", "", 1000,
+		"how many async documents may wait for a worker before requests are refused (503)")
+
+	nFlags.DurationVarP(&FlagJobRetention, "job-retention", "", time.Hour,
+		"how long a finished async job can still be looked up at /jobs/{id}")
+
+	nFlags.StringVarP(&FlagDeadLetterDir, "deadletter-dir", "", "",
+		"directory keeping documents whose delivery failed for good, so they can be "+
+			"examined and replayed")
+
+	nFlags.StringVarP(&FlagSequenceFormat, "sequence-format", "", "base36",
+		"format of the P3id-Sequence id given each document: 'base36' (time-counter), "+
+			"'ulid' or 'uuidv7'")
+
+	nFlags.StringVarP(&FlagSequenceFile, "sequence-file", "", "",
+		"file keeping the P3id-Sequence counter across restarts")
+
 	nFlags.StringVarP(&FlagDest, "destination", "",
 		"localhost",
 		"destination for Xml2Json endpoint. "+
@@ -95,13 +331,43 @@ func initFlags() {
 			"becomes \"https://localhost:<port>/reflect\" where"+
 			"<port> is the port of this program.")
 
-	/*
-		nFlags.StringArrayVarP(&FlagHeaderKey, "header-key", "", []string{"AUTHORIZATION"},
-			"Header Key (must be in same order as value)")
+	nFlags.StringVarP(&FlagHeaderPolicy, "header-policy", "", "",
+		"JSON file saying which headers /xml2json forwards, renames, injects "+
+			"and strips, and which destination response headers it returns")
 
-		nFlags.StringArrayVarP(&FlagHeaderValue, "header-value", "", []string{"bearer ****DuMmY*ToKeN****="},
-			"Header Value(must be in same order as key)")
-	*/
+	nFlags.StringArrayVarP(&FlagHeaderKey, "header-key", "", []string{},
+		"Header to inject into every /xml2json delivery (must be in same order as value)")
+
+	nFlags.StringArrayVarP(&FlagHeaderValue, "header-value", "", []string{},
+		"Header Value(must be in same order as key)")
+
+	nFlags.DurationVarP(&FlagDestTimeout, "dest-timeout", "", time.Minute,
+		"time allowed for one delivery to the destination, including all of its retries")
+
+	nFlags.DurationVarP(&FlagDestDialTimeout, "dest-dial-timeout", "", 10*time.Second,
+		"time allowed to open a TCP connection to the destination")
+
+	nFlags.DurationVarP(&FlagDestTLSTimeout, "dest-tls-timeout", "", 10*time.Second,
+		"time allowed for the TLS handshake with the destination")
+
+	nFlags.DurationVarP(&FlagDestIdleTimeout, "dest-idle-timeout", "", 90*time.Second,
+		"how long an idle kept-alive connection to the destination is held open")
+
+	nFlags.IntVarP(&FlagDestMaxIdle, "dest-max-idle", "", 100,
+		"most idle kept-alive connections held open, across all destinations")
+
+	nFlags.IntVarP(&FlagDestMaxIdlePerHost, "dest-max-idle-per-host", "", 16,
+		"most idle kept-alive connections held open to any one destination host")
+
+	nFlags.IntVarP(&FlagDestMaxConnsPerHost, "dest-max-conns-per-host", "", 0,
+		"most connections (busy or idle) to any one destination host; 0 is unlimited")
+
+	nFlags.BoolVarP(&FlagDestHTTP2, "dest-http2", "", true,
+		"use HTTP/2 with destinations that offer it (--dest-http2=false for HTTP/1.1 only)")
+
+	nFlags.StringVarP(&FlagDestProxy, "dest-proxy", "", "",
+		"proxy for destination connections, e.g. http://proxy.corp:3128 or "+
+			"socks5://proxy.corp:1080 (default: HTTPS_PROXY / HTTP_PROXY / NO_PROXY)")
 
 	nFlags.StringVarP(&FlagServiceName, "servername", "", "",
 		"Name of service/FQDN \"microservice.example.com\" <<not fully tested>> ")
@@ -116,20 +382,27 @@ func initFlags() {
 		"Certificate file for HTTPS service")
 
 	for flagName, optName := range hideFlags {
-		err = nFlags.MarkHidden(optName)
+		err := nFlags.MarkHidden(optName)
 		if nil != err {
-			xLog.Printf("could not mark option %s as %s hidden because %s\n",
+			safeLogPrintf("could not mark option %s as %s hidden because %s\n",
 				optName, flagName, err.Error())
 			myFatal()
 		}
 	}
 
 	// Fetch and load the program flags
-	err = nFlags.Parse(os.Args[1:])
-	if nil != err {
+	return nFlags.Parse(os.Args[1:])
+}
+
+// initFlags checks and applies the flags parseFlags read; parseErr is
+// what parseFlags returned
+func initFlags(parseErr error) {
+	var err error
+
+	if nil != parseErr {
 		_, _ = fmt.Fprintf(os.Stderr, "\n%s\n", nFlags.FlagUsagesWrapped(75))
 		xLog.Fatalf("\nerror parsing flags because: %s\n%s %s\n%s\n\t%v\n",
-			err.Error(),
+			parseErr.Error(),
 			"  common issue: 2 hyphens for long-form arguments,",
 			"  1 hyphen for short-form argument",
 			"  Program arguments are: ",
@@ -161,27 +434,69 @@ func initFlags() {
 	}
 
 	if FlagDebug || FlagVerbose {
-		xLog.Println("\t\t/*** start program flags ***/\n")
+		xLog.Println("\t\t/*** start program flags ***/")
 		nFlags.VisitAll(logFlag)
 		xLog.Println("\t\t/***   end program flags ***/")
 	}
-	/*
-			if len(FlagHeaderKey) != len(FlagHeaderValue) {
-				logPrintf("count of --header-key values (%d) does not equal count of --header-value (%d)",
-					len(FlagHeaderKey), len(FlagHeaderValue))
-				myFatal()
-			}
-
-			if FlagVerbose || FlagDebug {
-				var sb strings.Builder
-				sb.WriteString(fmt.Sprintf("\n%s\n\tCommand Line Headers\n", SEP))
-				for ix := range FlagHeaderKey {
-					sb.WriteString(fmt.Sprintf("[header %3d] %s=%s\n",
-						ix, FlagHeaderKey[ix], FlagHeaderValue[ix]))
-				}
-				logPrintf(sb.String())
-			}
+	xResponseMode, err = parseResponseMode(FlagResponseMode)
+	if nil != err {
+		xLog.Printf("Got bad value for --response-mode: %s", err.Error())
+		myFatal()
+	}
+
+	xSequence.format, err = parseSequenceFormat(FlagSequenceFormat)
+	if nil != err {
+		xLog.Printf("Got bad value for --sequence-format: %s", err.Error())
+		myFatal()
+	}
+
+	if misc.IsStringSet(&FlagDestProxy) {
+		outboundProxyURL, err = url.Parse(FlagDestProxy)
+		if nil != err || !misc.IsStringSet(&outboundProxyURL.Host) {
+			xLog.Printf("Got bad value for --dest-proxy: %s (want scheme://host:port)", FlagDestProxy)
+			myFatal()
+		}
+	}
+
+	if FlagAsyncWorkers < 0 || FlagAsyncBacklog < 1 {
+		xLog.Printf("Got bad value for --async-workers (%d) or --async-backlog (%d)",
+			FlagAsyncWorkers, FlagAsyncBacklog)
+		myFatal()
+	}
+	if FlagAsync && FlagAsyncWorkers == 0 {
+		xLog.Printf("--async needs --async-workers")
+		myFatal()
+	}
+
+	if FlagStaleRevisions != "drop" && FlagStaleRevisions != "flag" {
+		xLog.Printf("Got bad value for --stale-revisions: %s (want drop or flag)", FlagStaleRevisions)
+		myFatal()
+	}
+
+	if len(FlagHeaderKey) != len(FlagHeaderValue) {
+		xLog.Printf("count of --header-key values (%d) does not equal count of --header-value (%d)",
+			len(FlagHeaderKey), len(FlagHeaderValue))
+		myFatal()
+	}
+
+	if misc.IsStringSet(&FlagHeaderPolicy) {
+		xHeaderPolicy, err = loadHeaderPolicy(FlagHeaderPolicy)
+		if nil != err {
+			xLog.Printf("could not load --header-policy %s because %s", FlagHeaderPolicy, err.Error())
+			myFatal()
+		}
+	}
+	if nil == xHeaderPolicy.Inject {
+		xHeaderPolicy.Inject = make(map[string]headerValue, len(FlagHeaderKey))
+	}
+	for ix := range FlagHeaderKey {
+		xHeaderPolicy.Inject[FlagHeaderKey[ix]] = headerValue{Value: FlagHeaderValue[ix]}
+	}
 
+	if FlagVerbose || FlagDebug {
+		xLog.Printf("\n%s\n\tHeader Policy\n%s\n%s", SEP, xHeaderPolicy.String(), SEP)
+	}
+	/*
 		if FlagDestInsecure && !FlagDebug {
 			xLog.Printf("--insecure cannot be used without --debug. DO NOT USE --insecure IN PRODUCTION.")
 			myFatal()
@@ -237,12 +552,84 @@ func initFlags() {
 		xLog.Printf("Listening on port %d", portNumber)
 	}
 
+	if FlagRetryMax < 0 {
+		xLog.Printf("Got bad value for --retry-max: %d (must not be negative)", FlagRetryMax)
+		myFatal()
+	}
+
+	if policy, err := parseConversionPolicy(FlagConversionFailure); nil != err {
+		xLog.Printf("Got bad value for --conversion-failure: %s", err.Error())
+		myFatal()
+	} else {
+		FlagConversionFailure = string(policy)
+	}
+
+	if FlagBatchEvents != batchSeparate && FlagBatchEvents != batchArray {
+		xLog.Printf("Got bad value for --batch-events: %s (want %s or %s)",
+			FlagBatchEvents, batchSeparate, batchArray)
+		myFatal()
+	}
+
+	if policy, err := parseLowConfidencePolicy(FlagLowConfidence); nil != err {
+		xLog.Printf("Got bad value for --low-confidence: %s", err.Error())
+		myFatal()
+	} else {
+		FlagLowConfidence = string(policy)
+	}
+	if FlagMinConfidence < 0 {
+		xLog.Printf("Got bad value for --min-confidence: %g (must not be negative)", FlagMinConfidence)
+		myFatal()
+	}
+
+	if xProfile, err = loadXmlProfile(FlagXmlProfile); nil != err {
+		xLog.Printf("could not load --xml-profile %s because %s", FlagXmlProfile, err.Error())
+		myFatal()
+	}
+
 	if misc.IsStringSet(&FlagRemapFieldNames) {
 		FlagRemapMap = loadFieldTranslations(FlagRemapFieldNames)
 	} else {
 		FlagRemapMap = make(map[string]remapField)
 	}
 
+	xDefaultRoute, err = makeDefaultRoute()
+	if nil != err {
+		xLog.Printf("could not set up --destination %s because %s", FlagDest, err.Error())
+		myFatal()
+	}
+
+	if misc.IsStringSet(&FlagSignKeys) {
+		xKeyring, err = loadKeyring(FlagSignKeys)
+		if nil != err {
+			xLog.Printf("could not load --sign-keys because %s", err.Error())
+			myFatal()
+		}
+	}
+	if len(FlagSignKeyIDs) > 0 && nil == xKeyring {
+		xLog.Printf("--sign-key-id needs --sign-keys")
+		myFatal()
+	}
+	for _, id := range FlagSignKeyIDs {
+		key, ok := xKeyring.byID[id]
+		if !ok {
+			xLog.Printf("--sign-key-id %s is not in the keyring %s", id, FlagSignKeys)
+			myFatal()
+		}
+		xSigners = append(xSigners, key)
+	}
+	if FlagVerifySignatures && nil == xKeyring {
+		xLog.Printf("--verify-signatures needs --sign-keys")
+		myFatal()
+	}
+
+	if misc.IsStringSet(&FlagRoutes) {
+		xRoutes, err = loadRoutingTable(FlagRoutes)
+		if nil != err {
+			xLog.Printf("could not load --routes %s because %s", FlagRoutes, err.Error())
+			myFatal()
+		}
+	}
+
 }
 
 // logFlag -- This writes out to the logger the value of a
@@ -3,7 +3,7 @@ package main
 import (
 	"context"
 	_ "encoding/json"
-	"encoding/xml"
+	"errors"
 	"github.com/go-kit/kit/endpoint"
 	"io"
 	"net/http"
@@ -11,8 +11,14 @@ import (
 )
 
 type ConvertResponse struct {
-	Success string `json:"success"`
-	Error   string `json:"error,omitempty"`
+	Success    string         `json:"success"`
+	Error      string         `json:"error,omitempty"`
+	Violations []fieldFailure `json:"violations,omitempty"`
+	// Sequence and DocumentID say which event of a batch this is, and
+	// Events are the results of each event of a batch
+	Sequence   string            `json:"sequence,omitempty"`
+	DocumentID string            `json:"document_id,omitempty"`
+	Events     []ConvertResponse `json:"events,omitempty"`
 }
 
 type ConvertRequest XtractaEvents
@@ -21,7 +27,7 @@ func (pr ConvertRequest) String() string {
 	return XtractaEvents(pr).String()
 }
 
-func (pr ConvertRequest) Json() string {
+func (pr ConvertRequest) Json() (string, error) {
 	return XtractaEvents(pr).Json()
 }
 
@@ -67,7 +73,8 @@ func decodeConvertRequest(_ context.Context, r *http.Request) (interface{}, erro
 		xLog.Printf("io.ReadAll failed on ConvertRequest because %s", err.Error())
 		return nil, err
 	}
-	err = xml.Unmarshal(body, &request)
+	events, err := readDocuments(body)
+	request = ConvertRequest(events)
 	if nil != err {
 		xLog.Printf("xml.Unmarshal failed because %s", err.Error())
 		return nil, err
@@ -79,12 +86,31 @@ func decodeConvertRequest(_ context.Context, r *http.Request) (interface{}, erro
 func makeConvertEndpoint(svc SimpleService) endpoint.Endpoint {
 	return func(_ context.Context, request interface{}) (interface{}, error) {
 		req := request.(ConvertRequest)
-		_, err := svc.Convert(req)
-		if err != nil {
-			if err != nil {
-				return ConvertResponse{"FAILURE", err.Error()}, nil
+		if len(req.More) == 0 {
+			return convertOne(svc, req), nil
+		}
+		// a batch: each event is converted by itself
+		response := ConvertResponse{Success: "Success"}
+		for _, one := range XtractaEvents(req).Split() {
+			r := convertOne(svc, ConvertRequest(one))
+			r.Sequence, r.DocumentID = one.Event.Sequence, one.Event.Document.DocumentID
+			if "Success" != r.Success {
+				response.Success = "FAILURE"
 			}
+			response.Events = append(response.Events, r)
+		}
+		return response, nil
+	}
+}
+
+func convertOne(svc SimpleService, req ConvertRequest) ConvertResponse {
+	c, err := svc.Convert(req)
+	if err != nil {
+		var ce conversionError
+		if errors.As(err, &ce) {
+			return ConvertResponse{Success: "FAILURE", Error: err.Error(), Violations: append(ce.Failures, c.Violations...)}
 		}
-		return ConvertResponse{"Success", ""}, nil
+		return ConvertResponse{Success: "FAILURE", Error: err.Error()}
 	}
+	return ConvertResponse{Success: "Success", Violations: c.Violations}
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	ambiguousFirst = "first" // use the first layout that fits, and log it
+	ambiguousFail  = "fail"  // treat it as a value that does not convert
+)
+
+// defaultDateLayouts are tried for a date field with no in= option: a
+// value both fit differently (3/1/2023) is ambiguous, and is read month
+// first unless the field says ambiguous=fail
+var defaultDateLayouts = []string{XmlDateLayout, xmlDateLayoutDayFirst}
+
+// defaultDateTimeLayouts are tried for a datetime field with no in= option
+var defaultDateTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+}
+
+// dateFormat is how a date or datetime field is read and written
+type dateFormat struct {
+	// In are the layouts tried, in order, on the value
+	In []string
+	// Out is the layout it is sent in
+	Out string
+	// Zone is the time zone of values that do not carry an offset
+	Zone *time.Location
+	// OutZone, if set, is the time zone a datetime is sent in
+	OutZone *time.Location
+	// Ambiguous is what happens when layouts disagree about a value
+	Ambiguous string
+}
+
+// dateLayout accepts a Go reference layout, or one of the names below
+func dateLayout(s string) string {
+	switch strings.ToLower(s) {
+	case "rfc3339", "iso8601":
+		return time.RFC3339Nano
+	case "date":
+		return "2006-01-02"
+	}
+	return s
+}
+
+// convertDate reads val with the first of the field's layouts that
+// fits. When a later layout also fits but gives another time (3/1/2023
+// as 3 January and as 1 March), the value is ambiguous.
+func convertDate(rm *remapField, val string) (string, error) {
+	df := rm.Dates
+	layouts := df.In
+	if len(layouts) == 0 {
+		if JsonDateTime == rm.FieldType {
+			layouts = defaultDateTimeLayouts
+		} else {
+			layouts = defaultDateLayouts
+		}
+	}
+	zone := df.Zone
+	if nil == zone {
+		zone = time.UTC
+	}
+
+	val = strings.TrimSpace(val)
+	var when time.Time
+	found := false
+	for _, layout := range layouts {
+		t, err := time.ParseInLocation(layout, val, zone)
+		if nil != err {
+			continue
+		}
+		if !found {
+			when, found = t, true
+			continue
+		}
+		if !t.Equal(when) {
+			shown := time.RFC3339
+			if JsonDate == rm.FieldType {
+				shown = JsonDateLayout
+			}
+			err = fmt.Errorf("is ambiguous (%s or %s)", when.Format(shown), t.Format(shown))
+			if ambiguousFail == df.Ambiguous {
+				return "", err
+			}
+			xLog.Printf("huh? Field %s has value %q, which %s -- using the first",
+				rm.JsonName, val, err.Error())
+			break
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("is not a date like %s", strings.Join(layouts, " or "))
+	}
+
+	out := df.Out
+	if JsonDateTime == rm.FieldType {
+		if nil != df.OutZone {
+			when = when.In(df.OutZone)
+		}
+		if "" == out {
+			out = time.RFC3339
+		}
+	} else if "" == out {
+		out = JsonDateLayout
+	}
+	return when.Format(out), nil
+}
+
+// reverseDate writes a date as sent the way the field reads it: in its
+// first in= layout, and its tz= time zone. A value that is not a date
+// as sent is returned as it is.
+func reverseDate(rm *remapField, val string) string {
+	df := rm.Dates
+	out, in := df.Out, XmlDateLayout
+	if JsonDateTime == rm.FieldType {
+		in = defaultDateTimeLayouts[0]
+		if "" == out {
+			out = time.RFC3339
+		}
+	} else if "" == out {
+		out = JsonDateLayout
+	}
+	if len(df.In) > 0 {
+		in = df.In[0]
+	}
+	when, err := time.Parse(out, strings.TrimSpace(val))
+	if nil != err {
+		return val
+	}
+	if nil != df.Zone {
+		when = when.In(df.Zone)
+	}
+	// _2 pads the day with a space
+	return strings.TrimSpace(when.Format(in))
+}
+
+// setDateOption applies the date options of the mapping file
+func (r *remapField) setDateOption(key string, value string) (err error) {
+	switch key {
+	case "in":
+		r.Dates.In = r.Dates.In[:0]
+		for _, layout := range strings.Split(value, "|") {
+			if layout = strings.TrimSpace(layout); "" != layout {
+				r.Dates.In = append(r.Dates.In, dateLayout(layout))
+			}
+		}
+		if len(r.Dates.In) == 0 {
+			return errors.New("in= needs at least one layout")
+		}
+	case "out":
+		r.Dates.Out = dateLayout(value)
+	case "tz":
+		r.Dates.Zone, err = time.LoadLocation(value)
+	case "outtz":
+		r.Dates.OutZone, err = time.LoadLocation(value)
+	case "ambiguous":
+		switch strings.ToLower(value) {
+		case ambiguousFirst, ambiguousFail:
+			r.Dates.Ambiguous = strings.ToLower(value)
+		default:
+			err = fmt.Errorf("ambiguous=%s (want %s or %s)", value, ambiguousFirst, ambiguousFail)
+		}
+	}
+	return err
+}
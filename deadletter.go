@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/endpoint"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflectsvc/misc"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const REDACTED = "[redacted]"
+
+// keep the attempt history of a long-queued item from growing forever
+const maxAttemptHistory = 20
+
+// deliveryAttempt is one try at sending a document
+type deliveryAttempt struct {
+	Time   time.Time `json:"time"`
+	Code   int       `json:"code,omitempty"`
+	Status string    `json:"status,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+func newDeliveryAttempt(tried time.Time, xj x2jProxyData, err error) deliveryAttempt {
+	a := deliveryAttempt{Time: tried, Code: xj.Code, Status: xj.Status}
+	if nil != err {
+		a.Error = err.Error()
+	}
+	return a
+}
+
+// deadLetter is a document that could not be delivered: the XML as it
+// arrived, the json sent, and enough about the attempts to see why.
+// Headers are as sent, less anything secret.
+type deadLetter struct {
+	ID          string            `json:"id"`
+	Created     time.Time         `json:"created"`
+	Route       string            `json:"route,omitempty"`
+	Destination string            `json:"destination"`
+	DocumentID  string            `json:"documentId,omitempty"`
+	Revision    string            `json:"revision,omitempty"`
+	Sequence    string            `json:"sequence,omitempty"`
+	Code        int               `json:"code,omitempty"`
+	Error       string            `json:"error"`
+	Headers     http.Header       `json:"headers,omitempty"`
+	XML         string            `json:"xml,omitempty"`
+	JSON        string            `json:"json"`
+	Attempts    []deliveryAttempt `json:"attempts,omitempty"`
+	Replays     int               `json:"replays,omitempty"`
+}
+
+func (d deadLetter) String() string {
+	return fmt.Sprintf("%s  created %s  document %s rev %s  route %s  destination %s\n\terror: %s  (%d attempt(s), %d replay(s))",
+		d.ID, d.Created.UTC().Format(time.RFC3339), d.DocumentID, d.Revision, d.Route, d.Destination,
+		d.Error, len(d.Attempts), d.Replays)
+}
+
+// deadLetterStore is a directory of deadLetter files, named so they
+// sort oldest first
+type deadLetterStore struct {
+	dir string
+	mx  sync.Mutex
+	seq int64
+}
+
+// xDeadLetters is nil unless --deadletter-dir is set
+var xDeadLetters *deadLetterStore
+
+func openDeadLetters(dir string) (*deadLetterStore, error) {
+	if err := os.MkdirAll(dir, 0755); nil != err {
+		return nil, err
+	}
+	return &deadLetterStore{dir: dir}, nil
+}
+
+func (s *deadLetterStore) fileName(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// deliveryError is why a delivery failed: the error, or else the
+// destination's status
+func deliveryError(xj x2jProxyData) string {
+	if misc.IsStringSet(&xj.Error) {
+		return xj.Error
+	}
+	return xj.Status
+}
+
+// makeDeadLetter records a failed delivery of jsonBody to rt
+func makeDeadLetter(rt *route, rawXML []byte, jsonBody string, xj x2jProxyData) deadLetter {
+	d := deadLetter{
+		Route:       rt.Name,
+		Destination: rt.Destination,
+		Code:        xj.Code,
+		Error:       deliveryError(xj),
+		Headers:     redactHeaders(xj.Sent),
+		XML:         string(rawXML),
+		JSON:        jsonBody,
+		Attempts:    xj.History,
+		Sequence:    xj.Sent.Get(P3IDSEQUENCEHEADER),
+	}
+	if events, err := readDocuments(rawXML); nil == err {
+		d.DocumentID = events.Event.Document.DocumentID
+		d.Revision = events.Event.Document.Revision
+	}
+	return d
+}
+
+// Add stores a dead letter, returning its id
+func (s *deadLetterStore) Add(d deadLetter) (string, error) {
+	s.mx.Lock()
+	d.ID = fmt.Sprintf("%020d-%06d", time.Now().UnixNano(), s.seq%1000000)
+	s.seq++
+	s.mx.Unlock()
+	d.Created = time.Now().UTC()
+	if err := s.write(d); nil != err {
+		return "", err
+	}
+	xLog.Printf("dead-lettered document %s [%s] for %s as %s: %s",
+		d.DocumentID, d.Sequence, d.Destination, d.ID, d.Error)
+	return d.ID, nil
+}
+
+func (s *deadLetterStore) write(d deadLetter) error {
+	data, err := json.MarshalIndent(d, "", "  ")
+	if nil != err {
+		return err
+	}
+	return misc.WriteFileAtomic(s.fileName(d.ID), data, 0600)
+}
+
+// IDs returns the dead letter ids, oldest first
+func (s *deadLetterStore) IDs() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if nil != err {
+		return nil, err
+	}
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(name, ".json"))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (s *deadLetterStore) Get(id string) (d deadLetter, err error) {
+	if strings.ContainsAny(id, `/\`) {
+		return d, os.ErrNotExist
+	}
+	data, err := os.ReadFile(s.fileName(id))
+	if nil != err {
+		return d, err
+	}
+	err = json.Unmarshal(data, &d)
+	return d, err
+}
+
+func (s *deadLetterStore) Remove(id string) error {
+	if strings.ContainsAny(id, `/\`) {
+		return os.ErrNotExist
+	}
+	return os.Remove(s.fileName(id))
+}
+
+// Replay sends a dead letter again: the stored json as it is, or (with
+// reconvert) the stored XML converted with the current field mapping.
+// Headers are rebuilt for the route (fresh sequence, injected headers,
+// token and signature) and the stored ones that were not redacted are
+// added back; forwarded secrets, such as the caller's Authorization,
+// are gone. The dead letter is removed once delivered, otherwise it
+// is updated with the new attempts.
+func (s *deadLetterStore) Replay(id string, reconvert bool) (x2jProxyData, error) {
+	d, err := s.Get(id)
+	if nil != err {
+		return x2jProxyData{}, err
+	}
+	rt, ok := lookupRoute(d.Route)
+	if !ok {
+		rt = defaultRoute()
+	}
+	sendTo := *rt
+	sendTo.Destination = d.Destination
+
+	body := d.JSON
+	if reconvert {
+		events, err := readDocuments([]byte(d.XML))
+		if nil != err || !misc.IsStringSet(&d.XML) {
+			return x2jProxyData{}, fmt.Errorf("dead letter %s has no usable XML to convert again", id)
+		}
+		c, err := events.ConvertAll(sendTo.remap)
+		if body = c.Body; nil != err || len(c.Violations) > 0 {
+			// refused the way /xml2json refuses it
+			err = c.refused(err)
+			xj := x2jProxyData{Route: sendTo.Name, Destination: sendTo.Destination,
+				Code: http.StatusUnprocessableEntity, Status: err.Error()}
+			var ce conversionError
+			if errors.As(err, &ce) {
+				xj.Failures = ce.Failures
+			}
+			return xj, fmt.Errorf("dead letter %s could not be converted again: %w", id, err)
+		}
+	}
+
+	xj, err := x2jDeliver(&sendTo, resendHeaders(&sendTo, d.Headers), []byte(body))
+	xj.Route = sendTo.Name
+	xj.Destination = sendTo.Destination
+	if nil == err && xj.Code >= 200 && xj.Code < 300 {
+		xLog.Printf("replayed dead letter %s [%s] to %s: %s", id, d.Sequence, sendTo.Destination, xj.Status)
+		return xj, s.Remove(id)
+	}
+
+	d.Replays++
+	d.Code = xj.Code
+	d.Error = deliveryError(xj)
+	d.Attempts = append(d.Attempts, xj.History...)
+	if writeErr := s.write(d); nil != writeErr {
+		xLog.Printf("could not update dead letter %s because %s", id, writeErr.Error())
+	}
+	if nil == err {
+		err = fmt.Errorf("destination returned %s", xj.Status)
+	}
+	return xj, err
+}
+
+// resendHeaders rebuilds the headers of a stored delivery for rt:
+// fresh ones for the route (injected headers; x2jDeliver adds the token
+// and signature), the stored sequence, so the delivery can be traced
+// to it, and the stored headers that were not redacted
+func resendHeaders(rt *route, stored http.Header) http.Header {
+	extra := make(http.Header)
+	if seq := stored.Get(P3IDSEQUENCEHEADER); misc.IsStringSet(&seq) {
+		extra.Set(P3IDSEQUENCEHEADER, seq)
+	}
+	header := x2jOutboundHeaders(rt, nil, extra)
+	for key, values := range stored {
+		if _, set := header[key]; set || key == FlagSignHeader ||
+			key == FlagSignTimestampHeader {
+			continue
+		}
+		if len(values) > 0 && values[0] == REDACTED {
+			continue
+		}
+		header[key] = values
+	}
+	return header
+}
+
+// redactHeaders copies h, hiding the values of headers that carry
+// credentials: those named like one, and anything the header policy
+// injects from the environment.
+func redactHeaders(h http.Header) http.Header {
+	if nil == h {
+		return nil
+	}
+	out := make(http.Header, len(h))
+	for key, values := range h {
+		if isSecretHeader(key) {
+			out[key] = []string{REDACTED}
+			continue
+		}
+		out[key] = append([]string(nil), values...)
+	}
+	return out
+}
+
+func isSecretHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	if name == http.CanonicalHeaderKey(FlagIdempotencyHeader) {
+		return false
+	}
+	switch name {
+	case "Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie":
+		return true
+	}
+	for key, value := range xHeaderPolicy.Inject {
+		if misc.IsStringSet(&value.Env) && http.CanonicalHeaderKey(key) == name {
+			return true
+		}
+	}
+	lower := strings.ToLower(name)
+	for _, word := range []string{"key", "token", "secret", "password", "auth"} {
+		if strings.Contains(lower, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// deadLetterCommand implements `reflectsvc deadletter list|show|replay|purge`
+func deadLetterCommand(args []string) int {
+	if !misc.IsStringSet(&FlagDeadLetterDir) {
+		_, _ = fmt.Fprintln(os.Stderr, "the deadletter commands need --deadletter-dir")
+		return 2
+	}
+	s, err := openDeadLetters(FlagDeadLetterDir)
+	if nil != err {
+		_, _ = fmt.Fprintf(os.Stderr, "could not open %s because %s\n", FlagDeadLetterDir, err.Error())
+		return 1
+	}
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	ids, err := s.IDs()
+	if nil != err {
+		_, _ = fmt.Fprintf(os.Stderr, "could not read %s because %s\n", FlagDeadLetterDir, err.Error())
+		return 1
+	}
+
+	switch args[0] {
+	case "list":
+		for _, id := range ids {
+			d, err := s.Get(id)
+			if nil != err {
+				_, _ = fmt.Fprintf(os.Stdout, "%s  (unreadable: %s)\n", id, err.Error())
+				continue
+			}
+			_, _ = fmt.Fprintln(os.Stdout, d.String())
+		}
+		_, _ = fmt.Fprintf(os.Stdout, "%d dead letter(s) in %s\n", len(ids), FlagDeadLetterDir)
+	case "show":
+		if len(args) < 2 {
+			_, _ = fmt.Fprintln(os.Stderr, "usage: reflectsvc deadletter show <id>...")
+			return 2
+		}
+		for _, id := range args[1:] {
+			data, err := os.ReadFile(s.fileName(id))
+			if nil != err {
+				_, _ = fmt.Fprintf(os.Stderr, "could not read %s because %s\n", id, err.Error())
+				return 1
+			}
+			_, _ = os.Stdout.Write(data)
+			_, _ = fmt.Fprintln(os.Stdout)
+		}
+	case "replay":
+		// replay [reconvert] [id...]; with no ids, replay everything
+		args = args[1:]
+		reconvert := len(args) > 0 && args[0] == "reconvert"
+		if reconvert {
+			args = args[1:]
+		}
+		if len(args) > 0 {
+			ids = args
+		}
+		failed := 0
+		for _, id := range ids {
+			xj, err := s.Replay(id, reconvert)
+			if nil != err {
+				failed++
+				_, _ = fmt.Fprintf(os.Stdout, "%s  FAILED: %s\n", id, err.Error())
+				continue
+			}
+			_, _ = fmt.Fprintf(os.Stdout, "%s  delivered to %s: %s\n", id, xj.Destination, xj.Status)
+		}
+		_, _ = fmt.Fprintf(os.Stdout, "replayed %d dead letter(s), %d failed\n", len(ids)-failed, failed)
+		if failed > 0 {
+			return 1
+		}
+	case "purge":
+		// with no ids, purge everything
+		if len(args) > 1 {
+			ids = args[1:]
+		}
+		for _, id := range ids {
+			if err = s.Remove(id); nil != err {
+				_, _ = fmt.Fprintf(os.Stderr, "could not purge %s because %s\n", id, err.Error())
+				return 1
+			}
+		}
+		_, _ = fmt.Fprintf(os.Stdout, "purged %d dead letter(s) from %s\n", len(ids), FlagDeadLetterDir)
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "unknown deadletter command %q (want list, show, replay or purge)\n", args[0])
+		return 2
+	}
+	return 0
+}
+
+// the admin endpoints:
+//
+//	GET    /admin/deadletters                    list
+//	DELETE /admin/deadletters                    purge everything
+//	GET    /admin/deadletters/{id}               show
+//	DELETE /admin/deadletters/{id}               purge one
+//	POST   /admin/deadletters/{id}/replay        replay the stored json
+//	POST   /admin/deadletters/{id}/replay?reconvert=true
+type deadLetterAdminRequest struct {
+	Method    string
+	ID        string
+	Replay    bool
+	Reconvert bool
+}
+
+type deadLetterListResponse struct {
+	DeadLetters []deadLetter `json:"deadLetters"`
+}
+
+type deadLetterPurgeResponse struct {
+	Removed int `json:"removed"`
+}
+
+type deadLetterReplayResponse struct {
+	ID          string `json:"id"`
+	Success     bool   `json:"success"`
+	Destination string `json:"destination"`
+	Code        int    `json:"code,omitempty"`
+	Status      string `json:"status,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// Fields are the problems that kept a reconverted document from
+	// being sent
+	Fields []fieldFailure `json:"fields,omitempty"`
+}
+
+func makeDeadLetterAdminEndpoint() endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req := request.(deadLetterAdminRequest)
+		if nil == xDeadLetters {
+			return nil, statusError{errors.New("the dead-letter store is not enabled (see --deadletter-dir)"),
+				http.StatusNotFound}
+		}
+		ids := []string{req.ID}
+		if !misc.IsStringSet(&req.ID) {
+			var err error
+			if ids, err = xDeadLetters.IDs(); nil != err {
+				return nil, err
+			}
+		}
+
+		switch {
+		case req.Replay:
+			xj, err := xDeadLetters.Replay(req.ID, req.Reconvert)
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, statusError{fmt.Errorf("no dead letter %s", req.ID), http.StatusNotFound}
+			}
+			rsp := deadLetterReplayResponse{ID: req.ID, Success: nil == err,
+				Destination: xj.Destination, Code: xj.Code, Status: xj.Status, Fields: xj.Failures}
+			if nil != err {
+				rsp.Error = err.Error()
+			}
+			return rsp, nil
+		case req.Method == http.MethodDelete:
+			removed := 0
+			for _, id := range ids {
+				if err := xDeadLetters.Remove(id); nil == err {
+					removed++
+				}
+			}
+			if removed == 0 && misc.IsStringSet(&req.ID) {
+				return nil, statusError{fmt.Errorf("no dead letter %s", req.ID), http.StatusNotFound}
+			}
+			xLog.Printf("purged %d dead letter(s)", removed)
+			return deadLetterPurgeResponse{Removed: removed}, nil
+		case misc.IsStringSet(&req.ID):
+			d, err := xDeadLetters.Get(req.ID)
+			if nil != err {
+				return nil, statusError{fmt.Errorf("no dead letter %s", req.ID), http.StatusNotFound}
+			}
+			return d, nil
+		}
+		list := deadLetterListResponse{DeadLetters: make([]deadLetter, 0, len(ids))}
+		for _, id := range ids {
+			if d, err := xDeadLetters.Get(id); nil == err {
+				list.DeadLetters = append(list.DeadLetters, d)
+			}
+		}
+		return list, nil
+	}
+}
+
+func decodeDeadLetterAdminRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := deadLetterAdminRequest{Method: r.Method}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/deadletters"), "/")
+	parts := strings.Split(path, "/")
+	if misc.IsStringSet(&path) {
+		req.ID = parts[0]
+	}
+	switch {
+	case len(parts) == 2 && parts[1] == "replay" && r.Method == http.MethodPost:
+		req.Replay = true
+		req.Reconvert = r.URL.Query().Get("reconvert") == "true"
+	case len(parts) > 1:
+		return nil, statusError{fmt.Errorf("unknown path %s", r.URL.Path), http.StatusNotFound}
+	case r.Method != http.MethodGet && r.Method != http.MethodDelete:
+		return nil, statusError{fmt.Errorf("%s is not supported here", r.Method), http.StatusMethodNotAllowed}
+	}
+	return req, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testMapping reads a mapping file of the lines given
+func testMapping(t *testing.T, lines ...string) map[string]remapField {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "mapping.csv")
+	if err := os.WriteFile(fn, []byte(strings.Join(lines, "\n")+"\n"), 0644); nil != err {
+		t.Fatal(err)
+	}
+	remap, problems, err := readFieldTranslations(fn)
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Fatalf("mapping %s", p.String())
+	}
+	return remap
+}
+
+// testDeadLetters makes xDeadLetters an empty store, for the test
+func testDeadLetters(t *testing.T) *deadLetterStore {
+	t.Helper()
+	saved := xDeadLetters
+	t.Cleanup(func() { xDeadLetters = saved })
+	var err error
+	if xDeadLetters, err = openDeadLetters(t.TempDir()); nil != err {
+		t.Fatal(err)
+	}
+	return xDeadLetters
+}
+
+func TestDeadLetterReplayReconvert(t *testing.T) {
+	dest := newDestination(t)
+	saved := xDefaultRoute
+	defer func() { xDefaultRoute = saved }()
+	xDefaultRoute = testRoute(t, "default", dest.URL)
+	xDefaultRoute.remap = testMapping(t, "Status;status;string;false;mustBe=open|closed")
+	s := testDeadLetters(t)
+
+	letter := func(status string) string {
+		xml := `<events><event><document><document_id>A</document_id><field_data><field>` +
+			`<field_name>Status</field_name><field_value>` + status + `</field_value></field></field_data></document></event></events>`
+		id, err := s.Add(deadLetter{Route: "default", Destination: dest.URL, XML: xml, JSON: `{"stale":true}`})
+		if nil != err {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	// breaks a validation rule: refused the way /xml2json refuses it
+	id := letter("lost")
+	xj, err := s.Replay(id, true)
+	var ce conversionError
+	if !errors.As(err, &ce) || http.StatusUnprocessableEntity != xj.Code || len(xj.Failures) != 1 ||
+		"status" != xj.Failures[0].Field {
+		t.Errorf("replay of a document breaking a rule: got %d %+v, %v", xj.Code, xj.Failures, err)
+	}
+	if len(dest.received()) != 0 {
+		t.Errorf("sent %q", dest.received())
+	}
+	if _, err = s.Get(id); nil != err {
+		t.Errorf("the dead letter is gone: %s", err)
+	}
+
+	// fixed by the mapping: sent as converted now, and removed
+	id = letter("open")
+	if xj, err = s.Replay(id, true); nil != err || http.StatusOK != xj.Code {
+		t.Fatalf("replay: got %d, %v", xj.Code, err)
+	}
+	if got := dest.received(); len(got) != 1 || `{"documentLink":"","status":"open"}` != got[0] {
+		t.Errorf("sent %q", got)
+	}
+	if _, err = s.Get(id); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("a delivered dead letter was kept: %v", err)
+	}
+}
+
+func TestDeadLetterStore(t *testing.T) {
+	s := testDeadLetters(t)
+	if ids, err := s.IDs(); nil != err || 0 != len(ids) {
+		t.Fatalf("an empty store: got %q, %v", ids, err)
+	}
+	var added []string
+	for _, doc := range []string{"A", "B", "C"} {
+		id, err := s.Add(deadLetter{DocumentID: doc, Destination: "http://x", Error: "no", JSON: `{}`})
+		if nil != err {
+			t.Fatal(err)
+		}
+		added = append(added, id)
+	}
+	// not dead letters: a file being written, a directory, and anything else
+	for _, name := range []string{".tmp-1.json", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(s.dir, name), []byte("{}"), 0600); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(s.dir, "old.json"), 0755); nil != err {
+		t.Fatal(err)
+	}
+
+	ids, err := s.IDs()
+	if nil != err || strings.Join(added, " ") != strings.Join(ids, " ") {
+		t.Errorf("got %q, %v; want them oldest first %q", ids, err, added)
+	}
+	d, err := s.Get(added[1])
+	if nil != err || added[1] != d.ID || "B" != d.DocumentID || d.Created.IsZero() {
+		t.Errorf("got %+v, %v", d, err)
+	}
+	if err = s.Remove(added[1]); nil != err {
+		t.Fatal(err)
+	}
+	if _, err = s.Get(added[1]); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("a removed dead letter: got %v", err)
+	}
+	if err = s.Remove(added[1]); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("removed twice: got %v", err)
+	}
+	if ids, _ = s.IDs(); 2 != len(ids) {
+		t.Errorf("got %q", ids)
+	}
+}
+
+func TestDeadLetterStoreOutside(t *testing.T) {
+	s := testDeadLetters(t)
+	// a dead letter, as far as the file goes, next to the store
+	outside := filepath.Join(filepath.Dir(s.dir), "outside.json")
+	if err := os.WriteFile(outside, []byte(`{"id":"outside"}`), 0600); nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Remove(outside) })
+	sub := filepath.Join(s.dir, "sub")
+	if err := os.Mkdir(sub, 0755); nil != err {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sub, "inside.json"), []byte(`{"id":"inside"}`), 0600); nil != err {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"../outside", `..\outside`, "sub/inside", "sub/../../outside"} {
+		if d, err := s.Get(id); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Get(%q): got %+v, %v", id, d, err)
+		}
+		if err := s.Remove(id); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Remove(%q): got %v", id, err)
+		}
+		if _, err := s.Replay(id, false); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Replay(%q): got %v", id, err)
+		}
+	}
+	for _, fn := range []string{outside, filepath.Join(sub, "inside.json")} {
+		if _, err := os.Stat(fn); nil != err {
+			t.Errorf("%s: %v", fn, err)
+		}
+	}
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	refused := true
+	var got []*http.Request
+	var mx sync.Mutex
+	dest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		got = append(got, r)
+		if refused {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer dest.Close()
+	saved := xDefaultRoute
+	defer func() { xDefaultRoute = saved }()
+	xDefaultRoute = testRoute(t, "default", dest.URL)
+	s := testDeadLetters(t)
+
+	sent := http.Header{P3IDSEQUENCEHEADER: {"seq-9"}, "X-Tenant": {"t1"}}
+	sent.Set("Authorization", "Bearer caller")
+	id, err := s.Add(deadLetter{Route: "default", Destination: dest.URL, Error: "no",
+		Headers: redactHeaders(sent), JSON: `{"documentId":"A"}`})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// refused again: kept, with the replay counted
+	if xj, err := s.Replay(id, false); nil == err || http.StatusBadRequest != xj.Code {
+		t.Errorf("got %d, %v", xj.Code, err)
+	}
+	d, err := s.Get(id)
+	if nil != err || 1 != d.Replays || http.StatusBadRequest != d.Code || 1 != len(d.Attempts) {
+		t.Errorf("got %+v, %v", d, err)
+	}
+
+	mx.Lock()
+	refused = false
+	mx.Unlock()
+	if xj, err := s.Replay(id, false); nil != err || http.StatusOK != xj.Code {
+		t.Errorf("got %d, %v", xj.Code, err)
+	}
+	if _, err = s.Get(id); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("a delivered dead letter was kept: %v", err)
+	}
+	mx.Lock()
+	defer mx.Unlock()
+	if 2 != len(got) {
+		t.Fatalf("sent %d times", len(got))
+	}
+	h := got[1].Header
+	if "seq-9" != h.Get(P3IDSEQUENCEHEADER) || "t1" != h.Get("X-Tenant") || "" != h.Get("Authorization") {
+		t.Errorf("sent headers %v", h)
+	}
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"reflectsvc/misc"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -18,36 +22,119 @@ const (
 	JsonNumeric
 	JsonDate
 	JsonBoolean
+	JsonDateTime
 )
 
+// conversionPolicy says what happens to a mapped field whose value
+// cannot be converted to its JSON type
+type conversionPolicy string
+
+const (
+	policyNull   conversionPolicy = "null"   // send null in its place
+	policyOmit   conversionPolicy = "omit"   // leave the field out
+	policyString conversionPolicy = "string" // send the value as a string, as it arrived
+	policyReject conversionPolicy = "reject" // refuse the whole document
+)
+
+func parseConversionPolicy(s string) (conversionPolicy, error) {
+	switch p := conversionPolicy(strings.ToLower(s)); p {
+	case policyNull, policyOmit, policyString, policyReject:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown conversion failure policy %q (want %s, %s, %s or %s)",
+		s, policyNull, policyOmit, policyString, policyReject)
+}
+
 type remapField struct {
 	JsonName  string
 	XMLName   string
 	FieldType JsonFieldType
 	OmitEmpty bool
-	// MustBe    []string
+	// OnError overrides --conversion-failure for this field
+	OnError conversionPolicy
+	// Decimal is the decimal mark of a number field (see parseAmount)
+	Decimal string
+	// Currency, if set, is the JSON name the currency of a number field
+	// is sent as; CurrencyDefault is the currency of `$` and of amounts
+	// that do not say
+	Currency        string
+	CurrencyDefault string
+	// Dates is how a date or datetime field is read and written
+	Dates dateFormat
+	// Path and CurrencyPath are JsonName and Currency as steps into the
+	// output JSON (`origin.city`, `parties[0].lastName`)
+	Path         []jsonStep
+	CurrencyPath []jsonStep
+	// MinConfidence overrides --min-confidence when it is not negative,
+	// and LowConfidence overrides --low-confidence
+	MinConfidence float64
+	LowConfidence lowConfidencePolicy
+	// Order is the line of the field in the mapping file; the JSON
+	// fields are written in this order
+	Order int
+	// Rules are the checks the field's value has to pass
+	Rules fieldRules
+	// Select is XMLName compiled, when it is a selector (see isSelector)
+	Select *xpath
 }
 
 func (r *remapField) String() string {
-	return fmt.Sprintf("%s   %s   %v   %t",
-		r.JsonName, r.XMLName, r.FieldType, r.OmitEmpty)
+	return fmt.Sprintf("%s   %s   %v   %t   %s",
+		r.JsonName, r.XMLName, r.FieldType, r.OmitEmpty, r.onError())
+}
+
+// onError is the failure policy in force for the field
+func (r *remapField) onError() conversionPolicy {
+	if "" != r.OnError {
+		return r.OnError
+	}
+	return conversionPolicy(FlagConversionFailure)
 }
 
 // FlagRemapMap is not really an argument flag, but it used similarly.
 // This is a conversion of incoming XML field names to outgoing JSON
 // field names as part of the xml2json endpoint. These to->from strings
-// are held in the file specifed by `--fieldNames <file>`. <file> should
-// be a plain unicode file. Lines beginning with `#` are ignored (comments).
-// Empty lines are ignored. Field name replacements are specified as
-// [`From XML Field Name`][`toJsonFieldName`].
+// are held in the file specifed by `--fieldNames <file>`: a YAML or
+// JSON mapping file (see mappingFile.go), or a plain unicode file of
+// `;` separated columns. Lines beginning with a backtick are ignored
+// (comments), as are empty lines. Each line is
+// `XML name;JSON name;type;omitEmpty`, optionally followed by
+// `key=value` options, e.g. `onError=reject`.
 var FlagRemapMap map[string]remapField
 
+// mappingProblem is something wrong with a field mapping file, and
+// where: Line and Column count from 1, and are 0 when not known
+type mappingProblem struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+	// Warning is a problem the file is loaded in spite of
+	Warning bool
+}
+
+func (p mappingProblem) String() string {
+	kind := "error"
+	if p.Warning {
+		kind = "warning"
+	}
+	if p.Line <= 0 {
+		return fmt.Sprintf("%s: %s: %s", p.File, kind, p.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", p.File, p.Line, p.Column, kind, p.Message)
+}
+
+// mappingPos is where a field of a mapping file is
+type mappingPos struct {
+	Line   int
+	Column int
+}
+
 func loadFieldTranslations(fn string) (remap map[string]remapField) {
-	remap = make(map[string]remapField, 64)
 	if !misc.IsStringSet(&fn) {
-		return remap
+		return make(map[string]remapField)
 	}
-	f, err := os.Open(fn)
+	remap, problems, err := readFieldTranslations(fn)
 	if nil != err {
 		xLog.Printf("could not open field translation file %s because %s",
 			fn, err.Error())
@@ -55,36 +142,151 @@ func loadFieldTranslations(fn string) (remap map[string]remapField) {
 	} else if FlagDebug {
 		xLog.Printf("successfully opened field translation file %s", fn)
 	}
-	defer misc.DeferError(f.Close)
-	rdr := csv.NewReader(bufio.NewReader(f))
+	fatal := false
+	for _, p := range problems {
+		xLog.Printf("field translation file %s", p.String())
+		fatal = fatal || !p.Warning
+	}
+	if fatal {
+		myFatal()
+	}
+	if FlagDebug {
+		ix := 0
+		xLog.Printf("REMAP VALUES")
+		for key, val := range remap {
+			xLog.Printf("%3d %s: %s", ix, key, val.String())
+			ix++
+		}
+	}
+	return remap
+}
+
+// readFieldTranslations reads a mapping file, YAML or JSON by its
+// extension and the `;` format otherwise, finding every problem with it
+// rather than stopping at the first. err is set only when the file
+// cannot be read at all.
+func readFieldTranslations(fn string) (remap map[string]remapField, problems []mappingProblem, err error) {
+	remap = make(map[string]remapField, 64)
+	data, err := os.ReadFile(fn)
+	if nil != err {
+		return remap, nil, err
+	}
+	var fields []remapField
+	var where []mappingPos
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".yaml", ".yml", ".json":
+		fields, where, problems = readMappingFile(fn, data)
+	default:
+		fields, where, problems = readCsvMapping(fn, data)
+	}
+
+	// the same checks, whichever the format
+	problem := func(pos mappingPos, format string, args ...interface{}) {
+		problems = append(problems, mappingProblem{File: fn, Line: pos.Line, Column: pos.Column,
+			Message: fmt.Sprintf(format, args...)})
+	}
+	at := make(map[string]mappingPos, len(fields))
+	for ix, rm := range fields {
+		if _, ok := xtractaMetadata[rm.XMLName]; !ok && strings.HasPrefix(rm.XMLName, "@") {
+			problem(where[ix], "unknown document metadata %s", rm.XMLName)
+			continue
+		}
+		if isSelector(rm.XMLName) {
+			if rm.Select, err = compileSelector(rm.XMLName); nil != err {
+				problem(where[ix], "bad selector: %s", err.Error())
+				continue
+			}
+		}
+		if "-" == rm.JsonName {
+			// mapped so that it is not sent
+		} else if rm.Path, err = parseJsonPath(rm.JsonName); nil == err && misc.IsStringSet(&rm.Currency) {
+			rm.CurrencyPath, err = parseJsonPath(rm.Currency)
+		}
+		if nil != err {
+			problem(where[ix], "bad JSON name for %s: %s", rm.XMLName, err.Error())
+			continue
+		}
+		if first, ok := at[rm.XMLName]; ok {
+			problem(where[ix], "duplicate XML name %s (first mapped on line %d)", rm.XMLName, first.Line)
+			continue
+		}
+		at[rm.XMLName] = where[ix]
+		rm.Order = len(remap)
+		remap[rm.XMLName] = rm
+	}
+	for _, pair := range jsonPathConflicts(remap) {
+		problem(at[pair[1].XMLName], "JSON name %s (of %s) conflicts with %s (of %s)",
+			pair[1].JsonName, pair[1].XMLName, pair[0].JsonName, pair[0].XMLName)
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+	return remap, problems, nil
+}
+
+// newRemapField is a field with the defaults of the mapping file
+func newRemapField() remapField {
+	var rm remapField
+	rm.Decimal = decimalPoint
+	rm.MinConfidence = -1
+	rm.Rules.MaxLength = -1
+	return rm
+}
+
+// parseFieldType reads the type column; ok is false for an unknown type
+func parseFieldType(s string) (t JsonFieldType, ok bool) {
+	switch strings.ToLower(s) {
+	case "string":
+		return JsonString, true
+	case "numeric", "number":
+		return JsonNumeric, true
+	case "integer", "int", "decimal":
+		// decimal has always meant an integer
+		return JsonInteger, true
+	case "boolean", "bool":
+		return JsonBoolean, true
+	case "date":
+		return JsonDate, true
+	case "datetime", "timestamp":
+		return JsonDateTime, true
+	}
+	return JsonString, false
+}
+
+// readCsvMapping reads the `;` separated format. Unknown types and
+// omitEmpty values, and short lines, are warnings, as they always were.
+func readCsvMapping(fn string, data []byte) (fields []remapField, where []mappingPos, problems []mappingProblem) {
+	rdr := csv.NewReader(bytes.NewReader(data))
 	rdr.Comma = ';'
 	rdr.Comment = '`'
 	rdr.ReuseRecord = true
+	// options after the fourth column are optional
+	rdr.FieldsPerRecord = -1
 
-	var record []string
-	for record, err = rdr.Read(); nil != record && nil == err; record, err = rdr.Read() {
+	record, err := rdr.Read()
+	for ; nil != record && nil == err; record, err = rdr.Read() {
+		column := func(ix int) mappingPos {
+			line, col := rdr.FieldPos(ix)
+			return mappingPos{line, col}
+		}
+		problem := func(ix int, warning bool, format string, args ...interface{}) {
+			pos := column(ix)
+			problems = append(problems, mappingProblem{File: fn, Line: pos.Line, Column: pos.Column,
+				Message: fmt.Sprintf(format, args...), Warning: warning})
+		}
 		// if the first row is field designators, ignore them
 		if "xmlname" == strings.ToLower(record[0]) {
 			continue
 		}
-		var rm remapField
+		if len(record) < 4 {
+			problem(0, true, "only %d column(s) (want XML name;JSON name;type;omitEmpty) -- skipping the line",
+				len(record))
+			continue
+		}
+		rm := newRemapField()
 		rm.XMLName = record[0]
 		rm.JsonName = record[1]
-		switch strings.ToLower(record[2]) {
-		case "string":
-			rm.FieldType = JsonString
-		case "numeric", "number":
-			rm.FieldType = JsonNumeric
-		case "decimal", "integer":
-			rm.FieldType = JsonInteger
-		case "boolean", "bool":
-			rm.FieldType = JsonBoolean
-		case "date":
-			rm.FieldType = JsonDate
-		default:
-			rm.FieldType = JsonString
-			xLog.Printf("Huh? Found an unrecognized JSON field "+
-				"type  %s in the field translation file (treating it as a string)", record[2])
+		var ok bool
+		if rm.FieldType, ok = parseFieldType(record[2]); !ok {
+			problem(2, true, "unrecognized JSON field type %s (treating it as a string)", record[2])
 		}
 		switch strings.ToLower(record[3]) {
 		case "true":
@@ -93,27 +295,105 @@ func loadFieldTranslations(fn string) (remap map[string]remapField) {
 			rm.OmitEmpty = false
 		default:
 			rm.OmitEmpty = false
-			xLog.Printf("Huh? Found a non-true / non-false type for OmitEmpty "+
-				" %s in the field translation file (treating it as false", record[2])
+			problem(3, true, "non-true / non-false OmitEmpty %s (treating it as false)", record[3])
 		}
-		_, ok := remap[rm.XMLName]
-		if !ok {
-			remap[rm.XMLName] = rm
-		} else {
-			xLog.Printf("Detected duplicate name in field name translation file %s: duplicate values for %s", fn, rm.XMLName)
-			myFatal()
+		bad := false
+		for ix, opt := range record[4:] {
+			if err := rm.setOption(opt); nil != err {
+				problem(4+ix, false, "bad option for %s: %s", rm.XMLName, err.Error())
+				bad = true
+			}
+		}
+		if !bad {
+			fields = append(fields, rm)
+			where = append(where, column(0))
 		}
 	}
 	if nil != err && io.EOF != err {
-		xLog.Printf("got non-EOF error while parsing field translation file: %s", err.Error())
+		var pe *csv.ParseError
+		if errors.As(err, &pe) {
+			problems = append(problems, mappingProblem{File: fn, Line: pe.Line, Column: pe.Column,
+				Message: pe.Err.Error()})
+		} else {
+			problems = append(problems, mappingProblem{File: fn, Message: err.Error()})
+		}
 	}
-	if FlagDebug {
-		ix := 0
-		xLog.Printf("REMAP VALUES")
-		for key, val := range remap {
-			xLog.Printf("%3d %s: %s", ix, key, val.String())
-			ix++
+	return fields, where, problems
+}
+
+// setOption applies one `key=value` column of the mapping file
+func (r *remapField) setOption(opt string) (err error) {
+	opt = strings.TrimSpace(opt)
+	if "" == opt {
+		return nil
+	}
+	key, value, found := strings.Cut(opt, "=")
+	if !found {
+		return fmt.Errorf("option %q is not key=value", opt)
+	}
+	switch key = strings.ToLower(strings.TrimSpace(key)); key {
+	case "in", "out", "tz", "outtz", "ambiguous":
+		return r.setDateOption(key, strings.TrimSpace(value))
+	case "required", "mustbe", "enum", "pattern", "minlength", "maxlength", "min", "max",
+		"eq", "ne", "gt", "gte", "lt", "lte":
+		return r.setRuleOption(key, strings.TrimSpace(value))
+	case "onerror":
+		r.OnError, err = parseConversionPolicy(strings.TrimSpace(value))
+		return err
+	case "minconfidence":
+		if r.MinConfidence, err = strconv.ParseFloat(strings.TrimSpace(value), 64); nil != err || r.MinConfidence < 0 {
+			return fmt.Errorf("minConfidence %q is not a number of 0 or more", value)
 		}
+		return nil
+	case "lowconfidence":
+		r.LowConfidence, err = parseLowConfidencePolicy(strings.TrimSpace(value))
+		return err
+	case "decimal":
+		r.Decimal, err = parseDecimalMark(strings.TrimSpace(value))
+		return err
+	case "currency":
+		r.Currency = strings.TrimSpace(value)
+		return nil
+	case "currencydefault":
+		r.CurrencyDefault = strings.ToUpper(strings.TrimSpace(value))
+		if !isCurrencyCode(r.CurrencyDefault) {
+			return fmt.Errorf("currencyDefault %q is not an ISO 4217 code", value)
+		}
+		return nil
 	}
-	return remap
+	return fmt.Errorf("unknown option %q", key)
+}
+
+// jsonPathConflicts are the pairs of fields of the mapping whose JSON
+// names need the same spot in the output to be two different things,
+// such as `origin` and `origin.city` (or their currency names)
+func jsonPathConflicts(remap map[string]remapField) [][2]remapField {
+	fields := make([]remapField, 0, len(remap))
+	for _, rm := range remap {
+		fields = append(fields, rm)
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Order < fields[j].Order })
+
+	var owners []remapField
+	var paths [][]jsonStep
+	for _, rm := range fields {
+		if nil == rm.Path {
+			continue
+		}
+		owners, paths = append(owners, rm), append(paths, rm.Path)
+		if misc.IsStringSet(&rm.Currency) {
+			currency := rm
+			currency.JsonName = rm.Currency
+			owners, paths = append(owners, currency), append(paths, rm.CurrencyPath)
+		}
+	}
+	var conflicts [][2]remapField
+	for ix := range paths {
+		for jx := ix + 1; jx < len(paths); jx++ {
+			if jsonPathsConflict(paths[ix], paths[jx]) {
+				conflicts = append(conflicts, [2]remapField{owners[ix], owners[jx]})
+			}
+		}
+	}
+	return conflicts
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflectsvc/misc"
+	"strings"
+)
+
+// headerValue is an injected header value: either a literal string,
+// or {"env":"NAME"} to take it from the environment when the policy
+// is loaded (keeps secrets out of the policy file).
+type headerValue struct {
+	Value string `json:"value,omitempty"`
+	Env   string `json:"env,omitempty"`
+}
+
+func (hv *headerValue) UnmarshalJSON(data []byte) error {
+	var literal string
+	if err := json.Unmarshal(data, &literal); nil == err {
+		hv.Value = literal
+		return nil
+	}
+	type plain headerValue
+	return json.Unmarshal(data, (*plain)(hv))
+}
+
+// headerPolicy decides which headers travel with a delivery, and which
+// of the destination's response headers are handed back to the caller.
+//
+//	Forward  incoming headers copied to the delivery
+//	Rename   incoming header -> name it is forwarded under
+//	Inject   headers always set on the delivery
+//	Strip    headers removed from the delivery after everything else
+//	Return   destination response headers copied back to the caller
+type headerPolicy struct {
+	Forward []string               `json:"forward"`
+	Rename  map[string]string      `json:"rename,omitempty"`
+	Inject  map[string]headerValue `json:"inject,omitempty"`
+	Strip   []string               `json:"strip,omitempty"`
+	Return  []string               `json:"return,omitempty"`
+}
+
+// xHeaderPolicy is replaced by --header-policy, if given
+var xHeaderPolicy = defaultHeaderPolicy()
+
+// defaultHeaderPolicy is what /xml2json has always done
+func defaultHeaderPolicy() *headerPolicy {
+	hp := &headerPolicy{
+		Forward: proxiedHeaders[:],
+		Inject:  make(map[string]headerValue, len(standardRequestHeaders)),
+	}
+	for key, val := range standardRequestHeaders {
+		hp.Inject[key] = headerValue{Value: val}
+	}
+	return hp
+}
+
+func loadHeaderPolicy(fn string) (*headerPolicy, error) {
+	data, err := os.ReadFile(fn)
+	if nil != err {
+		return nil, err
+	}
+	var hp headerPolicy
+	if err = json.Unmarshal(data, &hp); nil != err {
+		return nil, fmt.Errorf("could not parse header policy %s because %w", fn, err)
+	}
+	if err = hp.resolve(); nil != err {
+		return nil, fmt.Errorf("header policy %s: %w", fn, err)
+	}
+	return &hp, nil
+}
+
+// resolve reads environment-sourced values, failing if any are unset
+func (hp *headerPolicy) resolve() error {
+	for key, hv := range hp.Inject {
+		if !misc.IsStringSet(&hv.Env) {
+			continue
+		}
+		val, ok := os.LookupEnv(hv.Env)
+		if !ok {
+			return fmt.Errorf("header %s wants environment variable %s, which is not set",
+				key, hv.Env)
+		}
+		hp.Inject[key] = headerValue{Value: val, Env: hv.Env}
+	}
+	return nil
+}
+
+// apply adds the policy's headers, taken from incoming, to out
+func (hp *headerPolicy) apply(incoming http.Header, out http.Header) {
+	for key, hv := range hp.Inject {
+		out.Set(key, hv.Value)
+	}
+	for _, name := range hp.Forward {
+		if values, ok := incoming[http.CanonicalHeaderKey(name)]; ok {
+			out[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	for from, to := range hp.Rename {
+		if values, ok := incoming[http.CanonicalHeaderKey(from)]; ok {
+			out[http.CanonicalHeaderKey(to)] = values
+		}
+	}
+}
+
+// strip removes the policy's stripped headers from out
+func (hp *headerPolicy) strip(out http.Header) {
+	for _, name := range hp.Strip {
+		out.Del(name)
+	}
+}
+
+// returned copies the listed destination response headers to w
+func (hp *headerPolicy) returned(downstream http.Header, w http.Header) {
+	for _, name := range hp.Return {
+		if values, ok := downstream[http.CanonicalHeaderKey(name)]; ok {
+			w[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+}
+
+// returnedOf is the listed destination response headers of downstream
+// by themselves (nil if there are none), for a response reporting
+// several results, each with its own
+func (hp *headerPolicy) returnedOf(downstream http.Header) http.Header {
+	h := make(http.Header)
+	hp.returned(downstream, h)
+	if len(h) == 0 {
+		return nil
+	}
+	return h
+}
+
+func (hp *headerPolicy) String() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("forward %v\n", hp.Forward))
+	for from, to := range hp.Rename {
+		sb.WriteString(fmt.Sprintf("rename  %s -> %s\n", from, to))
+	}
+	for key, hv := range hp.Inject {
+		// don't log secrets pulled from the environment
+		if misc.IsStringSet(&hv.Env) {
+			sb.WriteString(fmt.Sprintf("inject  %s = $%s\n", key, hv.Env))
+		} else {
+			sb.WriteString(fmt.Sprintf("inject  %s = %s\n", key, hv.Value))
+		}
+	}
+	sb.WriteString(fmt.Sprintf("strip   %v\nreturn  %v", hp.Strip, hp.Return))
+	return sb.String()
+}
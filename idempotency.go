@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/endpoint"
+	"net/http"
+	"os"
+	"reflectsvc/misc"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const STALEREVISIONHEADER = "P3id-Stale-Revision"
+
+// what the ledger says to do with a document
+type ledgerVerdict int
+
+const (
+	ledgerDeliver ledgerVerdict = iota
+	ledgerDuplicate
+	ledgerStale
+	ledgerInFlight
+)
+
+// deliveryRecord is the latest revision of a document delivered to a route
+type deliveryRecord struct {
+	Route      string    `json:"route"`
+	DocumentID string    `json:"documentId"`
+	Revision   string    `json:"revision"`
+	Sequence   string    `json:"sequence,omitempty"`
+	Key        string    `json:"key"`
+	Delivered  time.Time `json:"delivered"`
+}
+
+// deliveryLedger remembers which documents have been delivered to each
+// route, so a document Xtracta sends again is acknowledged without being
+// forwarded again. It is saved to --idempotency-file after each change;
+// records older than --idempotency-retention are dropped.
+type deliveryLedger struct {
+	fn        string
+	retention time.Duration
+	mx        sync.Mutex
+	records   map[string]*deliveryRecord
+	inFlight  map[string]string
+}
+
+// xLedger is nil unless --idempotency-file is set
+var xLedger *deliveryLedger
+
+func ledgerKey(routeName string, documentID string) string {
+	return routeName + "\x00" + documentID
+}
+
+// idempotencyKey is the same for every copy of an event, whichever
+// instance of this service converts it. A batch sent as one
+// (--batch-events array) has a key made of all its events.
+func idempotencyKey(x XtractaEvents) string {
+	parts := make([]string, 0, len(x.More)+1)
+	for _, one := range x.eachEvent() {
+		doc := one.Event.Document
+		parts = append(parts, "xtracta\x00"+doc.DocumentID+"\x00"+doc.Revision+"\x00"+one.Event.Sequence)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00\x00")))
+	return hex.EncodeToString(sum[:16])
+}
+
+func openLedger(fn string, retention time.Duration) (*deliveryLedger, error) {
+	l := &deliveryLedger{
+		fn:        fn,
+		retention: retention,
+		records:   make(map[string]*deliveryRecord),
+		inFlight:  make(map[string]string),
+	}
+	data, err := os.ReadFile(fn)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if nil != err {
+		return nil, err
+	}
+	var saved []*deliveryRecord
+	if err = json.Unmarshal(data, &saved); nil != err {
+		return nil, fmt.Errorf("could not parse idempotency file %s because %w", fn, err)
+	}
+	for _, rec := range saved {
+		l.records[ledgerKey(rec.Route, rec.DocumentID)] = rec
+	}
+	l.prune()
+	return l, nil
+}
+
+// prune drops expired records; l.mx is held (or l is not yet shared)
+func (l *deliveryLedger) prune() {
+	if l.retention <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-l.retention)
+	for key, rec := range l.records {
+		if rec.Delivered.Before(cutoff) {
+			delete(l.records, key)
+		}
+	}
+}
+
+// save writes the ledger; l.mx is held
+func (l *deliveryLedger) save() {
+	l.prune()
+	data, err := json.MarshalIndent(l.sorted("", ""), "", "  ")
+	if nil == err {
+		err = misc.WriteFileAtomic(l.fn, data, 0600)
+	}
+	if nil != err {
+		xLog.Printf("huh? could not save idempotency file %s because %s", l.fn, err.Error())
+	}
+}
+
+// claim decides whether the document should go to the route. For
+// ledgerDeliver (and a stale revision under --stale-revisions flag) the
+// caller must settle its newDeliveryRecord with the outcome; a copy arriving meanwhile is
+// ledgerInFlight. The record returned is the delivery that came before.
+func (l *deliveryLedger) claim(routeName string, x XtractaEvents) (ledgerVerdict, *deliveryRecord) {
+	doc := x.Event.Document
+	if !misc.IsStringSet(&doc.DocumentID) {
+		return ledgerDeliver, nil
+	}
+	key := ledgerKey(routeName, doc.DocumentID)
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if _, busy := l.inFlight[key]; busy {
+		return ledgerInFlight, nil
+	}
+	prev, seen := l.records[key]
+	if seen && (l.retention <= 0 || time.Since(prev.Delivered) < l.retention) {
+		switch compareRevisions(doc.Revision, prev.Revision) {
+		case 0:
+			return ledgerDuplicate, prev
+		case -1:
+			if FlagStaleRevisions == "flag" {
+				l.inFlight[key] = doc.Revision
+			}
+			return ledgerStale, prev
+		}
+	}
+	l.inFlight[key] = doc.Revision
+	return ledgerDeliver, nil
+}
+
+// newDeliveryRecord is what the ledger will say once x is delivered to
+// the route; nil if x has no document id. A queued document carries it
+// until the queue settles it.
+func newDeliveryRecord(routeName string, x XtractaEvents) *deliveryRecord {
+	doc := x.Event.Document
+	if !misc.IsStringSet(&doc.DocumentID) {
+		return nil
+	}
+	return &deliveryRecord{
+		Route:      routeName,
+		DocumentID: doc.DocumentID,
+		Revision:   doc.Revision,
+		Sequence:   x.Event.Sequence,
+		Key:        idempotencyKey(x),
+	}
+}
+
+// settle releases the claim on rec's document, recording it if it was
+// delivered. An older revision is never recorded over a newer one.
+func (l *deliveryLedger) settle(rec *deliveryRecord, delivered bool) {
+	if nil == rec {
+		return
+	}
+	key := ledgerKey(rec.Route, rec.DocumentID)
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	delete(l.inFlight, key)
+	if !delivered {
+		return
+	}
+	if prev, ok := l.records[key]; ok && compareRevisions(rec.Revision, prev.Revision) < 0 {
+		return
+	}
+	saved := *rec
+	saved.Delivered = time.Now().UTC()
+	l.records[key] = &saved
+	l.save()
+}
+
+// sorted lists the records for documentID and routeName ("" matches
+// any), oldest first; l.mx is held
+func (l *deliveryLedger) sorted(documentID string, routeName string) []*deliveryRecord {
+	list := make([]*deliveryRecord, 0, len(l.records))
+	for _, rec := range l.records {
+		if (documentID == "" || rec.DocumentID == documentID) && (routeName == "" || rec.Route == routeName) {
+			list = append(list, rec)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Delivered.Before(list[j].Delivered)
+	})
+	return list
+}
+
+// List returns the records for documentID and routeName ("" matches any)
+func (l *deliveryLedger) List(documentID string, routeName string) []*deliveryRecord {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.prune()
+	return l.sorted(documentID, routeName)
+}
+
+// Clear forgets the records for documentID and routeName ("" matches
+// any), so those documents will be delivered again
+func (l *deliveryLedger) Clear(documentID string, routeName string) int {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	removed := l.sorted(documentID, routeName)
+	for _, rec := range removed {
+		delete(l.records, ledgerKey(rec.Route, rec.DocumentID))
+	}
+	if len(removed) > 0 {
+		l.save()
+	}
+	return len(removed)
+}
+
+// compareRevisions compares numerically when both revisions are numbers
+func compareRevisions(a string, b string) int {
+	na, errA := strconv.ParseInt(a, 10, 64)
+	nb, errB := strconv.ParseInt(b, 10, 64)
+	if nil == errA && nil == errB {
+		switch {
+		case na < nb:
+			return -1
+		case na > nb:
+			return 1
+		}
+		return 0
+	}
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// /admin/idempotency: GET lists the ledger, DELETE clears it; both
+// take optional ?document= and ?route= filters
+type idempotencyAdminRequest struct {
+	Method     string
+	DocumentID string
+	Route      string
+}
+
+type idempotencyListResponse struct {
+	Records []*deliveryRecord `json:"records"`
+}
+
+type idempotencyClearResponse struct {
+	Removed int `json:"removed"`
+}
+
+func makeIdempotencyAdminEndpoint() endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req := request.(idempotencyAdminRequest)
+		if nil == xLedger {
+			return nil, statusError{errors.New("idempotency is not enabled (see --idempotency-file)"),
+				http.StatusNotFound}
+		}
+		if req.Method == http.MethodDelete {
+			removed := xLedger.Clear(req.DocumentID, req.Route)
+			xLog.Printf("cleared %d idempotency record(s) (document %q, route %q)",
+				removed, req.DocumentID, req.Route)
+			return idempotencyClearResponse{Removed: removed}, nil
+		}
+		return idempotencyListResponse{Records: xLedger.List(req.DocumentID, req.Route)}, nil
+	}
+}
+
+func decodeIdempotencyAdminRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		return nil, statusError{fmt.Errorf("%s is not supported (use GET or DELETE)", r.Method),
+			http.StatusMethodNotAllowed}
+	}
+	return idempotencyAdminRequest{
+		Method:     r.Method,
+		DocumentID: r.URL.Query().Get("document"),
+		Route:      r.URL.Query().Get("route"),
+	}, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testRevision is an event of a document at a revision
+func testRevision(documentID string, revision string) XtractaEvents {
+	var x XtractaEvents
+	x.Event.Sequence = "1"
+	x.Event.Document.DocumentID, x.Event.Document.Revision = documentID, revision
+	return x
+}
+
+func TestCompareRevisions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"1", "1", 0},
+		{"2", "10", -1},
+		{"10", "2", 1},
+		{"", "", 0},
+		// not both numbers: compared as text
+		{"b", "a", 1},
+		{"10", "2a", -1},
+		{"", "1", -1},
+	} {
+		if got := compareRevisions(tc.a, tc.b); tc.want != got {
+			t.Errorf("compareRevisions(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestLedgerClaim(t *testing.T) {
+	saved := FlagStaleRevisions
+	defer func() { FlagStaleRevisions = saved }()
+	FlagStaleRevisions = "drop"
+	l, err := openLedger(filepath.Join(t.TempDir(), "ledger.json"), 0)
+	if nil != err {
+		t.Fatal(err)
+	}
+	claim := func(doc string, rev string) ledgerVerdict {
+		verdict, _ := l.claim("r", testRevision(doc, rev))
+		return verdict
+	}
+	settle := func(doc string, rev string, delivered bool) {
+		l.settle(newDeliveryRecord("r", testRevision(doc, rev)), delivered)
+	}
+
+	if v := claim("A", "2"); ledgerDeliver != v {
+		t.Fatalf("a new document: %v", v)
+	}
+	if v := claim("A", "2"); ledgerInFlight != v {
+		t.Errorf("a copy while the first is delivered: %v", v)
+	}
+	if v, _ := l.claim("other", testRevision("A", "2")); ledgerDeliver != v {
+		t.Errorf("the document for another route: %v", v)
+	}
+	// not delivered: the claim is let go, and nothing is recorded
+	settle("A", "2", false)
+	if v := claim("A", "2"); ledgerDeliver != v {
+		t.Fatalf("after a failed delivery: %v", v)
+	}
+	settle("A", "2", true)
+
+	v, prev := l.claim("r", testRevision("A", "2"))
+	if ledgerDuplicate != v || nil == prev || "2" != prev.Revision || "" == prev.Key {
+		t.Errorf("a delivered revision again: %v %+v", v, prev)
+	}
+	if v, prev = l.claim("r", testRevision("A", "1")); ledgerStale != v || "2" != prev.Revision {
+		t.Errorf("an older revision: %v %+v", v, prev)
+	}
+	if v = claim("A", "1"); ledgerStale != v {
+		t.Errorf("dropping a stale revision left it claimed: %v", v)
+	}
+	if v = claim("A", "10"); ledgerDeliver != v {
+		t.Errorf("a newer revision: %v", v)
+	}
+
+	// a stale revision sent anyway is claimed, and never recorded over
+	// the newer one
+	settle("A", "10", true)
+	FlagStaleRevisions = "flag"
+	if v = claim("A", "3"); ledgerStale != v {
+		t.Fatalf("an older revision under flag: %v", v)
+	}
+	if v = claim("A", "3"); ledgerInFlight != v {
+		t.Errorf("a flagged stale revision was not claimed: %v", v)
+	}
+	settle("A", "3", true)
+	if list := l.List("A", "r"); 1 != len(list) || "10" != list[0].Revision {
+		t.Errorf("recorded %+v, want revision 10", list)
+	}
+
+	// without a document id there is nothing to go by
+	if v = claim("", "1"); ledgerDeliver != v || ledgerDeliver != claim("", "1") {
+		t.Errorf("a document without an id: %v", v)
+	}
+	if nil != newDeliveryRecord("r", testRevision("", "1")) {
+		t.Error("a record for a document without an id")
+	}
+}
+
+func TestLedgerFile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "ledger.json")
+	l, err := openLedger(fn, time.Hour)
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, doc := range []string{"A", "B"} {
+		if v, _ := l.claim("r", testRevision(doc, "1")); ledgerDeliver != v {
+			t.Fatal(v)
+		}
+		l.settle(newDeliveryRecord("r", testRevision(doc, "1")), true)
+	}
+
+	// a restart remembers what was delivered, but for what has expired
+	var records []*deliveryRecord
+	data, err := os.ReadFile(fn)
+	if nil == err {
+		err = json.Unmarshal(data, &records)
+	}
+	if nil != err || 2 != len(records) {
+		t.Fatalf("saved %s, %v", data, err)
+	}
+	records[0].Delivered = time.Now().Add(-2 * time.Hour)
+	if data, err = json.Marshal(records); nil == err {
+		err = os.WriteFile(fn, data, 0600)
+	}
+	if nil != err {
+		t.Fatal(err)
+	}
+	if l, err = openLedger(fn, time.Hour); nil != err {
+		t.Fatal(err)
+	}
+	if list := l.List("", ""); 1 != len(list) || records[1].DocumentID != list[0].DocumentID {
+		t.Errorf("reopened as %+v", list)
+	}
+	if v, _ := l.claim("r", testRevision(records[0].DocumentID, "1")); ledgerDeliver != v {
+		t.Errorf("an expired record still counts: %v", v)
+	}
+
+	if n := l.Clear("", "r"); 1 != n || 0 != len(l.List("", "")) {
+		t.Errorf("cleared %d, left %+v", n, l.List("", ""))
+	}
+	if err = os.WriteFile(fn, []byte("{"), 0600); nil != err {
+		t.Fatal(err)
+	}
+	if _, err = openLedger(fn, 0); nil == err {
+		t.Error("opened a ledger that is not JSON")
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	a, b := testRevision("A", "1"), testRevision("B", "1")
+	if idempotencyKey(a) != idempotencyKey(testRevision("A", "1")) {
+		t.Error("copies of an event have different keys")
+	}
+	for name, other := range map[string]XtractaEvents{
+		"another document": b,
+		"another revision": testRevision("A", "2"),
+		"a batch":          XtractaEvents{Event: a.Event, More: []XtractaEvent{b.Event}},
+	} {
+		if idempotencyKey(a) == idempotencyKey(other) {
+			t.Errorf("%s has the same key", name)
+		}
+	}
+	ab := XtractaEvents{Event: a.Event, More: []XtractaEvent{b.Event}}
+	ba := XtractaEvents{Event: b.Event, More: []XtractaEvent{a.Event}}
+	if idempotencyKey(ab) == idempotencyKey(ba) || 32 != len(idempotencyKey(ab)) {
+		t.Errorf("batch keys %s and %s", idempotencyKey(ab), idempotencyKey(ba))
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/endpoint"
+	"net/http"
+	"reflectsvc/misc"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type jobState string
+
+const (
+	jobQueued     jobState = "queued"
+	jobDelivering jobState = "delivering"
+	jobDelivered  jobState = "delivered"
+	jobFailed     jobState = "failed"
+)
+
+// ErrJobBacklog is reported when every worker is busy and the backlog is full
+var ErrJobBacklog = errors.New("too many documents waiting for delivery")
+
+// x2jJobResult is one destination of a job, once it has been tried
+type x2jJobResult struct {
+	Route       string      `json:"route"`
+	Destination string      `json:"destination"`
+	Code        int         `json:"code"`
+	Status      string      `json:"status"`
+	Attempts    int         `json:"attempts"`
+	ElapsedMs   int64       `json:"elapsedMs"`
+	Queued      string      `json:"queued,omitempty"`
+	Skipped     string      `json:"skipped,omitempty"`
+	DeadLetter  string      `json:"deadLetter,omitempty"`
+	Headers     http.Header `json:"headers,omitempty"`
+}
+
+// x2jJob is an /xml2json document accepted in async mode: converted
+// when it arrived, delivered later by the worker pool. With --queue-dir
+// it is queued before it is accepted, and the job follows the queue's
+// first attempt for up to --queue-sync-wait.
+type x2jJob struct {
+	ID           string         `json:"id"`
+	State        jobState       `json:"state"`
+	DocumentID   string         `json:"documentId,omitempty"`
+	Sequence     string         `json:"sequence,omitempty"`
+	Created      time.Time      `json:"created"`
+	Started      *time.Time     `json:"started,omitempty"`
+	Finished     *time.Time     `json:"finished,omitempty"`
+	ElapsedMs    int64          `json:"elapsedMs,omitempty"`
+	Attempts     int            `json:"attempts"`
+	Code         int            `json:"code,omitempty"`
+	Status       string         `json:"status,omitempty"`
+	Destinations []x2jJobResult `json:"destinations,omitempty"`
+
+	deliver func() x2jProxyData
+}
+
+// jobRegistry runs async deliveries on --async-workers workers and keeps
+// each job's outcome for --job-retention after it finishes. Jobs live
+// in memory only; use --queue-dir as well for deliveries that must
+// survive a restart (the queue, not the job, has them then).
+type jobRegistry struct {
+	mx   sync.Mutex
+	seq  int64
+	jobs map[string]*x2jJob
+	work chan *x2jJob
+}
+
+// xJobs is nil unless async mode is possible (--async-workers > 0)
+var xJobs *jobRegistry
+
+func startJobRegistry(workers int, backlog int) *jobRegistry {
+	r := &jobRegistry{
+		jobs: make(map[string]*x2jJob),
+		work: make(chan *x2jJob, backlog),
+	}
+	for ix := 0; ix < workers; ix++ {
+		go r.worker()
+	}
+	go r.reap()
+	return r
+}
+
+// Submit records a job and hands it to the worker pool
+func (r *jobRegistry) Submit(documentID string, sequence string, deliver func() x2jProxyData) (string, error) {
+	r.mx.Lock()
+	job := &x2jJob{
+		ID:         strconv.FormatInt(time.Now().Unix(), 36) + "-" + strconv.FormatInt(r.seq, 36),
+		State:      jobQueued,
+		DocumentID: documentID,
+		Sequence:   sequence,
+		Created:    time.Now().UTC(),
+		deliver:    deliver,
+	}
+	r.seq++
+	r.jobs[job.ID] = job
+	r.mx.Unlock()
+
+	select {
+	case r.work <- job:
+		return job.ID, nil
+	default:
+		r.mx.Lock()
+		delete(r.jobs, job.ID)
+		r.mx.Unlock()
+		return "", ErrJobBacklog
+	}
+}
+
+// Get returns a copy of the job, safe to use while it runs
+func (r *jobRegistry) Get(id string) (x2jJob, bool) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	job, ok := r.jobs[id]
+	if !ok {
+		return x2jJob{}, false
+	}
+	return *job, true
+}
+
+func (r *jobRegistry) worker() {
+	for job := range r.work {
+		r.mx.Lock()
+		started := time.Now().UTC()
+		job.Started = &started
+		job.State = jobDelivering
+		r.mx.Unlock()
+
+		xj := job.deliver()
+
+		r.mx.Lock()
+		job.finish(xj)
+		r.mx.Unlock()
+		if FlagDebug || FlagVerbose {
+			xLog.Printf("job %s [%s] %s: %s", job.ID, job.Sequence, job.State, job.Status)
+		}
+	}
+}
+
+// finish records the outcome of a job; r.mx is held
+func (job *x2jJob) finish(xj x2jProxyData) {
+	finished := time.Now().UTC()
+	job.Finished = &finished
+	job.ElapsedMs = finished.Sub(*job.Started).Milliseconds()
+	job.Code = xj.Code
+	job.Status = xj.Status
+	job.deliver = nil
+
+	results := xj.Results
+	if len(results) == 0 {
+		results = []x2jProxyData{xj}
+	}
+	job.State = jobDelivered
+	job.Destinations = make([]x2jJobResult, 0, len(results))
+	for _, r := range results {
+		job.Attempts += r.Attempts
+		job.Destinations = append(job.Destinations, x2jJobResult{
+			Route:       r.Route,
+			Destination: r.Destination,
+			Code:        r.Code,
+			Status:      r.Status,
+			Attempts:    r.Attempts,
+			ElapsedMs:   r.Elapsed.Milliseconds(),
+			Queued:      r.QueueID,
+			Skipped:     r.Skipped,
+			DeadLetter:  r.DeadLetter,
+			Headers:     xHeaderPolicy.returnedOf(r.Header),
+		})
+		switch {
+		case misc.IsStringSet(&r.QueueID):
+			// still on the store-and-forward queue, which keeps trying
+			if job.State != jobFailed {
+				job.State = jobQueued
+			}
+		case r.Code >= 200 && r.Code < 300:
+			// including a destination's own 202
+		default:
+			job.State = jobFailed
+		}
+	}
+}
+
+// reap drops finished jobs older than --job-retention
+func (r *jobRegistry) reap() {
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for range tick.C {
+		cutoff := time.Now().Add(-FlagJobRetention)
+		r.mx.Lock()
+		for id, job := range r.jobs {
+			if nil != job.Finished && job.Finished.Before(cutoff) {
+				delete(r.jobs, id)
+			}
+		}
+		r.mx.Unlock()
+	}
+}
+
+// GET /jobs/{id}
+type jobRequest struct {
+	ID string
+}
+
+func makeJobEndpoint() endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req := request.(jobRequest)
+		if nil == xJobs {
+			return nil, statusError{errors.New("async mode is not enabled (see --async-workers)"),
+				http.StatusNotFound}
+		}
+		job, ok := xJobs.Get(req.ID)
+		if !ok {
+			return nil, statusError{fmt.Errorf("no job %s (it may have expired)", req.ID),
+				http.StatusNotFound}
+		}
+		return job, nil
+	}
+}
+
+func decodeJobRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	if r.Method != http.MethodGet {
+		return nil, statusError{fmt.Errorf("%s is not supported (use GET)", r.Method),
+			http.StatusMethodNotAllowed}
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	if id == "" || strings.Contains(id, "/") {
+		return nil, statusError{errors.New("want /jobs/{id}"), http.StatusNotFound}
+	}
+	return jobRequest{ID: id}, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// finished waits for the job to finish
+func finished(t *testing.T, r *jobRegistry, id string) x2jJob {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if job, ok := r.Get(id); !ok {
+			t.Fatalf("no job %s", id)
+		} else if nil != job.Finished {
+			return job
+		}
+	}
+	t.Fatalf("job %s did not finish", id)
+	return x2jJob{}
+}
+
+func TestJobRegistry(t *testing.T) {
+	r := startJobRegistry(2, 8)
+	for _, tc := range []struct {
+		name     string
+		xj       x2jProxyData
+		state    jobState
+		attempts int
+	}{
+		{"delivered", x2jProxyData{Code: 200, Status: "200 OK", Attempts: 2}, jobDelivered, 2},
+		{"the destination's own 202", x2jProxyData{Code: 202, Attempts: 1}, jobDelivered, 1},
+		{"refused", x2jProxyData{Code: 400, Attempts: 1}, jobFailed, 1},
+		{"still queued", x2jProxyData{Code: 202, QueueID: "q1", Attempts: 3}, jobQueued, 3},
+		{"to every destination", x2jProxyData{Code: 200, Results: []x2jProxyData{
+			{Route: "a", Code: 200, Attempts: 1}, {Route: "b", Code: 201, Attempts: 2}}}, jobDelivered, 3},
+		{"queued for one", x2jProxyData{Code: 202, Results: []x2jProxyData{
+			{Route: "a", Code: 200, Attempts: 1}, {Route: "b", Code: 202, QueueID: "q2", Attempts: 1}}},
+			jobQueued, 2},
+		{"failed for one", x2jProxyData{Code: 502, Results: []x2jProxyData{
+			{Route: "a", Code: 503, Attempts: 4}, {Route: "b", Code: 202, QueueID: "q3", Attempts: 1}}},
+			jobFailed, 5},
+	} {
+		xj := tc.xj
+		id, err := r.Submit("D", "seq-1", func() x2jProxyData { return xj })
+		if nil != err {
+			t.Fatal(err)
+		}
+		job := finished(t, r, id)
+		want := len(xj.Results)
+		if 0 == want {
+			want = 1
+		}
+		if tc.state != job.State || tc.attempts != job.Attempts || xj.Code != job.Code ||
+			want != len(job.Destinations) || "D" != job.DocumentID || "seq-1" != job.Sequence ||
+			nil == job.Started || job.Finished.Before(*job.Started) {
+			t.Errorf("%s: got %+v", tc.name, job)
+		}
+	}
+}
+
+func TestJobBacklog(t *testing.T) {
+	// no workers: the first job waits, and there is no room for another
+	r := startJobRegistry(0, 1)
+	id, err := r.Submit("A", "1", func() x2jProxyData { return x2jProxyData{} })
+	if nil != err {
+		t.Fatal(err)
+	}
+	if job, ok := r.Get(id); !ok || jobQueued != job.State || nil != job.Started {
+		t.Errorf("a waiting job: %+v", job)
+	}
+	if id, err = r.Submit("B", "2", func() x2jProxyData { return x2jProxyData{} }); !errors.Is(err, ErrJobBacklog) {
+		t.Errorf("got %q, %v; want %v", id, err, ErrJobBacklog)
+	}
+	if 1 != len(r.jobs) {
+		t.Errorf("a job that was not accepted is kept: %d jobs", len(r.jobs))
+	}
+}
+
+func TestJobEndpoint(t *testing.T) {
+	saved := xJobs
+	defer func() { xJobs = saved }()
+	get := func(id string) (interface{}, error) {
+		return makeJobEndpoint()(context.Background(), jobRequest{ID: id})
+	}
+	var se statusError
+
+	xJobs = nil
+	if _, err := get("x"); !errors.As(err, &se) || http.StatusNotFound != se.StatusCode() {
+		t.Errorf("without async mode: got %v, want a 404", err)
+	}
+	xJobs = startJobRegistry(1, 1)
+	if _, err := get("x"); !errors.As(err, &se) || http.StatusNotFound != se.StatusCode() {
+		t.Errorf("an unknown job: got %v, want a 404", err)
+	}
+	id, _ := xJobs.Submit("A", "1", func() x2jProxyData { return x2jProxyData{Code: 200} })
+	finished(t, xJobs, id)
+	if rsp, err := get(id); nil != err || jobDelivered != rsp.(x2jJob).State {
+		t.Errorf("job %s: got %+v, %v", id, rsp, err)
+	}
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{http.MethodGet, "/jobs/" + id, 0},
+		{http.MethodPost, "/jobs/" + id, http.StatusMethodNotAllowed},
+		{http.MethodGet, "/jobs/", http.StatusNotFound},
+		{http.MethodGet, "/jobs/a/b", http.StatusNotFound},
+	} {
+		req, err := decodeJobRequest(context.Background(), httptest.NewRequest(tc.method, tc.path, nil))
+		if 0 == tc.code {
+			if nil != err || id != req.(jobRequest).ID {
+				t.Errorf("%s %s: got %+v, %v", tc.method, tc.path, req, err)
+			}
+		} else if !errors.As(err, &se) || tc.code != se.StatusCode() {
+			t.Errorf("%s %s: got %v, want a %d", tc.method, tc.path, err, tc.code)
+		}
+	}
+}
+
+func TestAsyncXml2Json(t *testing.T) {
+	dest := newDestination(t)
+	savedRoute, savedJobs := xDefaultRoute, xJobs
+	defer func() { xDefaultRoute, xJobs = savedRoute, savedJobs }()
+	xDefaultRoute = testRoute(t, "default", dest.URL)
+	xJobs = startJobRegistry(1, 4)
+
+	req := testBatch(t, "t-1", "1/A")
+	req.Headers.Set("Prefer", "respond-async")
+	xj := simpleService{}.Xml2Json(req)
+	if http.StatusAccepted != xj.Code || "" == xj.JobID {
+		t.Fatalf("got %d %s, want a job", xj.Code, xj.Status)
+	}
+	job := finished(t, xJobs, xj.JobID)
+	if jobDelivered != job.State || "A" != job.DocumentID || "t-1" != job.Sequence ||
+		1 != len(dest.received()) {
+		t.Errorf("got %+v; the destination saw %q", job, dest.received())
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"reflectsvc/misc"
+)
+
+// decodeJson2JsonRequest reads flat JSON keyed by XML name, such as
+// body.json, into the same request /xml2json makes of Xtracta's XML,
+// so from here on it is converted, validated and delivered the same
+// way (by makeXml2JsonEndpoint and x2jEncodeResponse).
+func decodeJson2JsonRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer misc.DeferError(xLogBuffer.Flush)
+	guid := xSequence.Next()
+	if FlagDebug {
+		xLog.Printf("enter decodeJson2JsonRequest -- %s", guid)
+	}
+	body, err := io.ReadAll(r.Body)
+	if nil != err {
+		xLog.Printf("io.ReadAll failed on decodeJson2JsonRequest because %s", err.Error())
+		return nil, err
+	}
+	events, err := xtractaFromFlatJson(body)
+	if nil != err {
+		xLog.Printf("could not read the JSON of %s because %s", guid, err.Error())
+		return nil, statusError{err, http.StatusBadRequest}
+	}
+	req := xml2JsonRequest(events)
+	req.MagicInternalGuid = guid
+	req.Headers = r.Header
+	return req, nil
+}
+
+// xtractaFromFlatJson makes a JSON object (or an array of them, a
+// batch) into Xtracta events. Each member is a field of that name, in
+// the order written; a member named for document metadata (@document_id
+// and so on) sets it instead. The events' Raw is them as Xtracta XML,
+// so a queued or dead-lettered document can be converted again.
+func xtractaFromFlatJson(data []byte) (x XtractaEvents, err error) {
+	callback, err := xtractaFromJson(data, xtractaEventFromFlatJson)
+	if nil != err {
+		return x, err
+	}
+	x.XMLName = xml.Name{Local: "events"}
+	x.Event, x.More = callback.Events[0], callback.Events[1:]
+	raw, err := xml.Marshal(callback)
+	if nil != err {
+		return x, err
+	}
+	x.Raw = append([]byte(xml.Header), raw...)
+	return x, nil
+}
+
+func xtractaEventFromFlatJson(doc jsonDocument) XtractaEvent {
+	var x XtractaEvents
+	plain := &remapField{FieldType: JsonString}
+	for _, key := range doc.keys {
+		addJsonValue(&x, key, plain, doc.values[key], doc, "")
+	}
+	return x.Event
+}
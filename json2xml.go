@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflectsvc/misc"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// xtractaCallback is the XML of a callback of any number of events
+type xtractaCallback struct {
+	XMLName xml.Name       `xml:"events"`
+	Events  []XtractaEvent `xml:"event"`
+}
+
+// xtractaGenerated is how Xtracta writes the time of an event
+const xtractaGenerated = "2006-01-02T15:04:05-07:00"
+
+// jsonDocument is one JSON object of a document: its members, and
+// their names in the order they are written
+type jsonDocument struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func readJsonDocument(data []byte) (doc jsonDocument, err error) {
+	if doc.keys, err = jsonObjectKeys(data); nil != err {
+		return doc, err
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	err = d.Decode(&doc.values)
+	return doc, err
+}
+
+// xtractaFromJson reads JSON that is one document (an object) or a
+// batch (an array of them) into a callback, with an event made of each
+// document by event. An event without a sequence is numbered by its
+// place in the batch.
+func xtractaFromJson(data []byte, event func(doc jsonDocument) XtractaEvent) (callback xtractaCallback, err error) {
+	data = bytes.TrimSpace(data)
+	var docs []json.RawMessage
+	if bytes.HasPrefix(data, []byte("[")) {
+		if err = json.Unmarshal(data, &docs); nil != err {
+			return callback, err
+		}
+		if len(docs) == 0 {
+			return callback, errors.New("the JSON array has no documents in it")
+		}
+	} else {
+		docs = []json.RawMessage{data}
+	}
+
+	callback.Events = make([]XtractaEvent, 0, len(docs))
+	for ix, data := range docs {
+		doc, err := readJsonDocument(data)
+		if nil != err {
+			if len(docs) > 1 {
+				return callback, fmt.Errorf("document [%d]: %w", ix, err)
+			}
+			return callback, err
+		}
+		e := event(doc)
+		if !misc.IsStringSet(&e.Sequence) {
+			e.Sequence = strconv.Itoa(ix + 1)
+		}
+		callback.Events = append(callback.Events, e)
+	}
+	return callback, nil
+}
+
+// addJsonValue puts a value of a JSON document into x: a metadata name
+// (see xtractaMetadata) where Xtracta sends it, and anything else as a
+// field of that name. The value is written the way rm reads it.
+func addJsonValue(x *XtractaEvents, name string, rm *remapField, value interface{}, doc jsonDocument,
+	confidence string) {
+	if _, ok := xtractaMetadata[name]; ok {
+		setXtractaMetadata(x, name, rm, value)
+		return
+	}
+	x.Event.Document.FieldData.Field = append(x.Event.Document.FieldData.Field, XtractaField{FieldName: name,
+		FieldValue: xmlFieldValue(rm, value, doc.values), FieldExtractionConfidence: confidence})
+}
+
+// jsonToXtracta turns JSON as /xml2json sends it (an object, or an array of
+// them for --batch-events array) back into the Xtracta callback it
+// could have come from, using the mapping backwards: JSON names become
+// XML names again, numbers, booleans and dates are written the way
+// the mapping reads them, and the `@` names go back to the document
+// metadata. Members not in the mapping become fields of their own
+// name. Values are never refused: one that does not fit its type is
+// written as it is.
+func jsonToXtracta(data []byte, remap map[string]remapField) ([]byte, error) {
+	mapped := make([]remapField, 0, len(remap))
+	for _, rm := range remap {
+		mapped = append(mapped, rm)
+	}
+	sort.Slice(mapped, func(i, j int) bool { return mapped[i].Order < mapped[j].Order })
+
+	callback, err := xtractaFromJson(data, func(doc jsonDocument) XtractaEvent {
+		return xtractaEventFromJson(doc, remap, mapped)
+	})
+	if nil != err {
+		return nil, err
+	}
+	out, err := xml.MarshalIndent(callback, "", "\t")
+	if nil != err {
+		return nil, err
+	}
+	return append(append([]byte(xml.Header), out...), '\n'), nil
+}
+
+// xtractaEventFromJson is the event of a document sent with remap;
+// mapped is remap in the order of the mapping file
+func xtractaEventFromJson(doc jsonDocument, remap map[string]remapField, mapped []remapField) XtractaEvent {
+	var x XtractaEvents
+
+	// what the sidecar objects say about the confidence of each field
+	confidences := make(map[string]string)
+	for _, name := range []string{FlagLowConfidenceField, FlagConfidenceField} {
+		if obj, ok := doc.values[name].(map[string]interface{}); ok && misc.IsStringSet(&name) {
+			for field, c := range obj {
+				if n, ok := c.(json.Number); ok {
+					confidences[field] = string(n)
+				}
+			}
+		}
+	}
+
+	used := map[string]bool{FlagLowConfidenceField: true, FlagConfidenceField: true}
+	if _, ok := remap["@document_url"]; !ok {
+		used["documentLink"] = true
+		if link, ok := doc.values["documentLink"].(string); ok {
+			x.Event.Document.DocumentURL = link
+		}
+	}
+	for _, rm := range mapped {
+		if nil != rm.Select {
+			// XML of another shape; there is no Xtracta field for it
+			continue
+		}
+		var value interface{}
+		if nil != rm.Path {
+			used[rm.Path[0].Key] = true
+			if nil != rm.CurrencyPath {
+				used[rm.CurrencyPath[0].Key] = true
+			}
+			value, _ = getJsonPath(doc.values, rm.Path)
+		}
+		addJsonValue(&x, rm.XMLName, &rm, value, doc, confidences[rm.JsonName])
+	}
+	plain := &remapField{FieldType: JsonString}
+	for _, key := range doc.keys {
+		if !used[key] {
+			addJsonValue(&x, key, plain, doc.values[key], doc, confidences[key])
+		}
+	}
+	if !misc.IsStringSet(&x.Event.Generated) {
+		x.Event.Generated = time.Now().UTC().Format(xtractaGenerated)
+	}
+	return x.Event
+}
+
+// jsonObjectKeys are the names of the members of a JSON object, in the
+// order they are written
+func jsonObjectKeys(data []byte) ([]string, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := d.Token(); nil != err {
+		return nil, err
+	} else if delim, ok := tok.(json.Delim); !ok || '{' != delim {
+		return nil, errors.New("the JSON is not an object")
+	}
+	var keys []string
+	for d.More() {
+		tok, err := d.Token()
+		if nil != err {
+			return nil, err
+		}
+		keys = append(keys, tok.(string))
+		var skip json.RawMessage
+		if err = d.Decode(&skip); nil != err {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// setXtractaMetadata puts the value of an `@` name back where Xtracta
+// sends it
+func setXtractaMetadata(x *XtractaEvents, name string, rm *remapField, value interface{}) {
+	var values []string
+	if list, ok := value.([]interface{}); ok {
+		for _, v := range list {
+			values = append(values, xmlFieldValue(rm, v, nil))
+		}
+	} else if nil != value {
+		values = []string{xmlFieldValue(rm, value, nil)}
+	}
+	switch name {
+	case "@image_url":
+		x.Event.Document.ImageURL = values
+	case "@p3id_sequence":
+		// ours, not Xtracta's
+	default:
+		if set, ok := profileMetadata[name]; ok {
+			set(x, values)
+		}
+	}
+}
+
+// xmlFieldValue writes a JSON value the way the field's type reads it;
+// doc, if given, is where a number's currency is looked up
+func xmlFieldValue(rm *remapField, value interface{}, doc map[string]interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		if JsonDate == rm.FieldType || JsonDateTime == rm.FieldType {
+			return reverseDate(rm, v)
+		}
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		s := string(v)
+		if (JsonNumeric == rm.FieldType || JsonInteger == rm.FieldType) && decimalComma == rm.Decimal {
+			s = strings.Replace(s, ".", ",", 1)
+		}
+		if nil != rm.CurrencyPath && nil != doc {
+			if code, ok := getJsonPath(doc, rm.CurrencyPath); ok {
+				if code, ok := code.(string); ok && misc.IsStringSet(&code) && code != rm.CurrencyDefault {
+					s += " " + code
+				}
+			}
+		}
+		return s
+	}
+	text, _ := marshalJson(value)
+	return string(text)
+}
+
+// json2xmlCommand converts a JSON file (or stdin) to Xtracta XML on stdout
+func json2xmlCommand(args []string) int {
+	var data []byte
+	var err error
+	switch len(args) {
+	case 0:
+		data, err = io.ReadAll(os.Stdin)
+	case 1:
+		data, err = os.ReadFile(args[0])
+	default:
+		_, _ = fmt.Fprintln(os.Stderr, "usage: reflectsvc [--fieldNames <file>] json2xml [<json file>]")
+		return 2
+	}
+	if nil != err {
+		_, _ = fmt.Fprintf(os.Stderr, "could not read the JSON because %s\n", err.Error())
+		return 1
+	}
+	out, err := jsonToXtracta(data, FlagRemapMap)
+	if nil != err {
+		_, _ = fmt.Fprintf(os.Stderr, "could not convert the JSON because %s\n", err.Error())
+		return 1
+	}
+	_, _ = os.Stdout.Write(out)
+	return 0
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-kit/kit/endpoint"
+	"io"
+	"net/http"
+	"reflectsvc/misc"
+)
+
+// json2XmlRequest is JSON to turn back into Xtracta XML, with the field
+// mapping of Route (?route=name) if it is set
+type json2XmlRequest struct {
+	Body  []byte
+	Route string
+}
+
+type json2XmlResponse struct {
+	XML   []byte
+	Error string
+}
+
+func makeJson2XmlEndpoint(svc SimpleService) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req := request.(json2XmlRequest)
+		v, err := svc.Json2Xml(req)
+		if nil != err {
+			return json2XmlResponse{Error: err.Error()}, nil
+		}
+		return json2XmlResponse{XML: v}, nil
+	}
+}
+
+func decodeJson2XmlRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer misc.DeferError(xLogBuffer.Flush)
+	body, err := io.ReadAll(r.Body)
+	if nil != err {
+		xLog.Printf("io.ReadAll failed on decodeJson2XmlRequest because %s", err.Error())
+		return nil, err
+	}
+	return json2XmlRequest{Body: body, Route: r.URL.Query().Get("route")}, nil
+}
+
+func encodeJson2XmlResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	v := response.(json2XmlResponse)
+	if misc.IsStringSet(&v.Error) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, err := fmt.Fprintf(w, "{\"error\":%s}", jsonQuote(v.Error))
+		return err
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	_, err := w.Write(v.XML)
+	return err
+}
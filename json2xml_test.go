@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJsonXmlJsonRoundTrip(t *testing.T) {
+	// the sample callback as /xml2json sends it, back to XML and again
+	want, err := os.ReadFile(filepath.Join("testdata", "xml2json", "body.json"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	remap, _, err := readFieldTranslations("fieldnames.csv")
+	if nil != err {
+		t.Fatal(err)
+	}
+	xmlData, err := jsonToXtracta(want, remap)
+	if nil != err {
+		t.Fatal(err)
+	}
+	events, err := readDocuments(xmlData)
+	if nil != err {
+		t.Fatalf("%s\n%s", err, xmlData)
+	}
+	c, err := events.ConvertAll(remap)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if got := c.Body; string(bytes.TrimSpace(want)) != got {
+		t.Errorf("round trip\n got: %s\nwant: %s", got, want)
+	}
+}
+
+func TestJsonToXtracta(t *testing.T) {
+	remap := testMapping(t,
+		"@document_id;id;string;false",
+		"@sequence;seq;string;false",
+		"Total;total;number;false;decimal=comma")
+	for _, tc := range []struct {
+		json string
+		// want is each event as sequence/document id: fields
+		want []string
+	}{
+		{`{"id":"A","total":1.5,"extra":true}`, []string{"1/A: Total=1,5 extra=true"}},
+		// sequences default to the place in the batch
+		{`[{"id":"A","seq":"7"},{"id":"B","note":{"x":[1]}}]`,
+			[]string{"7/A: Total=", "2/B: Total= note={\"x\":[1]}"}},
+		// a metadata name that is not mapped sets the metadata all the same
+		{`{"id":"A","@workflow_id":"9","@image_url[]":["u1","u2"]}`, []string{"1/A: Total="}},
+	} {
+		data, err := jsonToXtracta([]byte(tc.json), remap)
+		if nil != err {
+			t.Errorf("%s: %s", tc.json, err)
+			continue
+		}
+		x, err := readDocuments(data)
+		if nil != err {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range x.eachEvent() {
+			got = append(got, e.Event.Sequence+"/"+e.Event.Document.DocumentID+": "+fieldValues(e.Event))
+			if strings.Contains(tc.json, "@workflow_id") && ("9" != e.Event.Document.WorkflowID ||
+				2 != len(e.Event.Document.ImageURL)) {
+				t.Errorf("%s: metadata not set: %+v", tc.json, e.Event.Document)
+			}
+		}
+		if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("%s\n got: %q\nwant: %q", tc.json, got, tc.want)
+		}
+	}
+}
+
+func TestJsonToXtractaErrors(t *testing.T) {
+	for _, tc := range []struct {
+		json string
+		want string
+	}{
+		{`[]`, "no documents"},
+		{`3`, "not an object"},
+		{`{"a":`, ""},
+		// a document of a batch is named
+		{`[{"a":1},"b"]`, "document [1]: the JSON is not an object"},
+		{`[{"a":1}`, ""},
+	} {
+		for name, convert := range map[string]func([]byte) error{
+			"json2xml":  func(data []byte) error { _, err := jsonToXtracta(data, nil); return err },
+			"json2json": func(data []byte) error { _, err := xtractaFromFlatJson(data); return err },
+		} {
+			if err := convert([]byte(tc.json)); nil == err || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("%s of %s: got %v, want an error about %q", name, tc.json, err, tc.want)
+			}
+		}
+	}
+}
+
+func TestXtractaFromFlatJson(t *testing.T) {
+	data, err := os.ReadFile("body.json")
+	if nil != err {
+		t.Fatal(err)
+	}
+	x, err := xtractaFromFlatJson(data)
+	if nil != err {
+		t.Fatal(err)
+	}
+	keys, _ := jsonObjectKeys(data)
+	fields := x.Event.Document.FieldData.Field
+	if len(fields) != len(keys) || "Shipment Type" != fields[0].FieldName || "G-RATED ONLY" != fields[0].FieldValue {
+		t.Errorf("got %d fields (first %+v) for %d members", len(fields), fields[0], len(keys))
+	}
+	for ix := range fields {
+		if keys[ix] != fields[ix].FieldName {
+			t.Errorf("field %d is %s, want %s", ix, fields[ix].FieldName, keys[ix])
+			break
+		}
+	}
+
+	// a batch, with metadata; its Raw reads back as the same events
+	x, err = xtractaFromFlatJson([]byte(`[{"@document_id":"A","Total":"1"},` +
+		`{"@document_id":"B","@sequence":"5","@image_url[]":["u1","u2"],"Total":"2"}]`))
+	if nil != err {
+		t.Fatal(err)
+	}
+	again, err := readDocuments(x.Raw)
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, y := range []XtractaEvents{x, again} {
+		if len(y.More) != 1 || "A" != y.Event.Document.DocumentID || "1" != y.Event.Sequence ||
+			"B" != y.More[0].Document.DocumentID || "5" != y.More[0].Sequence ||
+			2 != len(y.More[0].Document.ImageURL) || "Total=2" != fieldValues(y.More[0]) {
+			t.Errorf("got %+v", y)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonObject is a JSON object that keeps its members in the order they
+// were first set, which encoding/json does not do for a map. Values are
+// anything encoding/json can marshal: string, json.Number, bool, nil,
+// []interface{} or another *jsonObject.
+type jsonObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newJsonObject() *jsonObject {
+	return &jsonObject{values: make(map[string]interface{})}
+}
+
+// Set adds key, or replaces its value where it already stands
+func (o *jsonObject) Set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *jsonObject) Get(key string) (interface{}, bool) {
+	v, ok := o.values[key]
+	return v, ok
+}
+
+func (o *jsonObject) Len() int {
+	return len(o.keys)
+}
+
+func (o *jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for ix, key := range o.keys {
+		if ix > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := marshalJson(key)
+		if nil != err {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := marshalJson(o.values[key])
+		if nil != err {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// marshalJson is json.Marshal without turning <, > and & into \u00XX,
+// so URLs in the output read the way they came in
+func marshalJson(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); nil != err {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}), nil
+}
+
+// jsonQuote is s as a JSON string literal
+func jsonQuote(s string) string {
+	b, _ := marshalJson(s)
+	return string(b)
+}
+
+// jsonDecimal checks that s is a plain decimal number and returns it as
+// a JSON number with its digits untouched, so 1540.10 stays 1540.10
+// rather than going through a float64. A leading + and leading zeros
+// are dropped, and a bare ".5" or "5." gains its missing zero.
+func jsonDecimal(s string) (json.Number, bool) {
+	s = strings.TrimSpace(s)
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign = "-"
+		s = s[1:]
+	} else if strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+	exp := ""
+	if ix := strings.IndexAny(s, "eE"); ix >= 0 {
+		exp = s[ix+1:]
+		s = s[:ix]
+		e := strings.TrimPrefix(strings.TrimPrefix(exp, "-"), "+")
+		if !allDigits(e) {
+			return "", false
+		}
+		exp = "e" + exp
+	}
+	whole, frac := s, ""
+	if ix := strings.IndexByte(s, '.'); ix >= 0 {
+		whole, frac = s[:ix], s[ix+1:]
+		if !allDigits(frac) && frac != "" {
+			return "", false
+		}
+	}
+	if whole == "" && frac == "" {
+		return "", false
+	}
+	if whole != "" && !allDigits(whole) {
+		return "", false
+	}
+	whole = strings.TrimLeft(whole, "0")
+	if whole == "" {
+		whole = "0"
+	}
+	n := sign + whole
+	if frac != "" {
+		n += "." + frac
+	}
+	return json.Number(n + exp), true
+}
+
+// jsonInteger is jsonDecimal for whole numbers; "150.00" is 150, but
+// "150.5" and anything with an exponent are not integers
+func jsonInteger(s string) (json.Number, bool) {
+	n, ok := jsonDecimal(s)
+	if !ok || strings.ContainsAny(string(n), "eE") {
+		return "", false
+	}
+	str := string(n)
+	if ix := strings.IndexByte(str, '.'); ix >= 0 {
+		if strings.Trim(str[ix+1:], "0") != "" {
+			return "", false
+		}
+		str = str[:ix]
+	}
+	if str == "-0" {
+		str = "0"
+	}
+	return json.Number(str), true
+}
+
+func allDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// maxJsonIndex bounds the array positions a path may name, so a typo
+// in the mapping file cannot ask for a billion element array
+const maxJsonIndex = 1000
+
+// jsonStep is one step of a path into the output JSON: a member name,
+// or (Index >= 0) a position in an array
+type jsonStep struct {
+	Key   string
+	Index int
+}
+
+// parseJsonPath splits `origin.city` or `parties[0].lastName` into its
+// steps; a name with no dots or brackets is a single step
+func parseJsonPath(path string) ([]jsonStep, error) {
+	var steps []jsonStep
+	for _, segment := range strings.Split(path, ".") {
+		name := segment
+		if ix := strings.IndexByte(segment, '['); ix >= 0 {
+			name = segment[:ix]
+		}
+		if "" == name {
+			return nil, fmt.Errorf("%q has an empty name in it", path)
+		}
+		steps = append(steps, jsonStep{Key: name, Index: -1})
+		for rest := segment[len(name):]; "" != rest; {
+			end := strings.IndexByte(rest, ']')
+			if !strings.HasPrefix(rest, "[") || end < 0 {
+				return nil, fmt.Errorf("%q has a bad array index in it", path)
+			}
+			n, err := strconv.Atoi(rest[1:end])
+			if nil != err || n < 0 || n >= maxJsonIndex {
+				return nil, fmt.Errorf("%q has a bad array index %q in it (want 0 to %d)",
+					path, rest[1:end], maxJsonIndex-1)
+			}
+			steps = append(steps, jsonStep{Index: n})
+			rest = rest[end+1:]
+		}
+	}
+	return steps, nil
+}
+
+// jsonPathsConflict is true when one path runs through the other, or
+// they treat the same step as an object member and as an array
+// position, so both could not be set in one document
+func jsonPathsConflict(a []jsonStep, b []jsonStep) bool {
+	for ix := 0; ix < len(a) && ix < len(b); ix++ {
+		if a[ix] != b[ix] {
+			return (a[ix].Index < 0) != (b[ix].Index < 0)
+		}
+	}
+	return len(a) != len(b)
+}
+
+// SetPath sets the value at the end of steps, making the objects and
+// arrays on the way as they are needed, so a parent only appears when
+// something in it is set. Positions skipped in an array are null.
+func (o *jsonObject) SetPath(steps []jsonStep, value interface{}) error {
+	_, err := setJsonPath(o, steps, value)
+	return err
+}
+
+func setJsonPath(node interface{}, steps []jsonStep, value interface{}) (interface{}, error) {
+	step := steps[0]
+	if step.Index < 0 {
+		obj, ok := node.(*jsonObject)
+		if nil == node {
+			obj = newJsonObject()
+		} else if !ok {
+			return node, fmt.Errorf("%s is not an object", step.Key)
+		}
+		if len(steps) == 1 {
+			obj.Set(step.Key, value)
+			return obj, nil
+		}
+		child, _ := obj.Get(step.Key)
+		child, err := setJsonPath(child, steps[1:], value)
+		if nil != err {
+			return obj, err
+		}
+		obj.Set(step.Key, child)
+		return obj, nil
+	}
+
+	arr, ok := node.([]interface{})
+	if nil != node && !ok {
+		return node, fmt.Errorf("[%d] is not in an array", step.Index)
+	}
+	for len(arr) <= step.Index {
+		arr = append(arr, nil)
+	}
+	if len(steps) == 1 {
+		arr[step.Index] = value
+		return arr, nil
+	}
+	child, err := setJsonPath(arr[step.Index], steps[1:], value)
+	arr[step.Index] = child
+	return arr, err
+}
+
+// getJsonPath finds the value at the end of steps in decoded JSON
+func getJsonPath(node interface{}, steps []jsonStep) (interface{}, bool) {
+	for _, step := range steps {
+		if step.Index < 0 {
+			obj, ok := node.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if node, ok = obj[step.Key]; !ok {
+				return nil, false
+			}
+			continue
+		}
+		arr, ok := node.([]interface{})
+		if !ok || step.Index >= len(arr) {
+			return nil, false
+		}
+		node = arr[step.Index]
+	}
+	return node, true
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseJsonPath(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		want []jsonStep
+	}{
+		{"city", []jsonStep{{"city", -1}}},
+		{"origin.city", []jsonStep{{"origin", -1}, {"city", -1}}},
+		{"parties[0].lastName", []jsonStep{{"parties", -1}, {Index: 0}, {"lastName", -1}}},
+		{"grid[2][999]", []jsonStep{{"grid", -1}, {Index: 2}, {Index: 999}}},
+		{"a b.c-d", []jsonStep{{"a b", -1}, {"c-d", -1}}},
+		{"", nil},
+		{"origin.", nil},
+		{".city", nil},
+		{"a..b", nil},
+		{"[0]", nil},
+		{"parties[", nil},
+		{"parties[x]", nil},
+		{"parties[-1]", nil},
+		{"parties[1000]", nil},
+		{"parties[0]x", nil},
+		{"parties]0[", nil},
+	} {
+		got, err := parseJsonPath(tc.path)
+		if (nil == tc.want) != (nil != err) || !reflect.DeepEqual(tc.want, got) {
+			t.Errorf("%q: got %v, %v; want %v", tc.path, got, err, tc.want)
+		}
+	}
+}
+
+func TestSetPath(t *testing.T) {
+	steps := func(path string) []jsonStep {
+		s, err := parseJsonPath(path)
+		if nil != err {
+			t.Fatal(err)
+		}
+		return s
+	}
+	obj := newJsonObject()
+	for _, set := range []struct {
+		path  string
+		value interface{}
+	}{
+		{"id", "A"},
+		{"origin.city", "Auckland"},
+		{"parties[1].lastName", "Smith"},
+		{"origin.zip", json.Number("1010")},
+		{"parties[0].lastName", "Jones"},
+		{"parties[1].firstName", "Jo"},
+		{"grid[1][2]", true},
+		// replaced where it stands
+		{"id", "B"},
+	} {
+		if err := obj.SetPath(steps(set.path), set.value); nil != err {
+			t.Fatalf("%s: %s", set.path, err)
+		}
+	}
+	got, err := marshalJson(obj)
+	want := `{"id":"B","origin":{"city":"Auckland","zip":1010},` +
+		`"parties":[{"lastName":"Jones"},{"lastName":"Smith","firstName":"Jo"}],"grid":[null,[null,null,true]]}`
+	if nil != err || want != string(got) {
+		t.Errorf("got %s, %v\nwant %s", got, err, want)
+	}
+
+	for _, path := range []string{"id.first", "origin[0]", "parties.lastName", "grid[1][2].x"} {
+		if err = obj.SetPath(steps(path), "x"); nil == err {
+			t.Errorf("%s: set over something of another shape", path)
+		}
+	}
+}
+
+func TestGetJsonPath(t *testing.T) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(`{"origin":{"city":"Auckland"},"parties":[{"lastName":"Jones"},null]}`),
+		&doc); nil != err {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]interface{}{
+		"origin.city":         "Auckland",
+		"parties[0].lastName": "Jones",
+		"parties[1]":          nil,
+	} {
+		steps, _ := parseJsonPath(path)
+		if got, ok := getJsonPath(doc, steps); !ok || want != got {
+			t.Errorf("%s: got %v, %v", path, got, ok)
+		}
+	}
+	for _, path := range []string{"city", "origin.zip", "origin[0]", "parties[2]", "parties.lastName",
+		"parties[1].lastName"} {
+		steps, _ := parseJsonPath(path)
+		if got, ok := getJsonPath(doc, steps); ok {
+			t.Errorf("%s: found %v", path, got)
+		}
+	}
+}
+
+func TestJsonPathsConflict(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want bool
+	}{
+		{"origin.city", "origin.zip", false},
+		{"parties[0].lastName", "parties[1].lastName", false},
+		{"city", "zip", false},
+		{"origin", "origin.city", true},
+		{"origin.city", "origin", true},
+		{"origin.city", "origin[0]", true},
+		{"parties[0]", "parties[0].lastName", true},
+		// two XML names for one JSON name; whichever is in the document is set
+		{"id", "id", false},
+	} {
+		a, _ := parseJsonPath(tc.a)
+		b, _ := parseJsonPath(tc.b)
+		if got := jsonPathsConflict(a, b); tc.want != got {
+			t.Errorf("%s and %s: got %v", tc.a, tc.b, got)
+		}
+	}
+}
+
+func TestConvertNestedNames(t *testing.T) {
+	remap := testMapping(t,
+		"Vendor;parties[0].name;string;false",
+		"Buyer;parties[1].name;string;false",
+		"City;origin.city;string;true",
+		"Total;totals.amount;number;false")
+	c, err := testDocument("1", "", "", "Buyer=Acme", "Total=12.50", "Vendor=Ltd").Convert(remap)
+	want := `{"documentLink":"","parties":[{"name":"Ltd"},{"name":"Acme"}],"totals":{"amount":12.50}}`
+	if nil != err || want != c.Body {
+		t.Errorf("got %s, %v\nwant %s", c.Body, err, want)
+	}
+
+	// names that cannot both be set are the mapping's problem
+	fn := filepath.Join(t.TempDir(), "mapping.csv")
+	data := "Vendor;parties[0];string;false\nBuyer;parties[0].name;string;false\nCity;origin[;string;false\n"
+	if err = os.WriteFile(fn, []byte(data), 0644); nil != err {
+		t.Fatal(err)
+	}
+	_, problems, err := readFieldTranslations(fn)
+	var lines []string
+	for _, p := range problems {
+		lines = append(lines, p.String())
+	}
+	if nil != err || 2 != len(problems) || 2 != problems[0].Line || 3 != problems[1].Line ||
+		!strings.Contains(problems[0].Message, "conflicts with") ||
+		!strings.Contains(problems[1].Message, "bad array index") {
+		t.Errorf("got %v, %q", err, lines)
+	}
+}
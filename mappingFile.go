@@ -0,0 +1,254 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// mappingSchema is the JSON Schema of the YAML and JSON mapping files
+//
+//go:embed mapping.schema.json
+var mappingSchema []byte
+
+// mappingVersion is the version of the mapping file format read here
+const mappingVersion = 1
+
+// readMappingFile reads the YAML (or JSON, which YAML reads too)
+// mapping format:
+//
+//	version: 1
+//	fields:
+//	  - xml: SP Bill Amount
+//	    json: sPBillNetAmt
+//	    type: number
+//	    omitEmpty: true
+//	    currency: currencyCD
+//	    min: 0
+//
+// Besides xml, json, type and omitEmpty, a field takes the options of
+// the `;` format under the same names (see setOption); in, mustBe and
+// enum may be lists. Unlike the `;` format, an unknown type or a
+// omitEmpty that is not a boolean is an error.
+func readMappingFile(fn string, data []byte) (fields []remapField, where []mappingPos, problems []mappingProblem) {
+	problem := func(n *yaml.Node, format string, args ...interface{}) {
+		p := mappingProblem{File: fn, Message: fmt.Sprintf(format, args...)}
+		if nil != n {
+			p.Line, p.Column = n.Line, n.Column
+		}
+		problems = append(problems, p)
+	}
+
+	if strings.HasSuffix(strings.ToLower(fn), ".json") {
+		// encoding/json says exactly where JSON goes wrong
+		var v interface{}
+		if err := json.Unmarshal(data, &v); nil != err {
+			p := mappingProblem{File: fn, Message: err.Error()}
+			var se *json.SyntaxError
+			if errors.As(err, &se) && se.Offset > 0 {
+				// Offset is just past the byte it stopped at
+				p.Line, p.Column = lineColumn(data, int(se.Offset)-1)
+			}
+			return nil, nil, append(problems, p)
+		}
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); nil != err {
+		return nil, nil, append(problems, yamlProblem(fn, err))
+	}
+	if len(root.Content) == 0 || yaml.MappingNode != root.Content[0].Kind {
+		problem(nil, "expected a mapping with version and fields")
+		return nil, nil, problems
+	}
+
+	doc := root.Content[0]
+	var list *yaml.Node
+	version := false
+	for ix := 0; ix+1 < len(doc.Content); ix += 2 {
+		key, value := doc.Content[ix], doc.Content[ix+1]
+		switch key.Value {
+		case "$schema":
+		case "version":
+			version = true
+			if n, err := strconv.Atoi(value.Value); nil != err || mappingVersion != n {
+				problem(value, "unsupported version %s (want %d)", value.Value, mappingVersion)
+			}
+		case "fields":
+			if yaml.SequenceNode != value.Kind {
+				problem(value, "fields must be a list")
+				continue
+			}
+			list = value
+		default:
+			problem(key, "unknown key %q", key.Value)
+		}
+	}
+	if !version {
+		problem(doc, "missing version (want version: %d)", mappingVersion)
+	}
+	if nil == list {
+		problem(doc, "missing fields")
+		return nil, nil, problems
+	}
+
+	for _, item := range list.Content {
+		if yaml.MappingNode != item.Kind {
+			problem(item, "a field must be a mapping of xml, json, type, ...")
+			continue
+		}
+		rm := newRemapField()
+		bad := false
+		seen := make(map[string]bool)
+		for ix := 0; ix+1 < len(item.Content); ix += 2 {
+			key, value := item.Content[ix], item.Content[ix+1]
+			if seen[key.Value] {
+				problem(key, "%s is given twice", key.Value)
+				bad = true
+				continue
+			}
+			seen[key.Value] = true
+			text, ok := mappingValue(key.Value, value)
+			if !ok {
+				problem(value, "%s must be a single value", key.Value)
+				bad = true
+				continue
+			}
+			switch key.Value {
+			case "xml":
+				rm.XMLName = text
+			case "json":
+				rm.JsonName = text
+			case "type":
+				if rm.FieldType, ok = parseFieldType(text); !ok {
+					problem(value, "unknown type %q (want string, number, integer, boolean, date or datetime)",
+						text)
+					bad = true
+				}
+			case "omitEmpty":
+				if rm.OmitEmpty, ok = yamlBool(value); !ok {
+					problem(value, "omitEmpty must be true or false")
+					bad = true
+				}
+			default:
+				if err := rm.setOption(key.Value + "=" + text); nil != err {
+					problem(key, "%s", err.Error())
+					bad = true
+				}
+			}
+		}
+		if "" == rm.XMLName {
+			problem(item, "missing xml (the XML name)")
+			bad = true
+		}
+		if "" == rm.JsonName {
+			problem(item, "missing json (the JSON name, or - to leave the field out)")
+			bad = true
+		}
+		if !bad {
+			fields = append(fields, rm)
+			where = append(where, mappingPos{item.Line, item.Column})
+		}
+	}
+	return fields, where, problems
+}
+
+// mappingValue is a field's value as the `;` format would have it:
+// lists are joined with |
+func mappingValue(key string, n *yaml.Node) (string, bool) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		return n.Value, true
+	case yaml.SequenceNode:
+		switch strings.ToLower(key) {
+		case "in", "mustbe", "enum":
+			values := make([]string, 0, len(n.Content))
+			for _, v := range n.Content {
+				if yaml.ScalarNode != v.Kind {
+					return "", false
+				}
+				values = append(values, v.Value)
+			}
+			return strings.Join(values, "|"), true
+		}
+	}
+	return "", false
+}
+
+func yamlBool(n *yaml.Node) (bool, bool) {
+	var b bool
+	if "!!bool" != n.ShortTag() || nil != n.Decode(&b) {
+		return false, false
+	}
+	return b, true
+}
+
+var yamlLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// yamlProblem finds the line in a YAML syntax error
+func yamlProblem(fn string, err error) mappingProblem {
+	p := mappingProblem{File: fn, Message: err.Error()}
+	if m := yamlLine.FindStringSubmatch(err.Error()); nil != m {
+		p.Line, _ = strconv.Atoi(m[1])
+		p.Column = 1
+		p.Message = m[2]
+	}
+	return p
+}
+
+// lineColumn finds a byte offset in data
+func lineColumn(data []byte, offset int) (line int, column int) {
+	if offset > len(data) {
+		offset = len(data)
+	}
+	line, column = 1, 1
+	for _, c := range data[:offset] {
+		if '\n' == c {
+			line, column = line+1, 1
+		} else {
+			column++
+		}
+	}
+	return line, column
+}
+
+// mappingCommand checks mapping files, or prints the schema of the
+// YAML and JSON format
+func mappingCommand(args []string) int {
+	if len(args) == 1 && "schema" == args[0] {
+		_, _ = os.Stdout.Write(mappingSchema)
+		return 0
+	}
+	if len(args) < 2 || "lint" != args[0] {
+		_, _ = fmt.Fprintln(os.Stderr, "usage: reflectsvc mapping lint <mapping file>...\n"+
+			"       reflectsvc mapping schema")
+		return 2
+	}
+	status := 0
+	for _, fn := range args[1:] {
+		remap, problems, err := readFieldTranslations(fn)
+		if nil != err {
+			_, _ = fmt.Fprintf(os.Stdout, "%s: error: %s\n", fn, err.Error())
+			status = 1
+			continue
+		}
+		errs := 0
+		for _, p := range problems {
+			_, _ = fmt.Fprintln(os.Stdout, p.String())
+			if !p.Warning {
+				errs++
+			}
+		}
+		if errs > 0 {
+			status = 1
+		}
+		_, _ = fmt.Fprintf(os.Stdout, "%s: %d field(s), %d error(s), %d warning(s)\n",
+			fn, len(remap), errs, len(problems)-errs)
+	}
+	return status
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readTestMapping reads text as the mapping file name
+func readTestMapping(t *testing.T, name string, text string) (map[string]remapField, []mappingProblem) {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fn, []byte(text), 0644); nil != err {
+		t.Fatal(err)
+	}
+	remap, problems, err := readFieldTranslations(fn)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return remap, problems
+}
+
+func TestReadMappingFile(t *testing.T) {
+	csv := testMapping(t,
+		"SP Bill Amount;sPBillNetAmt;number;true;currency=currencyCD;min=0",
+		"Status;status;string;false;mustBe=open|closed;required=true",
+		"Bill Date;billDate;date;false;in=01/02/2006|2006-01-02",
+		"@document_url;-;string;false")
+	yamlText := `# the same mapping
+version: 1
+fields:
+  - xml: SP Bill Amount
+    json: sPBillNetAmt
+    type: number
+    omitEmpty: true
+    currency: currencyCD
+    min: 0
+  - xml: Status
+    json: status
+    type: string
+    mustBe: [open, closed]
+    required: true
+  - {xml: Bill Date, json: billDate, type: date, in: ["01/02/2006", "2006-01-02"]}
+  - xml: "@document_url"
+    json: "-"
+`
+	jsonText := `{"version": 1, "fields": [
+	{"xml": "SP Bill Amount", "json": "sPBillNetAmt", "type": "number", "omitEmpty": true,
+		"currency": "currencyCD", "min": 0},
+	{"xml": "Status", "json": "status", "mustBe": ["open", "closed"], "required": true},
+	{"xml": "Bill Date", "json": "billDate", "type": "date", "in": "01/02/2006|2006-01-02"},
+	{"xml": "@document_url", "json": "-"}
+]}
+`
+	for name, text := range map[string]string{"mapping.yaml": yamlText, "mapping.json": jsonText} {
+		remap, problems := readTestMapping(t, name, text)
+		if len(problems) > 0 {
+			t.Errorf("%s: %v", name, problems)
+		}
+		if len(csv) != len(remap) {
+			t.Errorf("%s: %d fields, want %d", name, len(remap), len(csv))
+		}
+		for key, want := range csv {
+			got := remap[key]
+			// as regular expressions and rationals they compare by pointer
+			if fmt.Sprint(want) != fmt.Sprint(got) || !reflect.DeepEqual(want.Path, got.Path) ||
+				!reflect.DeepEqual(want.Rules.MustBe, got.Rules.MustBe) {
+				t.Errorf("%s: %s is\n%+v\nwant\n%+v", name, key, got, want)
+			}
+		}
+	}
+}
+
+func TestMappingFileProblems(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		text string
+		// want is line:column message of each problem
+		want []string
+	}{
+		{"mapping.yaml", "version: 2\nfields: []\n", []string{"1:10 unsupported version 2 (want 1)"}},
+		{"mapping.yaml", "fields:\n  - {xml: A, json: a}\n", []string{"1:1 missing version (want version: 1)"}},
+		{"mapping.yaml", "version: 1\n", []string{"1:1 missing fields"}},
+		{"mapping.yaml", "- xml: A\n", []string{"0:0 expected a mapping with version and fields"}},
+		{"mapping.yaml", "version: 1\nfeilds: []\n", []string{"1:1 missing fields", `2:1 unknown key "feilds"`}},
+		{"mapping.yaml", "version: 1\nfields: {xml: A}\n", []string{"1:1 missing fields",
+			"2:9 fields must be a list"}},
+		{"mapping.yaml", `version: 1
+fields:
+  - xml: A
+    json: a
+    type: money
+  - xml: B
+    json: b
+    omitEmpty: sometimes
+  - json: c
+  - xml: D
+  - xml: E
+    json: e
+    xml: F
+  - xml: G
+    json: [g, h]
+  - xml: H
+    json: h
+    onError: shrug
+  - just a name
+`, []string{
+			`5:11 unknown type "money" (want string, number, integer, boolean, date or datetime)`,
+			"8:16 omitEmpty must be true or false",
+			"9:5 missing xml (the XML name)",
+			"10:5 missing json (the JSON name, or - to leave the field out)",
+			"13:5 xml is given twice",
+			"14:5 missing json (the JSON name, or - to leave the field out)",
+			"15:11 json must be a single value",
+			`18:5 unknown conversion failure policy "shrug" (want null, omit, string or reject)`,
+			"19:5 a field must be a mapping of xml, json, type, ...",
+		}},
+		// the checks of every format, at the field they are about
+		{"mapping.yaml", `version: 1
+fields:
+  - {xml: A, json: origin}
+  - xml: B
+    json: origin.city
+  - xml: A
+    json: a
+  - xml: "@nope"
+    json: nope
+`, []string{
+			"4:5 JSON name origin.city (of B) conflicts with origin (of A)",
+			"6:5 duplicate XML name A (first mapped on line 3)",
+			"8:5 unknown document metadata @nope",
+		}},
+		// the line of what the YAML was in the middle of
+		{"mapping.yaml", "version: 1\nfields:\n  - xml: \"A\n", []string{"3:1 found unexpected end of stream"}},
+		{"mapping.json", "{\"version\": 1,\n  \"fields\": [\n    {\"xml\": \"A\" \"json\": \"a\"}\n]}\n",
+			[]string{"3:17 invalid character '\"' after object key:value pair"}},
+		{"mapping.json", "{\"version\": 1, \"fields\": [\n", []string{"1:27 unexpected end of JSON input"}},
+	} {
+		_, problems := readTestMapping(t, tc.name, tc.text)
+		var got []string
+		for _, p := range problems {
+			if p.Warning || !strings.HasSuffix(p.File, tc.name) {
+				t.Errorf("%+v", p)
+			}
+			got = append(got, fmt.Sprintf("%d:%d %s", p.Line, p.Column, p.Message))
+		}
+		if strings.Join(tc.want, "\n") != strings.Join(got, "\n") {
+			t.Errorf("%s\ngot:\n%s\nwant:\n%s", tc.text, strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+		}
+	}
+}
+
+func TestMappingSchema(t *testing.T) {
+	var schema map[string]interface{}
+	if err := json.Unmarshal(mappingSchema, &schema); nil != err {
+		t.Fatalf("the schema is not JSON: %s", err)
+	}
+	if _, ok := schema["properties"].(map[string]interface{})["fields"]; !ok {
+		t.Errorf("the schema has no fields")
+	}
+}
@@ -104,3 +104,33 @@ func ConcatenateErrors(errList ...error) error {
 	}
 	return nil
 }
+
+// WriteFileAtomic writes data to a temporary file alongside fn and
+// renames it into place, so readers never see a partially written file
+// (even if the process dies mid-write).
+func WriteFileAtomic(fn string, data []byte, perm os.FileMode) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(fn), "."+filepath.Base(fn)+".*.tmp")
+	if nil != err {
+		return err
+	}
+	defer func() {
+		if nil != err {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(data); nil != err {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); nil != err {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); nil != err {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), perm); nil != err {
+		return err
+	}
+	return os.Rename(tmp.Name(), fn)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	decimalPoint = "."    // 1,540.10 (the default)
+	decimalComma = ","    // 1.540,10
+	decimalAuto  = "auto" // guessed from each value (see guessDecimalMark)
+)
+
+// currencySymbols are the symbols an amount may carry in place of an
+// ISO code; longer ones first, so US$ is not read as $
+var currencySymbols = []struct {
+	Symbol string
+	Code   string
+}{
+	{"US$", "USD"},
+	{"CA$", "CAD"},
+	{"C$", "CAD"},
+	{"A$", "AUD"},
+	{"NZ$", "NZD"},
+	{"€", "EUR"},
+	{"£", "GBP"},
+	{"¥", "JPY"},
+	{"₹", "INR"},
+	{"$", ""}, // USD unless the field says otherwise (currencyDefault=)
+}
+
+var errNotAnAmount = errors.New("is not a number")
+
+func parseDecimalMark(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case decimalPoint, "point", "dot":
+		return decimalPoint, nil
+	case decimalComma, "comma":
+		return decimalComma, nil
+	case decimalAuto:
+		return decimalAuto, nil
+	}
+	return "", fmt.Errorf("unknown decimal mark %q (want %s, %s or %s)",
+		s, decimalPoint, decimalComma, decimalAuto)
+}
+
+// parseAmount takes a number as people write it -- `$1,540.10`,
+// `1.540,10 EUR`, `(25.00)` -- and returns it as a plain decimal
+// (`1540.10`, `1540.10`, `-25.00`) along with the ISO code of the
+// currency it was written in, if it had one. mark says which of `.`
+// and `,` separates the decimals; the other one, spaces and `'` are
+// taken as thousands separators. A `$` is dollarCode (USD if that is
+// not set). An exponent (`1.5e3`) is kept as it is.
+func parseAmount(s string, mark string, dollarCode string) (amount string, currency string, err error) {
+	s = strings.TrimSpace(s)
+	negative := false
+
+	// peel the sign, brackets and currency off either end, in any order
+	for changed := true; changed && s != ""; {
+		changed = false
+		if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+			// accounting style
+			negative = !negative
+			s, changed = strings.TrimSpace(s[1:len(s)-1]), true
+		} else if s[0] == '-' || s[0] == '+' {
+			negative = negative != (s[0] == '-')
+			s, changed = strings.TrimSpace(s[1:]), true
+		} else if s[len(s)-1] == '-' {
+			negative = !negative
+			s, changed = strings.TrimSpace(s[:len(s)-1]), true
+		}
+		for _, cs := range currencySymbols {
+			if strings.HasPrefix(s, cs.Symbol) {
+				s, changed = strings.TrimSpace(s[len(cs.Symbol):]), true
+			} else if strings.HasSuffix(s, cs.Symbol) {
+				s, changed = strings.TrimSpace(s[:len(s)-len(cs.Symbol)]), true
+			} else {
+				continue
+			}
+			currency = cs.Code
+			if currency == "" {
+				currency = dollarCode
+				if currency == "" {
+					currency = "USD"
+				}
+			}
+			break
+		}
+		if len(s) > 3 && isCurrencyCode(s[:3]) {
+			currency, s, changed = s[:3], strings.TrimSpace(s[3:]), true
+		} else if len(s) > 3 && isCurrencyCode(s[len(s)-3:]) {
+			currency, s, changed = s[len(s)-3:], strings.TrimSpace(s[:len(s)-3]), true
+		}
+	}
+
+	exponent := ""
+	if ix := strings.IndexAny(s, "eE"); ix > 0 {
+		e := s[ix+1:]
+		if strings.HasPrefix(e, "-") || strings.HasPrefix(e, "+") {
+			e = e[1:]
+		}
+		if allDigits(e) {
+			exponent, s = "e"+s[ix+1:], strings.TrimSpace(s[:ix])
+		}
+	}
+
+	if mark == "" {
+		mark = decimalPoint
+	} else if mark == decimalAuto {
+		mark = guessDecimalMark(s)
+	}
+	var sb strings.Builder
+	if negative {
+		sb.WriteRune('-')
+	}
+	// group counts the digits since the last thousands separator, so a
+	// misread decimal mark (1,5 as fifteen) is refused rather than sent
+	seenMark, digits, group := false, 0, -1
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			sb.WriteRune(c)
+			digits++
+			if group >= 0 {
+				group++
+			}
+		case string(c) == mark:
+			if seenMark || (group >= 0 && group != 3) {
+				return "", currency, errNotAnAmount
+			}
+			seenMark, group = true, -1
+			sb.WriteRune('.')
+		case c == '.' || c == ',' || c == '\'' || unicode.IsSpace(c):
+			// thousands separator: only between whole groups of three
+			// digits, and never after the decimals
+			if seenMark || 0 == digits || (group >= 0 && group != 3) {
+				return "", currency, errNotAnAmount
+			}
+			group = 0
+		default:
+			return "", currency, errNotAnAmount
+		}
+	}
+	if group >= 0 && group != 3 {
+		return "", currency, errNotAnAmount
+	}
+	amount = sb.String()
+	if amount == "" || amount == "-" {
+		return "", currency, errNotAnAmount
+	}
+	return amount + exponent, currency, nil
+}
+
+// guessDecimalMark picks the decimal mark of s: the last of `.` and `,`
+// when it has both, and otherwise the one it has unless it appears more
+// than once or is followed by exactly three digits (1,540 and 1.540 are
+// both taken as thousands)
+func guessDecimalMark(s string) string {
+	dot, comma := strings.LastIndex(s, "."), strings.LastIndex(s, ",")
+	switch {
+	case dot >= 0 && comma >= 0:
+		if comma > dot {
+			return decimalComma
+		}
+		return decimalPoint
+	case comma >= 0:
+		if strings.Count(s, ",") == 1 && len(strings.TrimSpace(s[comma+1:])) != 3 {
+			return decimalComma
+		}
+		return decimalPoint
+	case dot >= 0:
+		if strings.Count(s, ".") > 1 || len(strings.TrimSpace(s[dot+1:])) == 3 {
+			return decimalComma
+		}
+	}
+	return decimalPoint
+}
+
+func isCurrencyCode(s string) bool {
+	for _, c := range s {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return len(s) == 3
+}
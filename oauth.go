@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"reflectsvc/misc"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenExpirySkew is how long before its stated expiry a token is
+// treated as expired, so it never lapses in flight. A short-lived
+// token is given at most a quarter of its lifetime (see expirySkew).
+const tokenExpirySkew = 30 * time.Second
+
+// oauthConfig is the OAuth2 client-credentials grant used to get a
+// bearer token for a destination. The client secret comes from a file
+// (read at each token request, so it can be rotated) or from the
+// environment; it is never put in the configuration itself.
+type oauthConfig struct {
+	TokenURL   string   `json:"tokenUrl"`
+	ClientID   string   `json:"clientId"`
+	SecretFile string   `json:"secretFile,omitempty"`
+	SecretEnv  string   `json:"secretEnv,omitempty"`
+	Scopes     []string `json:"scopes,omitempty"`
+	// AuthStyle is "basic" (client_secret_basic, the default) or "post"
+	// (client_secret_post: the credentials go in the form body)
+	AuthStyle string `json:"authStyle,omitempty"`
+	// CAFile is the CA bundle trusted for the token endpoint; without
+	// it, the system roots. The destination's TLS settings (CA bundle,
+	// server name, client certificate) are not used.
+	CAFile string `json:"caFile,omitempty"`
+}
+
+// oauthTokenSource fetches and caches the token for one route
+type oauthTokenSource struct {
+	cfg     oauthConfig
+	rt      *route
+	client  *http.Client
+	mx      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// oauthFromFlags is the --oauth-* configuration, or nil if unused
+func oauthFromFlags() *oauthConfig {
+	if !misc.IsStringSet(&FlagOAuthTokenURL) {
+		return nil
+	}
+	return &oauthConfig{
+		TokenURL:   FlagOAuthTokenURL,
+		ClientID:   FlagOAuthClientID,
+		SecretFile: FlagOAuthSecretFile,
+		SecretEnv:  FlagOAuthSecretEnv,
+		Scopes:     FlagOAuthScopes,
+		AuthStyle:  FlagOAuthAuthStyle,
+		CAFile:     FlagOAuthCA,
+	}
+}
+
+func newOAuthTokenSource(cfg oauthConfig, rt *route) (*oauthTokenSource, error) {
+	if !misc.IsStringSet(&cfg.TokenURL) || !misc.IsStringSet(&cfg.ClientID) {
+		return nil, errors.New("oauth needs both a token url and a client id")
+	}
+	if misc.IsStringSet(&cfg.SecretFile) == misc.IsStringSet(&cfg.SecretEnv) {
+		return nil, errors.New("oauth needs exactly one of a client secret file or environment variable")
+	}
+	switch cfg.AuthStyle {
+	case "":
+		cfg.AuthStyle = "basic"
+	case "basic", "post":
+	default:
+		return nil, fmt.Errorf("unknown oauth auth style %q (want basic or post)", cfg.AuthStyle)
+	}
+	tlsConfig := &tls.Config{}
+	if misc.IsStringSet(&cfg.CAFile) {
+		u, err := url.Parse(cfg.TokenURL)
+		if nil != err {
+			return nil, fmt.Errorf("bad oauth token url %s because %w", cfg.TokenURL, err)
+		}
+		cas, err := newCAReloader(cfg.CAFile)
+		if nil != err {
+			return nil, err
+		}
+		// verified by VerifyConnection, as for the destination (see tlsConfig)
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = cas.verifier(u.Hostname())
+	}
+	ts := &oauthTokenSource{cfg: cfg, rt: rt,
+		client: &http.Client{Transport: newOutboundTransport(tlsConfig), Timeout: FlagDestTimeout}}
+	// fail at start-up, not on the first document, if the secret is missing
+	if _, err := ts.secret(); nil != err {
+		return nil, err
+	}
+	return ts, nil
+}
+
+func (ts *oauthTokenSource) secret() (string, error) {
+	if misc.IsStringSet(&ts.cfg.SecretEnv) {
+		val, ok := os.LookupEnv(ts.cfg.SecretEnv)
+		if !ok {
+			return "", fmt.Errorf("oauth client secret variable %s is not set", ts.cfg.SecretEnv)
+		}
+		return val, nil
+	}
+	data, err := os.ReadFile(ts.cfg.SecretFile)
+	if nil != err {
+		return "", fmt.Errorf("could not read oauth client secret because %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Token returns the cached token, fetching a new one if there is none
+// or it is about to expire.
+func (ts *oauthTokenSource) Token(ctx context.Context) (string, error) {
+	ts.mx.Lock()
+	defer ts.mx.Unlock()
+	if misc.IsStringSet(&ts.token) && (ts.expires.IsZero() || time.Now().Before(ts.expires)) {
+		return ts.token, nil
+	}
+	return ts.fetch(ctx)
+}
+
+// Invalidate drops token (if it is still the cached one), so the next
+// call to Token fetches a fresh one.
+func (ts *oauthTokenSource) Invalidate(token string) {
+	ts.mx.Lock()
+	defer ts.mx.Unlock()
+	if ts.token == token {
+		ts.token = ""
+	}
+}
+
+// fetch performs the client-credentials grant; ts.mx is held
+func (ts *oauthTokenSource) fetch(ctx context.Context) (string, error) {
+	secret, err := ts.secret()
+	if nil != err {
+		return "", err
+	}
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(ts.cfg.Scopes) > 0 {
+		form.Set("scope", strings.Join(ts.cfg.Scopes, " "))
+	}
+	if ts.cfg.AuthStyle == "post" {
+		form.Set("client_id", ts.cfg.ClientID)
+		form.Set("client_secret", secret)
+	}
+	hReq, err := http.NewRequestWithContext(ctx, http.MethodPost, ts.cfg.TokenURL,
+		strings.NewReader(form.Encode()))
+	if nil != err {
+		return "", err
+	}
+	hReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	hReq.Header.Set("Accept", "application/json")
+	if ts.cfg.AuthStyle == "basic" {
+		hReq.SetBasicAuth(url.QueryEscape(ts.cfg.ClientID), url.QueryEscape(secret))
+	}
+
+	rsp, err := ts.client.Do(hReq)
+	if nil != err {
+		return "", fmt.Errorf("oauth token request to %s failed because %w", ts.cfg.TokenURL, err)
+	}
+	defer misc.DeferError(rsp.Body.Close)
+	body, err := io.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+	if nil != err {
+		return "", fmt.Errorf("could not read oauth token response because %w", err)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oauth token endpoint %s returned %s: %s",
+			ts.cfg.TokenURL, rsp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err = json.Unmarshal(body, &tok); nil != err {
+		return "", fmt.Errorf("could not parse oauth token response because %w", err)
+	}
+	if !misc.IsStringSet(&tok.AccessToken) {
+		return "", errors.New("oauth token response has no access_token")
+	}
+	if misc.IsStringSet(&tok.TokenType) && !strings.EqualFold(tok.TokenType, "bearer") {
+		return "", fmt.Errorf("oauth token type is %s, not bearer", tok.TokenType)
+	}
+
+	ts.token = tok.AccessToken
+	ts.expires = time.Time{}
+	if tok.ExpiresIn > 0 {
+		// with no expires_in, the token is kept until the destination refuses it
+		lifetime := time.Duration(tok.ExpiresIn) * time.Second
+		ts.expires = time.Now().Add(lifetime - expirySkew(lifetime))
+	}
+	if FlagDebug || FlagVerbose {
+		xLog.Printf("fetched oauth token for route %s from %s (expires in %ds)",
+			ts.rt.Name, ts.cfg.TokenURL, tok.ExpiresIn)
+	}
+	return ts.token, nil
+}
+
+// expirySkew is tokenExpirySkew, or a quarter of a shorter lifetime, so
+// a token that lives 30 seconds or less is still used for a while
+func expirySkew(lifetime time.Duration) time.Duration {
+	if tokenExpirySkew > lifetime/4 {
+		return lifetime / 4
+	}
+	return tokenExpirySkew
+}
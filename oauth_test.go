@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tokenServer is a stand-in for an OAuth2 token endpoint. It hands out
+// tok-1, tok-2, ... each living expiresIn seconds.
+type tokenServer struct {
+	*httptest.Server
+	mx        sync.Mutex
+	issued    int
+	expiresIn int
+}
+
+func newTokenServer(t *testing.T, expiresIn int, tlsServer bool) *tokenServer {
+	t.Helper()
+	ts := &tokenServer{expiresIn: expiresIn}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if nil != r.ParseForm() || "client_credentials" != r.PostForm.Get("grant_type") ||
+			!ok || "reflectsvc" != id || "s3cret" != secret {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		ts.mx.Lock()
+		ts.issued++
+		token := fmt.Sprintf("tok-%d", ts.issued)
+		ts.mx.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"access_token":%q,"token_type":"Bearer","expires_in":%d}`,
+			token, ts.expiresIn)
+	})
+	ts.Server = httptest.NewUnstartedServer(handler)
+	if tlsServer {
+		// a client refusing the certificate is what some tests are after
+		ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+		ts.StartTLS()
+	} else {
+		ts.Start()
+	}
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func (ts *tokenServer) count() int {
+	ts.mx.Lock()
+	defer ts.mx.Unlock()
+	return ts.issued
+}
+
+// oauthRoute is a route to destination whose tokens come from tokenURL
+func oauthRoute(t *testing.T, name string, destination string, tokenURL string, caFile string) *route {
+	t.Helper()
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("s3cret\n"), 0600); nil != err {
+		t.Fatal(err)
+	}
+	rt := &route{Name: name, Destination: destination,
+		OAuth: &oauthConfig{TokenURL: tokenURL, ClientID: "reflectsvc", SecretFile: secretFile, CAFile: caFile}}
+	if err := rt.prepareTLS(); nil != err {
+		t.Fatal(err)
+	}
+	if err := rt.prepareAuth(); nil != err {
+		t.Fatal(err)
+	}
+	return rt
+}
+
+func TestOAuthTokenCache(t *testing.T) {
+	idp := newTokenServer(t, 3600, false)
+	rt := oauthRoute(t, "oauth-cache", "http://127.0.0.1:1/", idp.URL, "")
+	ctx := context.Background()
+
+	first, err := rt.tokens.Token(ctx)
+	if nil != err {
+		t.Fatal(err)
+	}
+	second, err := rt.tokens.Token(ctx)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "tok-1" != first || first != second || 1 != idp.count() {
+		t.Errorf("got %s then %s after %d fetch(es), want tok-1 twice from one fetch",
+			first, second, idp.count())
+	}
+
+	// expired: the next call fetches a new one
+	rt.tokens.mx.Lock()
+	rt.tokens.expires = time.Now().Add(-time.Second)
+	rt.tokens.mx.Unlock()
+	third, err := rt.tokens.Token(ctx)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if "tok-2" != third || 2 != idp.count() {
+		t.Errorf("got %s after expiry (%d fetches), want tok-2 from a second fetch", third, idp.count())
+	}
+}
+
+func TestOAuthShortLivedToken(t *testing.T) {
+	// a token living no longer than tokenExpirySkew is still cached
+	idp := newTokenServer(t, 20, false)
+	rt := oauthRoute(t, "oauth-short", "http://127.0.0.1:1/", idp.URL, "")
+	for ix := 0; ix < 3; ix++ {
+		if _, err := rt.tokens.Token(context.Background()); nil != err {
+			t.Fatal(err)
+		}
+	}
+	if 1 != idp.count() {
+		t.Errorf("a 20s token was fetched %d times, want once", idp.count())
+	}
+	rt.tokens.mx.Lock()
+	left := time.Until(rt.tokens.expires)
+	rt.tokens.mx.Unlock()
+	if left < 14*time.Second || left > 15*time.Second {
+		t.Errorf("a 20s token is kept for %s, want 15s", left)
+	}
+}
+
+func TestOAuthRefreshOn401(t *testing.T) {
+	idp := newTokenServer(t, 3600, false)
+	var mx sync.Mutex
+	var seen []string
+	dest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		mx.Lock()
+		seen = append(seen, auth)
+		mx.Unlock()
+		// tok-1 has been revoked before its time
+		if "Bearer tok-2" != auth {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer dest.Close()
+	rt := oauthRoute(t, "oauth-refresh", dest.URL, idp.URL, "")
+
+	xj, err := x2jDeliver(rt, http.Header{"Content-Type": {"application/json"}}, []byte(`{"a":1}`))
+	if nil != err {
+		t.Fatal(err)
+	}
+	mx.Lock()
+	defer mx.Unlock()
+	if http.StatusOK != xj.Code || 2 != idp.count() ||
+		"Bearer tok-1,Bearer tok-2" != strings.Join(seen, ",") {
+		t.Errorf("got %d with %d token fetch(es), destination saw %v; "+
+			"want 200 after tok-1 was refused and tok-2 fetched", xj.Code, idp.count(), seen)
+	}
+}
+
+func TestOAuthTokenEndpointTLS(t *testing.T) {
+	// the token endpoint is trusted through its own CA bundle, not the
+	// destination's (whose CA has not signed it)
+	idp := newTokenServer(t, 3600, true)
+	dir := t.TempDir()
+	idpCA := filepath.Join(dir, "idp-ca.pem")
+	err := os.WriteFile(idpCA, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: idp.Certificate().Raw}), 0600)
+	if nil != err {
+		t.Fatal(err)
+	}
+	destCA := filepath.Join(dir, "dest-ca.pem")
+	if err = os.WriteFile(destCA, newTestCA(t, "destination CA").pem, 0600); nil != err {
+		t.Fatal(err)
+	}
+
+	rt := oauthRoute(t, "oauth-tls", "https://127.0.0.1:1/", idp.URL, idpCA)
+	rt.CAFile = destCA
+	if err = rt.prepareTLS(); nil != err {
+		t.Fatal(err)
+	}
+	if token, err := rt.tokens.Token(context.Background()); nil != err || "tok-1" != token {
+		t.Errorf("got %q, %v from a token endpoint signed by --oauth-ca", token, err)
+	}
+
+	// and without it, by the system roots, which do not know httptest's CA
+	untrusted := oauthRoute(t, "oauth-untrusted", "https://127.0.0.1:1/", idp.URL, "")
+	if _, err = untrusted.tokens.Token(context.Background()); nil == err {
+		t.Error("a token endpoint with an unknown CA was trusted")
+	}
+}
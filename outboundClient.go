@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// outbound http clients are long-lived, one per route, so deliveries
+// reuse kept-alive connections (and TLS sessions) rather than paying
+// for a new TCP and TLS handshake on every document.
+var outboundClients = make(map[string]*http.Client)
+var outboundSync sync.Mutex
+
+// outboundProxyURL is --dest-proxy, parsed; nil means use the
+// HTTPS_PROXY / HTTP_PROXY / NO_PROXY environment variables.
+var outboundProxyURL *url.URL
+
+// outboundClient returns the shared client for a route, building it
+// the first time the route is used.
+func outboundClient(rt *route) *http.Client {
+	outboundSync.Lock()
+	defer outboundSync.Unlock()
+	client, ok := outboundClients[rt.Name]
+	if !ok {
+		client = &http.Client{Transport: newOutboundTransport(rt.tlsConfig())}
+		outboundClients[rt.Name] = client
+	}
+	return client
+}
+
+// newOutboundTransport builds a transport with the --dest-* pool,
+// timeout, HTTP/2 and proxy settings.
+func newOutboundTransport(tlsConfig *tls.Config) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   FlagDestDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	tr := &http.Transport{
+		Proxy:                 outboundProxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   FlagDestTLSTimeout,
+		MaxIdleConns:          FlagDestMaxIdle,
+		MaxIdleConnsPerHost:   FlagDestMaxIdlePerHost,
+		MaxConnsPerHost:       FlagDestMaxConnsPerHost,
+		IdleConnTimeout:       FlagDestIdleTimeout,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     FlagDestHTTP2,
+	}
+	if !FlagDestHTTP2 {
+		// a non-nil, empty map is how net/http is told not to use HTTP/2
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return tr
+}
+
+// outboundProxy chooses the proxy (http, https or socks5) for a request
+func outboundProxy(req *http.Request) (*url.URL, error) {
+	if nil != outboundProxyURL {
+		return outboundProxyURL, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflectsvc/misc"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const queueFileSuffix = ".json"
+
+// queuedDelivery is one converted document waiting on disk for
+// delivery. It holds everything needed to send it again after a
+// restart: the destination, the outbound headers and the json body.
+// Headers carrying credentials are stored redacted (see redactHeaders)
+// and filled in again when the item is sent.
+type queuedDelivery struct {
+	ID          string      `json:"id"`
+	Enqueued    time.Time   `json:"enqueued"`
+	Route       string      `json:"route,omitempty"`
+	Destination string      `json:"destination"`
+	Headers     http.Header `json:"headers"`
+	Body        string      `json:"body"`
+	XML         string      `json:"xml,omitempty"`
+	Attempts    int         `json:"attempts"`
+	LastAttempt time.Time   `json:"lastAttempt,omitempty"`
+	LastError   string      `json:"lastError,omitempty"`
+	// History is the most recent attempts, at most maxAttemptHistory
+	History []deliveryAttempt `json:"history,omitempty"`
+	// Ledger is what the idempotency ledger records once the item is
+	// delivered (a record per event); until then the documents are in
+	// flight
+	Ledger []*deliveryRecord `json:"ledger,omitempty"`
+}
+
+// lane is what a delivery waits behind: earlier items for the same
+// route and destination
+func (q queuedDelivery) lane() string {
+	return q.Route + " " + q.Destination
+}
+
+func (q queuedDelivery) String() string {
+	return fmt.Sprintf("%s  enqueued %s  attempts %d  destination %s%s",
+		q.ID, q.Enqueued.UTC().Format(time.RFC3339), q.Attempts, q.Destination,
+		misc.Ternary(misc.IsStringSet(&q.LastError), "\n\tlast error: "+q.LastError, ""))
+}
+
+// outboundQueue is a directory of queuedDelivery files, one per
+// document. File names sort in the order the documents arrived. Each
+// lane (route and destination) is drained oldest first by a worker of
+// its own, so a destination that is down holds up only its own lane.
+type outboundQueue struct {
+	dir     string
+	wake    chan struct{}
+	mx      sync.Mutex
+	seq     int64
+	waiters map[string]chan x2jProxyData
+	// secrets are the credential headers of items queued by this
+	// process, which are not written to disk
+	secrets map[string]http.Header
+	// lanes of the queued items, and the state of each lane
+	itemLanes map[string]string
+	lanes     map[string]*queueLane
+}
+
+type queueLane struct {
+	busy    bool
+	retryAt time.Time
+}
+
+// xQueue is nil unless --queue-dir is set
+var xQueue *outboundQueue
+
+func openQueue(dir string) (*outboundQueue, error) {
+	err := os.MkdirAll(dir, 0755)
+	if nil != err {
+		return nil, err
+	}
+	return &outboundQueue{
+		dir:       dir,
+		wake:      make(chan struct{}, 1),
+		waiters:   make(map[string]chan x2jProxyData),
+		secrets:   make(map[string]http.Header),
+		itemLanes: make(map[string]string),
+		lanes:     make(map[string]*queueLane),
+	}, nil
+}
+
+func (q *outboundQueue) fileName(id string) string {
+	return filepath.Join(q.dir, id+queueFileSuffix)
+}
+
+// Enqueue writes item to disk before anything is sent. With wait set,
+// the returned channel receives the result of the first delivery
+// attempt made for this item.
+func (q *outboundQueue) Enqueue(item queuedDelivery, wait bool) (string, <-chan x2jProxyData, error) {
+	var result chan x2jProxyData
+
+	q.mx.Lock()
+	item.ID = fmt.Sprintf("%020d-%06d", time.Now().UnixNano(), q.seq%1000000)
+	q.seq++
+	if wait {
+		result = make(chan x2jProxyData, 1)
+		q.waiters[item.ID] = result
+	}
+	secrets := make(http.Header)
+	for key, values := range item.Headers {
+		if isSecretHeader(key) {
+			secrets[key] = values
+		}
+	}
+	q.secrets[item.ID] = secrets
+	q.itemLanes[item.ID] = item.lane()
+	q.mx.Unlock()
+
+	item.Enqueued = time.Now().UTC()
+	item.Headers = redactHeaders(item.Headers)
+	err := q.write(item)
+	if nil != err {
+		q.notify(item.ID, x2jProxyData{})
+		q.forgetItem(item.ID)
+		return "", nil, err
+	}
+	if FlagDebug {
+		xLog.Printf("queued delivery %s for %s", item.ID, item.Destination)
+	}
+	q.poke()
+	return item.ID, result, nil
+}
+
+// poke wakes the queue's dispatcher
+func (q *outboundQueue) poke() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// forgetItem drops what is kept in memory about an item that has left
+// the queue
+func (q *outboundQueue) forgetItem(id string) {
+	q.mx.Lock()
+	delete(q.secrets, id)
+	delete(q.itemLanes, id)
+	q.mx.Unlock()
+}
+
+func (q *outboundQueue) write(item queuedDelivery) error {
+	data, err := json.MarshalIndent(item, "", "  ")
+	if nil != err {
+		return err
+	}
+	return misc.WriteFileAtomic(q.fileName(item.ID), data, 0600)
+}
+
+// notify hands a delivery result to whoever is waiting on it (if anyone)
+func (q *outboundQueue) notify(id string, result x2jProxyData) {
+	q.mx.Lock()
+	ch, ok := q.waiters[id]
+	delete(q.waiters, id)
+	q.mx.Unlock()
+	if ok {
+		ch <- result
+	}
+}
+
+// Forget stops waiting on id; the item stays queued.
+func (q *outboundQueue) Forget(id string) {
+	q.mx.Lock()
+	delete(q.waiters, id)
+	q.mx.Unlock()
+}
+
+// IDs returns the queued item ids, oldest first
+func (q *outboundQueue) IDs() ([]string, error) {
+	entries, err := os.ReadDir(q.dir)
+	if nil != err {
+		return nil, err
+	}
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, queueFileSuffix) {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(name, queueFileSuffix))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (q *outboundQueue) Get(id string) (item queuedDelivery, err error) {
+	data, err := os.ReadFile(q.fileName(id))
+	if nil != err {
+		return item, err
+	}
+	err = json.Unmarshal(data, &item)
+	return item, err
+}
+
+func (q *outboundQueue) Remove(id string) error {
+	err := os.Remove(q.fileName(id))
+	if nil != err && errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// run drains the queue for as long as the program lives. The oldest
+// item of each lane is handed to a worker of its own; an item that
+// cannot be delivered stays at the head of its lane, which is tried
+// again after --retry-max-delay while the other lanes carry on. An
+// item is given up (see giveUp) after --queue-max-attempts deliveries
+// or once it is older than --queue-max-age.
+func (q *outboundQueue) run() {
+	idle := time.NewTicker(time.Second)
+	defer idle.Stop()
+	for {
+		ids, err := q.IDs()
+		if nil != err {
+			xLog.Printf("could not read queue directory %s because %s", q.dir, err.Error())
+		} else {
+			q.dispatch(ids)
+		}
+		select {
+		case <-q.wake:
+		case <-idle.C:
+		}
+	}
+}
+
+// dispatch starts a worker on the oldest item of every lane that is
+// neither busy nor waiting to retry, and forgets the lanes with nothing
+// queued
+func (q *outboundQueue) dispatch(ids []string) {
+	now := time.Now()
+	headed := make(map[string]bool)
+	for _, id := range ids {
+		lane := q.laneOf(id)
+		if headed[lane] {
+			continue
+		}
+		headed[lane] = true
+
+		q.mx.Lock()
+		l, ok := q.lanes[lane]
+		if !ok {
+			l = &queueLane{}
+			q.lanes[lane] = l
+		}
+		ready := !l.busy && !now.Before(l.retryAt)
+		if ready {
+			l.busy = true
+		}
+		q.mx.Unlock()
+		if !ready {
+			continue
+		}
+
+		go func(id string, l *queueLane) {
+			delivered := q.deliver(id)
+			q.mx.Lock()
+			l.busy = false
+			if delivered {
+				l.retryAt = time.Time{}
+			} else {
+				l.retryAt = time.Now().Add(FlagRetryMaxDelay)
+			}
+			q.mx.Unlock()
+			q.poke()
+		}(id, l)
+	}
+
+	q.mx.Lock()
+	for lane, l := range q.lanes {
+		if !headed[lane] && !l.busy {
+			delete(q.lanes, lane)
+		}
+	}
+	q.mx.Unlock()
+}
+
+// laneOf finds the lane of a queued item, reading it if it was queued
+// before this process started. An unreadable item is a lane of its own.
+func (q *outboundQueue) laneOf(id string) string {
+	q.mx.Lock()
+	lane, ok := q.itemLanes[id]
+	q.mx.Unlock()
+	if ok {
+		return lane
+	}
+	lane = id
+	if item, err := q.Get(id); nil == err {
+		lane = item.lane()
+	}
+	q.mx.Lock()
+	q.itemLanes[id] = lane
+	q.mx.Unlock()
+	return lane
+}
+
+// deliver sends one queued item; it reports false if the item is still queued
+func (q *outboundQueue) deliver(id string) bool {
+	item, err := q.Get(id)
+	if nil != err {
+		if errors.Is(err, os.ErrNotExist) {
+			// purged out from under us
+			q.forgetItem(id)
+			return true
+		}
+		xLog.Printf("huh? could not read queued delivery %s because %s -- moving it aside as %s.bad",
+			id, err.Error(), q.fileName(id))
+		if err = os.Rename(q.fileName(id), q.fileName(id)+".bad"); nil != err {
+			xLog.Printf("could not move %s aside because %s", q.fileName(id), err.Error())
+			return false
+		}
+		q.forgetItem(id)
+		return true
+	}
+
+	rt, ok := lookupRoute(item.Route)
+	if !ok {
+		xLog.Printf("queued delivery %s names route %s, which is no longer configured -- "+
+			"sending it to %s with the default TLS settings", id, item.Route, item.Destination)
+		rt = defaultRoute()
+	}
+	// deliver to where the document was routed when it was queued
+	sendTo := *rt
+	sendTo.Destination = item.Destination
+
+	rsp, err := x2jDeliver(&sendTo, q.sendHeaders(id, &sendTo, item.Headers), []byte(item.Body))
+	item.Attempts++
+	item.LastAttempt = time.Now().UTC()
+	item.History = append(item.History, rsp.History...)
+	if len(item.History) > maxAttemptHistory {
+		item.History = item.History[len(item.History)-maxAttemptHistory:]
+	}
+	if nil != err {
+		item.LastError = err.Error()
+		xLog.Printf("queued delivery %s to %s failed (attempt %d) because %s",
+			id, item.Destination, item.Attempts, err.Error())
+		return q.retryLater(item, &sendTo, rsp)
+	}
+
+	if FlagDebug || FlagVerbose {
+		xLog.Printf("queued delivery %s to %s returned %s after %d attempt(s)",
+			id, item.Destination, rsp.Status, item.Attempts)
+	}
+	if (rsp.Code < 200 || rsp.Code >= 300) && nil != xDeadLetters {
+		// refused, not failed: sending it again would not help
+		rsp.History = item.History
+		rsp.Sent = item.Headers
+		rsp.DeadLetter, err = xDeadLetters.Add(makeDeadLetter(&sendTo, []byte(item.XML), item.Body, rsp))
+		if nil != err {
+			// kept, and counted towards the limits, until it can be
+			item.LastError = fmt.Sprintf("refused with %s, and could not be dead-lettered because %s",
+				rsp.Status, err.Error())
+			xLog.Printf("huh? queued delivery %s was %s", id, item.LastError)
+			return q.retryLater(item, &sendTo, rsp)
+		}
+	}
+	if err = q.Remove(id); nil != err {
+		xLog.Printf("huh? delivered %s but could not remove it from the queue because %s",
+			id, err.Error())
+	}
+	q.settle(item, rsp.Code >= 200 && rsp.Code < 300)
+	q.notify(id, rsp)
+	return true
+}
+
+// retryLater keeps an item that was not delivered in the queue, with
+// its attempt recorded, or gives it up once it is past the limits
+func (q *outboundQueue) retryLater(item queuedDelivery, rt *route, rsp x2jProxyData) bool {
+	if (FlagQueueMaxAttempts > 0 && item.Attempts >= FlagQueueMaxAttempts) ||
+		(FlagQueueMaxAge > 0 && time.Since(item.Enqueued) > FlagQueueMaxAge) {
+		return q.giveUp(item, rt, rsp)
+	}
+	if _, err := os.Stat(q.fileName(item.ID)); nil == err {
+		if err = q.write(item); nil != err {
+			xLog.Printf("could not update queued delivery %s because %s", item.ID, err.Error())
+		}
+	}
+	// tell a waiting caller the item is still queued
+	rsp.QueueID = item.ID
+	q.notify(item.ID, rsp)
+	return false
+}
+
+// settle tells the idempotency ledger how an item left the queue, and
+// forgets it
+func (q *outboundQueue) settle(item queuedDelivery, delivered bool) {
+	if nil != xLedger {
+		for _, rec := range item.Ledger {
+			xLedger.settle(rec, delivered)
+		}
+	}
+	q.forgetItem(item.ID)
+}
+
+// giveUp takes an item that has failed too often, or for too long, out
+// of the queue: into the dead letters if there are any, or else (or if
+// it cannot be dead-lettered) aside as <id>.json.failed, where `queue
+// list` no longer sees it.
+func (q *outboundQueue) giveUp(item queuedDelivery, rt *route, rsp x2jProxyData) bool {
+	id := item.ID
+	xLog.Printf("giving up queued delivery %s to %s after %d attempt(s) over %s",
+		id, item.Destination, item.Attempts, time.Since(item.Enqueued).Round(time.Second))
+	var err error
+	if nil != xDeadLetters {
+		rsp.History = item.History
+		rsp.Sent = item.Headers
+		if rsp.DeadLetter, err = xDeadLetters.Add(makeDeadLetter(rt, []byte(item.XML), item.Body, rsp)); nil == err {
+			err = q.Remove(id)
+		} else {
+			xLog.Printf("huh? could not dead-letter queued delivery %s because %s -- moving it aside as %s.failed",
+				id, err.Error(), q.fileName(id))
+		}
+	}
+	if !misc.IsStringSet(&rsp.DeadLetter) {
+		if err = q.write(item); nil == err {
+			err = os.Rename(q.fileName(id), q.fileName(id)+".failed")
+		}
+	}
+	if nil != err {
+		xLog.Printf("huh? could not give up queued delivery %s because %s", id, err.Error())
+		rsp.QueueID = id
+		q.notify(id, rsp)
+		return false
+	}
+	q.settle(item, false)
+	q.notify(id, rsp)
+	return true
+}
+
+// sendHeaders are the headers to send a queued item with: those
+// resendHeaders rebuilds for the route, and the credentials it was
+// queued with, while this process still has them. A forwarded
+// credential (such as the caller's Authorization) does not survive
+// a restart.
+func (q *outboundQueue) sendHeaders(id string, rt *route, stored http.Header) http.Header {
+	header := resendHeaders(rt, stored)
+	q.mx.Lock()
+	secrets, ok := q.secrets[id]
+	q.mx.Unlock()
+	for key, values := range secrets {
+		if _, set := header[key]; !set {
+			header[key] = values
+		}
+	}
+	if !ok {
+		for key, values := range stored {
+			if _, set := header[key]; !set && len(values) > 0 && values[0] == REDACTED {
+				xLog.Printf("queued delivery %s was queued before a restart -- sending it without "+
+					"its %s header", id, key)
+			}
+		}
+	}
+	return header
+}
+
+// queueCommand implements `reflectsvc queue list|show|purge`
+func queueCommand(args []string) int {
+	if !misc.IsStringSet(&FlagQueueDir) {
+		_, _ = fmt.Fprintln(os.Stderr, "the queue commands need --queue-dir")
+		return 2
+	}
+	q, err := openQueue(FlagQueueDir)
+	if nil != err {
+		_, _ = fmt.Fprintf(os.Stderr, "could not open queue %s because %s\n", FlagQueueDir, err.Error())
+		return 1
+	}
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	ids, err := q.IDs()
+	if nil != err {
+		_, _ = fmt.Fprintf(os.Stderr, "could not read queue %s because %s\n", FlagQueueDir, err.Error())
+		return 1
+	}
+
+	switch args[0] {
+	case "list":
+		for _, id := range ids {
+			item, err := q.Get(id)
+			if nil != err {
+				_, _ = fmt.Fprintf(os.Stdout, "%s  (unreadable: %s)\n", id, err.Error())
+				continue
+			}
+			_, _ = fmt.Fprintln(os.Stdout, item.String())
+		}
+		_, _ = fmt.Fprintf(os.Stdout, "%d item(s) queued in %s\n", len(ids), FlagQueueDir)
+	case "show":
+		if len(args) < 2 {
+			_, _ = fmt.Fprintln(os.Stderr, "usage: reflectsvc queue show <id>...")
+			return 2
+		}
+		for _, id := range args[1:] {
+			data, err := os.ReadFile(q.fileName(id))
+			if nil != err {
+				_, _ = fmt.Fprintf(os.Stderr, "could not read %s because %s\n", id, err.Error())
+				return 1
+			}
+			_, _ = os.Stdout.Write(data)
+			_, _ = fmt.Fprintln(os.Stdout)
+		}
+	case "purge":
+		// with no ids, purge everything
+		if len(args) > 1 {
+			ids = args[1:]
+		}
+		purged, failed := 0, 0
+		for _, id := range ids {
+			err = os.ErrNotExist
+			if !strings.ContainsAny(id, `/\`) {
+				err = os.Remove(q.fileName(id))
+			}
+			if nil != err {
+				failed++
+				if errors.Is(err, os.ErrNotExist) {
+					_, _ = fmt.Fprintf(os.Stderr, "%s is not queued\n", id)
+				} else {
+					_, _ = fmt.Fprintf(os.Stderr, "could not purge %s because %s\n", id, err.Error())
+				}
+				continue
+			}
+			purged++
+		}
+		_, _ = fmt.Fprintf(os.Stdout, "purged %d item(s) from %s\n", purged, FlagQueueDir)
+		if failed > 0 {
+			return 1
+		}
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "unknown queue command %q (want list, show or purge)\n", args[0])
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueRefusedWithoutDeadLetter(t *testing.T) {
+	refuse := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer refuse.Close()
+	savedRoute, savedDead, savedAttempts := xDefaultRoute, xDeadLetters, FlagQueueMaxAttempts
+	defer func() { xDefaultRoute, xDeadLetters, FlagQueueMaxAttempts = savedRoute, savedDead, savedAttempts }()
+	xDefaultRoute = testRoute(t, "default", refuse.URL)
+	FlagQueueMaxAttempts = 2
+
+	// dead letters that cannot be written
+	deadDir := filepath.Join(t.TempDir(), "dead")
+	var err error
+	if xDeadLetters, err = openDeadLetters(deadDir); nil != err {
+		t.Fatal(err)
+	}
+	if err = os.Remove(deadDir); nil != err {
+		t.Fatal(err)
+	}
+	q, err := openQueue(t.TempDir())
+	if nil != err {
+		t.Fatal(err)
+	}
+	id, _, err := q.Enqueue(queuedDelivery{Enqueued: time.Now(), Route: "default",
+		Destination: refuse.URL, Headers: make(http.Header), Body: `{}`}, false)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	// kept, with the attempt counted
+	if q.deliver(id) {
+		t.Fatal("a refused item that was not dead-lettered left the queue")
+	}
+	item, err := q.Get(id)
+	if nil != err || 1 != item.Attempts || !strings.Contains(item.LastError, "400") {
+		t.Fatalf("after one attempt: %+v %v", item, err)
+	}
+
+	// and given up at --queue-max-attempts
+	if !q.deliver(id) {
+		t.Fatal("the item was not given up")
+	}
+	if _, err = os.Stat(q.fileName(id) + ".failed"); nil != err {
+		t.Errorf("the item was not moved aside: %s", err)
+	}
+	if ids, _ := q.IDs(); len(ids) != 0 {
+		t.Errorf("still queued: %q", ids)
+	}
+}
+
+func TestQueueLanesPruned(t *testing.T) {
+	dest := newDestination(t)
+	saved := xDefaultRoute
+	defer func() { xDefaultRoute = saved }()
+	xDefaultRoute = testRoute(t, "default", dest.URL)
+	q, err := openQueue(t.TempDir())
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, to := range []string{dest.URL, dest.URL + "/other"} {
+		if _, _, err = q.Enqueue(queuedDelivery{Enqueued: time.Now(), Route: "default",
+			Destination: to, Headers: make(http.Header), Body: `{}`}, false); nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	lanes := func() int {
+		q.mx.Lock()
+		defer q.mx.Unlock()
+		return len(q.lanes)
+	}
+	ids, _ := q.IDs()
+	q.dispatch(ids)
+	if 2 != lanes() {
+		t.Fatalf("%d lane(s) for two destinations", lanes())
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if ids, _ = q.IDs(); len(ids) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not delivered: %q", ids)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// once the workers are done, nothing is left of the lanes
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		q.dispatch(nil)
+		if 0 == lanes() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d idle lane(s) kept", lanes())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
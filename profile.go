@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"reflectsvc/misc"
+	"sort"
+	"strings"
+)
+
+// xmlProfile says how to read XML of some shape into the documents the
+// rest of the service works with: where each document is, where its
+// fields are, and where its id and other metadata are (so routing,
+// idempotency and the `@` names of the mapping file work as they do
+// for Xtracta). Besides the fields listed by the profile, a document
+// has the value of each selector in the mapping file; see isSelector.
+// All selectors but Documents are read from the document.
+type xmlProfile struct {
+	Name string `json:"name"`
+	// Documents selects each document of the XML; without it the XML
+	// is one document
+	Documents string `json:"documents,omitempty"`
+	// Fields, if set, selects fields that carry their own names, the
+	// way Xtracta sends them
+	Fields *profileFields `json:"fields,omitempty"`
+	// Metadata selects the value of the `@` names (see xtractaMetadata)
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	documents *xpath
+	metadata  map[string]*xpath
+}
+
+// profileFields are name/value pairs: Select picks out each field, and
+// Name, Value and Confidence are read from there
+type profileFields struct {
+	Select     string `json:"select"`
+	Name       string `json:"name"`
+	Value      string `json:"value"`
+	Confidence string `json:"confidence,omitempty"`
+
+	selectors [4]*xpath
+}
+
+// xtractaProfile is an Xtracta callback as a profile. Callbacks are
+// read straight into XtractaEvents by encoding/xml, which comes to the
+// same thing, faster; the profile is the model for other vendors.
+var xtractaProfile = xmlProfile{
+	Name:      "xtracta",
+	Documents: "/events/event",
+	Fields: &profileFields{
+		Select:     "document/field_data/field",
+		Name:       "field_name",
+		Value:      "field_value",
+		Confidence: "field_extraction_confidence",
+	},
+	Metadata: map[string]string{
+		"@sequence":              "@sequence",
+		"@generated":             "generated",
+		"@revision":              "document/@revision",
+		"@workflow_id":           "document/workflow_id",
+		"@document_id":           "document/document_id",
+		"@document_status":       "document/document_status",
+		"@number_of_pages":       "document/number_of_pages",
+		"@api_download_status":   "document/api_download_status",
+		"@free_form":             "document/free_form",
+		"@classification":        "document/classification",
+		"@classification_class":  "document/classification_class",
+		"@classification_design": "document/classification_design",
+		"@document_url":          "document/document_url",
+		"@image_url[]":           "document/image_url",
+	},
+}
+
+// xProfile is --xml-profile; nil is xtractaProfile
+var xProfile *xmlProfile
+
+// profileMetadata fills in the XtractaEvents behind each `@` name a
+// profile can select
+var profileMetadata = map[string]func(x *XtractaEvents, values []string){
+	"@workflow_id":           func(x *XtractaEvents, v []string) { x.Event.Document.WorkflowID = firstOf(v) },
+	"@document_id":           func(x *XtractaEvents, v []string) { x.Event.Document.DocumentID = firstOf(v) },
+	"@revision":              func(x *XtractaEvents, v []string) { x.Event.Document.Revision = firstOf(v) },
+	"@document_status":       func(x *XtractaEvents, v []string) { x.Event.Document.DocumentStatus = firstOf(v) },
+	"@number_of_pages":       func(x *XtractaEvents, v []string) { x.Event.Document.NumberOfPages = firstOf(v) },
+	"@api_download_status":   func(x *XtractaEvents, v []string) { x.Event.Document.ApiDownloadStatus = firstOf(v) },
+	"@free_form":             func(x *XtractaEvents, v []string) { x.Event.Document.FreeForm = firstOf(v) },
+	"@classification":        func(x *XtractaEvents, v []string) { x.Event.Document.Classification = firstOf(v) },
+	"@classification_class":  func(x *XtractaEvents, v []string) { x.Event.Document.ClassificationClass = firstOf(v) },
+	"@classification_design": func(x *XtractaEvents, v []string) { x.Event.Document.ClassificationDesign = firstOf(v) },
+	"@document_url":          func(x *XtractaEvents, v []string) { x.Event.Document.DocumentURL = firstOf(v) },
+	"@image_url[]":           func(x *XtractaEvents, v []string) { x.Event.Document.ImageURL = v },
+	"@sequence":              func(x *XtractaEvents, v []string) { x.Event.Sequence = firstOf(v) },
+	"@generated":             func(x *XtractaEvents, v []string) { x.Event.Generated = firstOf(v) },
+}
+
+// isSelector is true for an XMLName of the mapping file that is an XML
+// selector (/invoice/number, //line/amount, ./number) rather than the
+// name of a field. A selector ending in [] is sent as a JSON array of
+// everything it selects; otherwise the first is sent.
+func isSelector(name string) bool {
+	return strings.HasPrefix(name, "/") || strings.HasPrefix(name, ".")
+}
+
+// compileSelector compiles an XMLName that isSelector
+func compileSelector(name string) (*xpath, error) {
+	return compileXPath(strings.TrimSuffix(name, "[]"))
+}
+
+func loadXmlProfile(fn string) (*xmlProfile, error) {
+	if "xtracta" == strings.ToLower(fn) {
+		return nil, nil
+	}
+	data, err := os.ReadFile(fn)
+	if nil != err {
+		return nil, err
+	}
+	var p xmlProfile
+	if err = json.Unmarshal(data, &p); nil != err {
+		return nil, fmt.Errorf("could not parse XML profile %s because %w", fn, err)
+	}
+	if !misc.IsStringSet(&p.Name) {
+		p.Name = fn
+	}
+	if err = p.compile(); nil != err {
+		return nil, fmt.Errorf("XML profile %s: %w", fn, err)
+	}
+	return &p, nil
+}
+
+func (p *xmlProfile) compile() (err error) {
+	if misc.IsStringSet(&p.Documents) {
+		if p.documents, err = compileXPath(p.Documents); nil != err {
+			return fmt.Errorf("documents: %w", err)
+		}
+	}
+	if nil != p.Fields {
+		f := p.Fields
+		for ix, expr := range [4]string{f.Select, f.Name, f.Value, f.Confidence} {
+			if 3 == ix && !misc.IsStringSet(&expr) {
+				continue
+			}
+			if f.selectors[ix], err = compileXPath(expr); nil != err {
+				return fmt.Errorf("fields: %w", err)
+			}
+		}
+	}
+	p.metadata = make(map[string]*xpath, len(p.Metadata))
+	for name, expr := range p.Metadata {
+		if _, ok := profileMetadata[name]; !ok {
+			return fmt.Errorf("metadata: unknown name %s", name)
+		}
+		if p.metadata[name], err = compileXPath(expr); nil != err {
+			return fmt.Errorf("metadata %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// readDocuments reads an /xml2json or /convert payload: an Xtracta
+// callback, or XML in the shape of --xml-profile
+func readDocuments(data []byte) (x XtractaEvents, err error) {
+	if nil == xProfile {
+		err = xml.Unmarshal(data, &x)
+		return x, err
+	}
+	return xProfile.Read(data)
+}
+
+// Read makes the XML into XtractaEvents: an event for each document,
+// with its metadata and fields. Each document is read, and kept as its
+// Raw XML, by itself: the XML less the other documents, so that
+// //line/amount only finds the lines of its own document.
+func (p *xmlProfile) Read(data []byte) (x XtractaEvents, err error) {
+	tree, err := parseXmlTree(data)
+	if nil != err {
+		return x, err
+	}
+	x.XMLName = xml.Name{Local: tree.elements()[0].Name.Local}
+	x.profile = p
+
+	docs := []*xmlNode{tree.elements()[0]}
+	if nil != p.documents {
+		if docs = p.documents.Select(tree); len(docs) == 0 {
+			return x, fmt.Errorf("found no documents (%s) in the XML", p.Documents)
+		}
+	}
+	drop := make(map[*xmlNode]bool, len(docs))
+	for _, doc := range docs {
+		drop[doc] = true
+	}
+	for _, doc := range docs {
+		if xmlElementNode != doc.Kind {
+			return x, fmt.Errorf("documents (%s) selects something other than elements", p.Documents)
+		}
+		for in := doc.Parent; nil != in; in = in.Parent {
+			if drop[in] {
+				return x, fmt.Errorf("documents (%s) overlap: a <%s> is inside another <%s>",
+					p.Documents, qualifiedName(doc.Name), qualifiedName(in.Name))
+			}
+		}
+	}
+	selectors := mappingSelectors()
+	for ix, doc := range docs {
+		one := doc
+		if len(docs) > 1 {
+			// cut the others out, and find this one in the copy
+			delete(drop, doc)
+			copies := make(map[*xmlNode]*xmlNode)
+			tree.without(drop, nil, copies)
+			drop[doc] = true
+			one = copies[doc]
+		}
+		event := p.readDocument(one, selectors)
+		if 0 == ix {
+			x.Event = event
+		} else {
+			x.More = append(x.More, event)
+		}
+		x.raws = append(x.raws, one.root().Marshal())
+	}
+	if len(docs) == 1 {
+		x.raws = nil
+	}
+	return x, nil
+}
+
+func (p *xmlProfile) readDocument(doc *xmlNode, selectors map[string]*xpath) XtractaEvent {
+	var x XtractaEvents
+	names := make([]string, 0, len(p.metadata))
+	for name := range p.metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		profileMetadata[name](&x, p.metadata[name].Strings(doc))
+	}
+
+	fields := &x.Event.Document.FieldData.Field
+	if nil != p.Fields {
+		s := p.Fields.selectors
+		for _, f := range s[0].Select(doc) {
+			fld := XtractaField{FieldName: firstOf(s[1].Strings(f)), FieldValue: firstOf(s[2].Strings(f))}
+			if nil != s[3] {
+				fld.FieldExtractionConfidence = firstOf(s[3].Strings(f))
+			}
+			*fields = append(*fields, fld)
+		}
+	}
+	names = names[:0]
+	for name := range selectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := selectors[name].Strings(doc)
+		if len(values) == 0 {
+			continue
+		}
+		fld := XtractaField{FieldName: name, FieldValue: values[0]}
+		if strings.HasSuffix(name, "[]") {
+			fld.Values = values
+		} else if len(values) > 1 && FlagDebug {
+			xLog.Printf("selector %s found %d values -- sending the first", name, len(values))
+		}
+		*fields = append(*fields, fld)
+	}
+	return x.Event
+}
+
+// mappingSelectors are the selectors of --fieldNames and of the field
+// mappings of the routes
+func mappingSelectors() map[string]*xpath {
+	selectors := make(map[string]*xpath)
+	add := func(remap map[string]remapField) {
+		for name, rm := range remap {
+			if nil != rm.Select {
+				selectors[name] = rm.Select
+			}
+		}
+	}
+	add(FlagRemapMap)
+	if nil != xRoutes {
+		for _, rt := range xRoutes.Routes {
+			add(rt.remap)
+		}
+	}
+	return selectors
+}
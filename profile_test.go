@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testProfile compiles a profile reading documents, with their ids from
+// @id, and sets the mapping to the selectors given
+func testProfile(t *testing.T, documents string, selectors ...string) *xmlProfile {
+	t.Helper()
+	p := &xmlProfile{Name: "test", Documents: documents,
+		Metadata: map[string]string{"@document_id": "@id"}}
+	if err := p.compile(); nil != err {
+		t.Fatal(err)
+	}
+	saved := FlagRemapMap
+	t.Cleanup(func() { FlagRemapMap = saved })
+	FlagRemapMap = make(map[string]remapField)
+	for _, name := range selectors {
+		rm := newRemapField()
+		rm.XMLName = name
+		var err error
+		if rm.Select, err = compileSelector(name); nil != err {
+			t.Fatal(err)
+		}
+		FlagRemapMap[name] = rm
+	}
+	return p
+}
+
+// fieldValues is each field of the event as name=value
+func fieldValues(e XtractaEvent) string {
+	var parts []string
+	for _, f := range e.Document.FieldData.Field {
+		value := f.FieldValue
+		if nil != f.Values {
+			value = strings.Join(f.Values, ",")
+		}
+		parts = append(parts, f.FieldName+"="+value)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestProfileRead(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		documents string
+		selectors []string
+		xml       string
+		// want is each event as id:fields
+		want []string
+	}{
+		{"one document per invoice, each reading only its own lines",
+			"/invoices/invoice", []string{"//line/amount[]", "/invoices/@batch", "./header/number"},
+			testInvoicesXML,
+			[]string{"1:./header/number=100 //line/amount[]=10.50,99 /invoices/@batch=7",
+				"2:./header/number=200 //line/amount[]=7 /invoices/@batch=7"}},
+		{"the whole XML as one document", "", []string{"//number[]", "//number"},
+			testInvoicesXML,
+			[]string{"://number=100 //number[]=100,200"}},
+		{"positional predicates pick the same documents in each copy",
+			"/root/group/doc[last()]", []string{"./@id"},
+			`<root><group><doc id="a"/><doc id="b"/></group><group><doc id="c"/><doc id="d"/></group></root>`,
+			[]string{"b:./@id=b", "d:./@id=d"}},
+		{"documents at different depths", "//doc", nil,
+			`<root><doc id="a"/><wrap><doc id="b"/></wrap></root>`,
+			[]string{"a:", "b:"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := testProfile(t, tc.documents, tc.selectors...)
+			x, err := p.Read([]byte(tc.xml))
+			if nil != err {
+				t.Fatal(err)
+			}
+			if x.profile != p {
+				t.Error("the events do not say which profile read them")
+			}
+			var got []string
+			split := x.Split()
+			for _, one := range split {
+				got = append(got, one.Event.Document.DocumentID+":"+fieldValues(one.Event))
+			}
+			// the XML of each document has none of the others
+			for _, one := range split {
+				for _, other := range split {
+					id := `id="` + other.Event.Document.DocumentID + `"`
+					if len(split) > 1 && (one.Event.Document.DocumentID == other.Event.Document.DocumentID) !=
+						strings.Contains(string(one.Raw), id) {
+						t.Errorf("the XML of document %s: %s", one.Event.Document.DocumentID, one.Raw)
+					}
+				}
+			}
+			if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+				t.Errorf("got  %q\nwant %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestProfileReadErrors(t *testing.T) {
+	for _, tc := range []struct {
+		documents string
+		xml       string
+		want      string
+	}{
+		// one document inside another used to panic
+		{"//item", `<root><item id="a"><item id="b"/></item></root>`, "overlap"},
+		{"/root/missing", `<root/>`, "found no documents"},
+		{"//item/@id", `<root><item id="a"/><item id="b"/></root>`, "other than elements"},
+		{"/root", `<root>`, "not closed"},
+	} {
+		p := testProfile(t, tc.documents)
+		if _, err := p.Read([]byte(tc.xml)); nil == err || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s over %s: got %v, want an error about %q", tc.documents, tc.xml, err, tc.want)
+		}
+	}
+}
+
+func TestXtractaProfile(t *testing.T) {
+	// the built-in profile reads a callback the way encoding/xml does
+	data, err := os.ReadFile("body.xml")
+	if nil != err {
+		t.Fatal(err)
+	}
+	var want XtractaEvents
+	if err = xml.Unmarshal(data, &want); nil != err {
+		t.Fatal(err)
+	}
+	p := xtractaProfile
+	if err = p.compile(); nil != err {
+		t.Fatal(err)
+	}
+	saved := FlagRemapMap
+	defer func() { FlagRemapMap = saved }()
+	FlagRemapMap = nil
+	got, err := p.Read(data)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	g, w := got.Event.Document, want.Event.Document
+	if g.DocumentID != w.DocumentID || g.Revision != w.Revision || g.WorkflowID != w.WorkflowID ||
+		g.DocumentURL != w.DocumentURL || len(g.ImageURL) != len(w.ImageURL) ||
+		got.Event.Sequence != want.Event.Sequence || got.Event.Generated != want.Event.Generated {
+		t.Errorf("metadata: got %+v, want %+v", got.Event, want.Event)
+	}
+	if fieldValues(got.Event) != fieldValues(want.Event) {
+		t.Errorf("fields:\ngot  %s\nwant %s", fieldValues(got.Event), fieldValues(want.Event))
+	}
+}
+
+func TestLoadXmlProfile(t *testing.T) {
+	if p, err := loadXmlProfile("Xtracta"); nil != p || nil != err {
+		t.Errorf("xtracta: got %v %v, want the built-in profile (nil)", p, err)
+	}
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		json string
+		want string
+	}{
+		{`{"documents": "/a/b", "metadata": {"@document_id": "@id"}}`, ""},
+		{`{"documents": "/a/b"`, "could not parse"},
+		{`{"documents": "a["}`, "documents:"},
+		{`{"fields": {"select": "f", "name": "", "value": "v"}}`, "fields:"},
+		{`{"metadata": {"@nonsense": "@id"}}`, "unknown name @nonsense"},
+		{`{"metadata": {"@document_id": "@"}}`, "metadata @document_id:"},
+	} {
+		fn := filepath.Join(dir, "profile.json")
+		if err := os.WriteFile(fn, []byte(tc.json), 0644); nil != err {
+			t.Fatal(err)
+		}
+		p, err := loadXmlProfile(fn)
+		if "" == tc.want {
+			if nil != err || fn != p.Name || nil == p.documents {
+				t.Errorf("%s: got %+v %v", tc.json, p, err)
+			}
+		} else if nil == err || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want an error about %q", tc.json, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/circuitbreaker"
+	"github.com/go-kit/kit/endpoint"
+	"github.com/sony/gobreaker"
+	"io"
+	"math/rand"
+	"net/http"
+	"reflectsvc/misc"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrBreakerOpen is returned (wrapped, with the destination) when the
+// circuit breaker for a destination is open and the request was
+// never attempted.
+var ErrBreakerOpen = errors.New("circuit breaker open")
+
+// retryableResponse marks a downstream response that is worth another
+// try: any 5xx, and 429 Too Many Requests.
+type retryableResponse struct {
+	Status     string
+	RetryAfter time.Duration
+}
+
+func (r retryableResponse) Error() string {
+	return "destination returned " + r.Status
+}
+
+var breakers = make(map[string]endpoint.Middleware)
+var breakerSync sync.Mutex
+
+// destinationBreaker returns the circuit breaker middleware for a
+// destination, creating it on first use. Each destination gets its
+// own breaker, so one bad downstream does not trip the others.
+// --breaker-failures 0 disables the breaker entirely.
+func destinationBreaker(dest string) endpoint.Middleware {
+	if FlagBreakerFailures <= 0 {
+		return func(next endpoint.Endpoint) endpoint.Endpoint { return next }
+	}
+	breakerSync.Lock()
+	defer breakerSync.Unlock()
+	mw, ok := breakers[dest]
+	if !ok {
+		cb := gobreaker.NewCircuitBreaker(gobreaker.Settings{
+			Name:        dest,
+			MaxRequests: 1,
+			Timeout:     FlagBreakerCooldown,
+			ReadyToTrip: func(counts gobreaker.Counts) bool {
+				return counts.ConsecutiveFailures >= FlagBreakerFailures
+			},
+			OnStateChange: func(name string, from gobreaker.State, to gobreaker.State) {
+				xLog.Printf("circuit breaker for %s changed from %s to %s", name, from, to)
+			},
+		})
+		mw = circuitbreaker.Gobreaker(cb)
+		breakers[dest] = mw
+	}
+	return mw
+}
+
+// makePostEndpoint performs a single attempt. The response body is
+// read here so the caller never holds an open connection across a
+// retry, and 5xx / 429 responses are returned as errors to be retried.
+func makePostEndpoint(client *http.Client) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		var xj x2jProxyData
+		hReq := request.(*http.Request)
+		rsp, err := client.Do(hReq)
+		if nil != err {
+			return xj, err
+		}
+		defer misc.DeferError(rsp.Body.Close)
+		xj.Code = rsp.StatusCode
+		xj.Status = rsp.Status
+		xj.Header = rsp.Header
+		xj.Body, err = io.ReadAll(rsp.Body)
+		if nil != err {
+			return xj, err
+		}
+		if rsp.StatusCode >= 500 || rsp.StatusCode == http.StatusTooManyRequests {
+			return xj, retryableResponse{
+				Status:     rsp.Status,
+				RetryAfter: parseRetryAfter(rsp.Header.Get("Retry-After")),
+			}
+		}
+		return xj, nil
+	}
+}
+
+// sendWithRetry posts to dest, building a fresh request for every
+// attempt with newRequest. Connection errors, 5xx and 429 responses are
+// retried up to --retry-max times with jittered exponential backoff; a
+// Retry-After header takes the place of the computed delay. The last
+// response received (if any) is returned alongside the last error.
+// The circuit breaker counts deliveries, not attempts: a delivery that
+// fails after all its retries is one failure. The first request is
+// built before the breaker is asked, so a request that cannot be made
+// (no OAuth token, or no signature) is not held against the destination.
+func sendWithRetry(ctx context.Context, dest string, client *http.Client,
+	newRequest func(ctx context.Context) (*http.Request, error)) (xj x2jProxyData, err error) {
+
+	var history []deliveryAttempt
+	defer func() {
+		xj.History = history
+	}()
+
+	first, err := newRequest(ctx)
+	if nil != err {
+		return xj, err
+	}
+	post := makePostEndpoint(client)
+	deliver := func(ctx context.Context, _ interface{}) (interface{}, error) {
+		return retryDelivery(ctx, dest, post, first, newRequest, &history)
+	}
+	rsp, err := destinationBreaker(dest)(deliver)(ctx, nil)
+	if r, ok := rsp.(x2jProxyData); ok {
+		xj = r
+	}
+	if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+		xj = x2jProxyData{
+			Code:   http.StatusServiceUnavailable,
+			Status: fmt.Sprintf("circuit breaker open for destination %s", dest),
+		}
+		return xj, fmt.Errorf("%w for destination %s", ErrBreakerOpen, dest)
+	}
+	return xj, err
+}
+
+// retryDelivery makes the attempts of one delivery, noting each in
+// history: first, and then a request from newRequest for each retry.
+// A retry that cannot be made ends the delivery, which the destination
+// has already failed.
+func retryDelivery(ctx context.Context, dest string, send endpoint.Endpoint, first *http.Request,
+	newRequest func(ctx context.Context) (*http.Request, error),
+	history *[]deliveryAttempt) (xj x2jProxyData, err error) {
+
+	for attempt := 0; ; attempt++ {
+		hReq := first
+		var rsp interface{}
+		if attempt > 0 {
+			if hReq, err = newRequest(ctx); nil != err {
+				return xj, err
+			}
+		}
+		tried := time.Now().UTC()
+		rsp, err = send(ctx, hReq)
+		if r, ok := rsp.(x2jProxyData); ok {
+			xj = r
+		}
+		*history = append(*history, newDeliveryAttempt(tried, xj, err))
+		if nil == err {
+			return xj, nil
+		}
+		if attempt >= FlagRetryMax || nil != ctx.Err() {
+			return xj, err
+		}
+
+		delay := backoffDelay(attempt)
+		var rr retryableResponse
+		if errors.As(err, &rr) && rr.RetryAfter > 0 {
+			if rr.RetryAfter > FlagRetryMaxDelay {
+				xLog.Printf("destination %s asked to retry after %s, longer than "+
+					"--retry-max-delay %s -- giving up", dest, rr.RetryAfter, FlagRetryMaxDelay)
+				return xj, err
+			}
+			delay = rr.RetryAfter
+		}
+		xLog.Printf("attempt %d to %s failed because %s -- retrying in %s",
+			attempt+1, dest, err.Error(), delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return xj, err
+		}
+	}
+}
+
+// backoffDelay is "full jitter" exponential backoff: a random delay
+// between zero and base * 2^attempt, capped at --retry-max-delay.
+func backoffDelay(attempt int) time.Duration {
+	ceiling := FlagRetryMaxDelay
+	if attempt < 32 {
+		if d := FlagRetryBaseDelay << uint(attempt); d > 0 && d < ceiling {
+			ceiling = d
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// parseRetryAfter understands both forms of Retry-After: a count of
+// seconds, or an HTTP date. Anything else is ignored.
+func parseRetryAfter(value string) time.Duration {
+	if !misc.IsStringSet(&value) {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); nil == err {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); nil == err {
+		if d := time.Until(when); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
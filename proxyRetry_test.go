@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBreakerIgnoresRequestErrors(t *testing.T) {
+	var status = http.StatusOK
+	dest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer dest.Close()
+	savedFailures, savedRetries := FlagBreakerFailures, FlagRetryMax
+	defer func() { FlagBreakerFailures, FlagRetryMax = savedFailures, savedRetries }()
+	FlagBreakerFailures, FlagRetryMax = 2, 0
+
+	noToken := errors.New("no token")
+	cannot := func(ctx context.Context) (*http.Request, error) { return nil, noToken }
+	post := func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodPost, dest.URL, nil)
+	}
+	send := func(newRequest func(ctx context.Context) (*http.Request, error)) (x2jProxyData, error) {
+		return sendWithRetry(context.Background(), dest.URL, http.DefaultClient, newRequest)
+	}
+
+	// requests that could not be made are not the destination's fault
+	for range [3]int{} {
+		if _, err := send(cannot); !errors.Is(err, noToken) {
+			t.Fatalf("got %v, want %v", err, noToken)
+		}
+	}
+	if xj, err := send(post); nil != err || http.StatusOK != xj.Code {
+		t.Fatalf("after requests that could not be made: got %d, %v", xj.Code, err)
+	}
+
+	// deliveries the destination fails are
+	status = http.StatusServiceUnavailable
+	for range [2]int{} {
+		if _, err := send(post); nil == err {
+			t.Fatal("a 503 delivered")
+		}
+	}
+	if _, err := send(post); !errors.Is(err, ErrBreakerOpen) {
+		t.Errorf("after %d failed deliveries: got %v, want the breaker open", FlagBreakerFailures, err)
+	}
+}
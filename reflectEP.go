@@ -55,6 +55,17 @@ func decodeReflectRequest(_ context.Context, r *http.Request) (interface{}, erro
 		v.Body = block
 	}
 	_ = r.Body.Close()
+	if nil == err && FlagVerifySignatures {
+		keyID, sigErr := xKeyring.verifySignature(r.Header.Get(FlagSignTimestampHeader),
+			r.Header.Get(FlagSignHeader), block, FlagSignatureMaxAge)
+		if nil != sigErr {
+			xLog.Printf("reflect refused a request from %s: %s", r.RemoteAddr, sigErr.Error())
+			return v, sigErr
+		}
+		if FlagDebug || FlagVerbose {
+			xLog.Printf("reflect request signed by key %s", keyID)
+		}
+	}
 	return v, err
 }
 
@@ -16,6 +16,14 @@ import (
 // ErrEmpty is returned when an input string is empty.
 var ErrEmpty = errors.New("empty string")
 
+// statusError is an error go-kit reports with the given HTTP status
+type statusError struct {
+	error
+	code int
+}
+
+func (e statusError) StatusCode() int { return e.code }
+
 var signalChan chan os.Signal
 
 func handleSignal() {
@@ -26,9 +34,18 @@ func handleSignal() {
 
 func main() {
 	var err error
-	initLog("reflectsvc.log")
+	flagErr := parseFlags()
+	if nil == flagErr && isSubcommand() {
+		initLog("reflectsvc-cmd.log")
+	} else {
+		initLog("reflectsvc.log")
+	}
 	defer closeLog()
-	initFlags()
+	initFlags(flagErr)
+
+	if nFlags.NArg() > 0 {
+		myFatal(runSubcommand(nFlags.Args()))
+	}
 
 	signalChan = make(chan os.Signal, 1)
 	signal.Notify(signalChan, os.Interrupt, os.Kill)
@@ -60,6 +77,42 @@ func main() {
 	}
 	// setup for specific services
 
+	if misc.IsStringSet(&FlagQueueDir) {
+		xQueue, err = openQueue(FlagQueueDir)
+		if nil != err {
+			xLog.Printf("could not open queue directory %s because %s", FlagQueueDir, err.Error())
+			myFatal()
+		}
+		go xQueue.run()
+	}
+
+	if misc.IsStringSet(&FlagIdempotencyFile) {
+		xLedger, err = openLedger(FlagIdempotencyFile, FlagIdempotencyRetention)
+		if nil != err {
+			xLog.Printf("could not open idempotency file %s because %s", FlagIdempotencyFile, err.Error())
+			myFatal()
+		}
+	}
+
+	if misc.IsStringSet(&FlagSequenceFile) {
+		if err = xSequence.persist(FlagSequenceFile); nil != err {
+			xLog.Printf("could not use sequence file %s because %s", FlagSequenceFile, err.Error())
+			myFatal()
+		}
+	}
+
+	if misc.IsStringSet(&FlagDeadLetterDir) {
+		xDeadLetters, err = openDeadLetters(FlagDeadLetterDir)
+		if nil != err {
+			xLog.Printf("could not open dead-letter directory %s because %s", FlagDeadLetterDir, err.Error())
+			myFatal()
+		}
+	}
+
+	if FlagAsyncWorkers > 0 {
+		xJobs = startJobRegistry(FlagAsyncWorkers, FlagAsyncBacklog)
+	}
+
 	svc := simpleService{}
 
 	successHandler := httpTransport.NewServer(
@@ -92,6 +145,31 @@ func main() {
 		decodeXml2JsonRequest,
 		x2jEncodeResponse)
 
+	json2JsonHandler := httpTransport.NewServer(
+		makeXml2JsonEndpoint(svc),
+		decodeJson2JsonRequest,
+		x2jEncodeResponse)
+
+	json2XmlHandler := httpTransport.NewServer(
+		makeJson2XmlEndpoint(svc),
+		decodeJson2XmlRequest,
+		encodeJson2XmlResponse)
+
+	idempotencyHandler := httpTransport.NewServer(
+		makeIdempotencyAdminEndpoint(),
+		decodeIdempotencyAdminRequest,
+		encodeResponse)
+
+	jobHandler := httpTransport.NewServer(
+		makeJobEndpoint(),
+		decodeJobRequest,
+		encodeResponse)
+
+	deadLetterHandler := httpTransport.NewServer(
+		makeDeadLetterAdminEndpoint(),
+		decodeDeadLetterAdminRequest,
+		encodeResponse)
+
 	http.Handle("/success/", successHandler)
 	http.Handle("/reverse", reverseHandler)
 	http.Handle("/parsifal", convertHandler)
@@ -99,6 +177,12 @@ func main() {
 	http.Handle("/reflect", reflectHandler)
 	http.Handle("/validate", validateHandler)
 	http.Handle("/xml2json", xml2JsonHandler)
+	http.Handle("/json2xml", json2XmlHandler)
+	http.Handle("/json2json", json2JsonHandler)
+	http.Handle("/admin/idempotency", idempotencyHandler)
+	http.Handle("/jobs/", jobHandler)
+	http.Handle("/admin/deadletters", deadLetterHandler)
+	http.Handle("/admin/deadletters/", deadLetterHandler)
 
 	service := "127.0.0.1:" + FlagPort
 
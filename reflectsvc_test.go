@@ -0,0 +1,20 @@
+package main
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+// TestMain gives the tests the flags' defaults, as the service starts
+// with, and a log that goes nowhere
+func TestMain(m *testing.M) {
+	args := os.Args
+	os.Args = args[:1]
+	if err := parseFlags(); nil != err {
+		panic(err)
+	}
+	os.Args = args
+	xLog.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// x2jResponseMode decides what an /xml2json caller gets back
+type x2jResponseMode string
+
+const (
+	// responseSummary is {"success":true}, whatever the destination said
+	responseSummary x2jResponseMode = "summary"
+	// responsePassthrough relays the destination's status, content type and body
+	responsePassthrough x2jResponseMode = "passthrough"
+	// responseEnvelope wraps the destination's body with our own details
+	responseEnvelope x2jResponseMode = "envelope"
+)
+
+// RESPONSEMODEHEADER lets a caller choose the mode for one request
+const RESPONSEMODEHEADER = "P3id-Response-Mode"
+
+func parseResponseMode(s string) (x2jResponseMode, error) {
+	switch mode := x2jResponseMode(strings.ToLower(strings.TrimSpace(s))); mode {
+	case responseSummary, responsePassthrough, responseEnvelope:
+		return mode, nil
+	}
+	return responseSummary, fmt.Errorf("unknown response mode %q (want summary, passthrough or envelope)", s)
+}
+
+// requestResponseMode is the caller's P3id-Response-Mode, if it sent a
+// valid one, otherwise --response-mode
+func requestResponseMode(header http.Header) x2jResponseMode {
+	value := header.Get(RESPONSEMODEHEADER)
+	if "" == value {
+		return xResponseMode
+	}
+	mode, err := parseResponseMode(value)
+	if nil != err {
+		xLog.Printf("ignoring %s header: %s", RESPONSEMODEHEADER, err.Error())
+		return xResponseMode
+	}
+	return mode
+}
+
+// xResponseMode is --response-mode
+var xResponseMode = responseSummary
+
+// x2jEnvelope is the destination's response, wrapped with the
+// sequence id we sent it under, where it went and how long it took.
+type x2jEnvelope struct {
+	// Success is a 2xx from the destination
+	Success     bool            `json:"success"`
+	Sequence    string          `json:"sequence"`
+	Route       string          `json:"route,omitempty"`
+	Destination string          `json:"destination"`
+	Status      int             `json:"status"`
+	ElapsedMs   int64           `json:"elapsedMs"`
+	ContentType string          `json:"contentType,omitempty"`
+	Body        json.RawMessage `json:"body,omitempty"`
+}
+
+func makeEnvelope(xj x2jProxyData) x2jEnvelope {
+	envelope := x2jEnvelope{
+		Success:     xj.Code >= 200 && xj.Code < 300,
+		Sequence:    xj.Sequence,
+		Route:       xj.Route,
+		Destination: xj.Destination,
+		Status:      xj.Code,
+		ElapsedMs:   xj.Elapsed.Milliseconds(),
+		ContentType: xj.Header.Get("Content-Type"),
+		Body:        xj.Body,
+	}
+	if len(xj.Body) == 0 {
+		// nothing came back, as with a 204
+		envelope.Body = nil
+	} else if !json.Valid(xj.Body) {
+		// not json, so carry it as a json string
+		envelope.Body, _ = json.Marshal(string(xj.Body))
+	}
+	return envelope
+}
+
+// x2jModeBody renders a passthrough or envelope response body, and
+// the content type that goes with it
+func x2jModeBody(v xml2JsonResponse) (body string, contentType string, err error) {
+	if v.Mode == responsePassthrough {
+		return string(v.Body), v.Header.Get("Content-Type"), nil
+	}
+	data, err := json.Marshal(makeEnvelope(v.x2jProxyData))
+	return string(data), "application/json", err
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"reflectsvc/misc"
+)
+
+// routeDocumentMatch matches on attributes of the Xtracta document.
+// Each list holds acceptable values; an empty list matches anything.
+type routeDocumentMatch struct {
+	WorkflowID     []string `json:"workflowId,omitempty"`
+	Classification []string `json:"classification,omitempty"`
+	DocumentStatus []string `json:"documentStatus,omitempty"`
+}
+
+// route sends matching documents to one destination, with its own
+// headers, TLS settings and (optionally) its own field mapping.
+type route struct {
+	Name        string              `json:"name"`
+	Destination string              `json:"destination"`
+	Document    routeDocumentMatch  `json:"document,omitempty"`
+	Fields      map[string][]string `json:"fields,omitempty"`
+	Headers     map[string]string   `json:"headers,omitempty"`
+	Insecure    bool                `json:"insecure,omitempty"`
+	CAFile      string              `json:"caFile,omitempty"`
+	CertFile    string              `json:"certFile,omitempty"`
+	KeyFile     string              `json:"keyFile,omitempty"`
+	MinTLS      string              `json:"minTLS,omitempty"`
+	ServerName  string              `json:"serverName,omitempty"`
+	FieldNames  string              `json:"fieldNames,omitempty"`
+	OAuth       *oauthConfig        `json:"oauth,omitempty"`
+
+	remap      map[string]remapField
+	tokens     *oauthTokenSource
+	rootCAs    *caReloader
+	clientCert *keyPairReloader
+	minVersion uint16
+}
+
+type routingTable struct {
+	Routes []*route `json:"routes"`
+}
+
+// xRoutes is nil unless --routes is set, in which case every
+// /xml2json document is delivered to each route that matches it.
+var xRoutes *routingTable
+
+// xDefaultRoute is --destination, with the --dest-* TLS settings
+var xDefaultRoute *route
+
+// defaultRoute is --destination, used when there is no routing table
+func defaultRoute() *route {
+	return xDefaultRoute
+}
+
+func makeDefaultRoute() (*route, error) {
+	rt := &route{
+		Name:        "default",
+		Destination: FlagDest,
+		Insecure:    FlagDestInsecure,
+		remap:       FlagRemapMap,
+	}
+	if err := rt.prepareTLS(); nil != err {
+		return rt, err
+	}
+	return rt, rt.prepareAuth()
+}
+
+// lookupRoute finds a route by name, e.g. for a queued delivery
+func lookupRoute(name string) (*route, bool) {
+	if nil == xRoutes {
+		if name == "default" || !misc.IsStringSet(&name) {
+			return defaultRoute(), true
+		}
+		return nil, false
+	}
+	for _, rt := range xRoutes.Routes {
+		if rt.Name == name {
+			return rt, true
+		}
+	}
+	return nil, false
+}
+
+func loadRoutingTable(fn string) (*routingTable, error) {
+	data, err := os.ReadFile(fn)
+	if nil != err {
+		return nil, err
+	}
+	var table routingTable
+	if err = json.Unmarshal(data, &table); nil != err {
+		return nil, fmt.Errorf("could not parse routing table %s because %w", fn, err)
+	}
+	if len(table.Routes) == 0 {
+		return nil, fmt.Errorf("routing table %s has no routes", fn)
+	}
+
+	names := make(map[string]bool, len(table.Routes))
+	for ix, rt := range table.Routes {
+		if !misc.IsStringSet(&rt.Name) {
+			rt.Name = fmt.Sprintf("route%d", ix+1)
+		}
+		if names[rt.Name] {
+			return nil, fmt.Errorf("routing table %s has more than one route named %s", fn, rt.Name)
+		}
+		names[rt.Name] = true
+		if !misc.IsStringSet(&rt.Destination) {
+			return nil, fmt.Errorf("route %s in %s has no destination", rt.Name, fn)
+		}
+		if misc.IsStringSet(&rt.FieldNames) {
+			rt.remap = loadFieldTranslations(rt.FieldNames)
+		} else {
+			rt.remap = FlagRemapMap
+		}
+		if err = rt.prepareTLS(); nil != err {
+			return nil, fmt.Errorf("route %s: %w", rt.Name, err)
+		}
+		if err = rt.prepareAuth(); nil != err {
+			return nil, fmt.Errorf("route %s: %w", rt.Name, err)
+		}
+		if FlagDebug {
+			xLog.Printf("loaded route %s to %s", rt.Name, rt.Destination)
+		}
+	}
+	return &table, nil
+}
+
+// Match returns every route that the document satisfies, in table order
+func (t *routingTable) Match(x XtractaEvents) []*route {
+	matched := make([]*route, 0, len(t.Routes))
+	for _, rt := range t.Routes {
+		if rt.matches(x) {
+			matched = append(matched, rt)
+		}
+	}
+	return matched
+}
+
+// ErrBatchRoutes refuses a --batch-events array callback whose events
+// do not all match the same routes
+var ErrBatchRoutes = errors.New("the events of the callback go to different routes " +
+	"(deliver them one by one with --batch-events separate)")
+
+// MatchEvents is Match for every event of a callback delivered as one
+// (--batch-events array), which all have to go to the same routes
+func (t *routingTable) MatchEvents(x XtractaEvents) ([]*route, error) {
+	each := x.eachEvent()
+	matched := t.Match(each[0])
+	for _, one := range each[1:] {
+		also := t.Match(one)
+		if len(also) != len(matched) {
+			return nil, ErrBatchRoutes
+		}
+		for ix := range also {
+			if also[ix] != matched[ix] {
+				return nil, ErrBatchRoutes
+			}
+		}
+	}
+	return matched, nil
+}
+
+// matches requires every condition of the route to hold. Field
+// conditions are keyed by the JSON name the default --fieldNames
+// mapping gives the field (or its XML name, if it is not mapped), and
+// compare against the value as it arrived.
+func (rt *route) matches(x XtractaEvents) bool {
+	doc := x.Event.Document
+	if !matchesOneOf(doc.WorkflowID, rt.Document.WorkflowID) ||
+		!matchesOneOf(doc.Classification, rt.Document.Classification) ||
+		!matchesOneOf(doc.DocumentStatus, rt.Document.DocumentStatus) {
+		return false
+	}
+	for name, accept := range rt.Fields {
+		found := false
+		for _, fld := range doc.FieldData.Field {
+			jsonName := fld.FieldName
+			if rm, ok := FlagRemapMap[fld.FieldName]; ok {
+				jsonName = rm.JsonName
+			}
+			if jsonName == name {
+				found = true
+				if !matchesOneOf(fld.FieldValue, accept) {
+					return false
+				}
+				break
+			}
+		}
+		if !found && len(accept) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesOneOf(value string, accept []string) bool {
+	if len(accept) == 0 {
+		return true
+	}
+	for _, a := range accept {
+		if a == value {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareTLS fills in TLS settings the route leaves out from the
+// --dest-* flags, and loads its certificates (failing early if they
+// are unusable).
+func (rt *route) prepareTLS() (err error) {
+	if !misc.IsStringSet(&rt.CAFile) {
+		rt.CAFile = FlagDestCA
+	}
+	if !misc.IsStringSet(&rt.CertFile) && !misc.IsStringSet(&rt.KeyFile) {
+		rt.CertFile = FlagDestCert
+		rt.KeyFile = FlagDestKey
+	}
+	if !misc.IsStringSet(&rt.MinTLS) {
+		rt.MinTLS = FlagDestMinTLS
+	}
+	if !misc.IsStringSet(&rt.ServerName) {
+		rt.ServerName = FlagDestServerName
+	}
+
+	if rt.minVersion, err = parseTLSVersion(rt.MinTLS); nil != err {
+		return err
+	}
+	if misc.IsStringSet(&rt.CAFile) {
+		if rt.rootCAs, err = newCAReloader(rt.CAFile); nil != err {
+			return err
+		}
+	}
+	if misc.IsStringSet(&rt.CertFile) != misc.IsStringSet(&rt.KeyFile) {
+		return fmt.Errorf("a client certificate needs both a certificate file and a key file")
+	}
+	if misc.IsStringSet(&rt.CertFile) {
+		if rt.clientCert, err = newKeyPairReloader(rt.CertFile, rt.KeyFile); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareAuth sets up the route's OAuth2 token source, taking the
+// --oauth-* flags if the route has no oauth settings of its own.
+func (rt *route) prepareAuth() (err error) {
+	if nil == rt.OAuth {
+		rt.OAuth = oauthFromFlags()
+	}
+	if nil != rt.OAuth {
+		rt.tokens, err = newOAuthTokenSource(*rt.OAuth, rt)
+	}
+	return err
+}
+
+// tlsConfig is this route's outbound TLS configuration
+func (rt *route) tlsConfig() *tls.Config {
+	cfg := &tls.Config{
+		InsecureSkipVerify: rt.Insecure,
+		ServerName:         rt.ServerName,
+		MinVersion:         rt.minVersion,
+	}
+	if nil != rt.clientCert {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return rt.clientCert.get()
+		}
+	}
+	if nil != rt.rootCAs && !rt.Insecure {
+		// verified by VerifyConnection against the current CA bundle;
+		// the host is named here because the connection state leaves
+		// out a destination given as an IP address
+		serverName := rt.ServerName
+		if u, err := url.Parse(rt.Destination); !misc.IsStringSet(&serverName) && nil == err {
+			serverName = u.Hostname()
+		}
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = rt.rootCAs.verifier(serverName)
+	}
+	return cfg
+}
+
+// ErrNoRoute is reported when a routing table is loaded and no route
+// matches the document
+var ErrNoRoute = errors.New("no route matched this document")
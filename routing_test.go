@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testDocument is an event of a document with the fields given as
+// name=value
+func testDocument(workflow string, classification string, status string, fields ...string) XtractaEvents {
+	var x XtractaEvents
+	doc := &x.Event.Document
+	doc.DocumentID, doc.WorkflowID, doc.Classification, doc.DocumentStatus = "D", workflow, classification, status
+	for _, f := range fields {
+		name, value, _ := strings.Cut(f, "=")
+		doc.FieldData.Field = append(doc.FieldData.Field, XtractaField{FieldName: name, FieldValue: value})
+	}
+	return x
+}
+
+func TestRouteMatches(t *testing.T) {
+	saved := FlagRemapMap
+	defer func() { FlagRemapMap = saved }()
+	FlagRemapMap = testMapping(t, "Bill Type;billType;string;false")
+
+	for _, tc := range []struct {
+		name  string
+		match routeDocumentMatch
+		// fields are keyed by JSON name
+		fields map[string][]string
+		doc    XtractaEvents
+		want   bool
+	}{
+		{"anything", routeDocumentMatch{}, nil, testDocument("1", "", ""), true},
+		{"one of the workflows", routeDocumentMatch{WorkflowID: []string{"1", "2"}}, nil,
+			testDocument("2", "", ""), true},
+		{"another workflow", routeDocumentMatch{WorkflowID: []string{"1", "2"}}, nil,
+			testDocument("3", "", ""), false},
+		{"every condition", routeDocumentMatch{WorkflowID: []string{"1"}, Classification: []string{"bill"},
+			DocumentStatus: []string{"output"}}, nil, testDocument("1", "bill", "output"), true},
+		{"but one", routeDocumentMatch{WorkflowID: []string{"1"}, Classification: []string{"bill"},
+			DocumentStatus: []string{"output"}}, nil, testDocument("1", "bill", "qa"), false},
+		{"a field by its JSON name", routeDocumentMatch{}, map[string][]string{"billType": {"Freight"}},
+			testDocument("1", "", "", "Bill Type=Freight"), true},
+		{"not by its XML name", routeDocumentMatch{}, map[string][]string{"Bill Type": {"Freight"}},
+			testDocument("1", "", "", "Bill Type=Freight"), false},
+		{"an unmapped field by its XML name", routeDocumentMatch{}, map[string][]string{"Other": {"x"}},
+			testDocument("1", "", "", "Other=x"), true},
+		{"a field of another value", routeDocumentMatch{}, map[string][]string{"billType": {"Freight"}},
+			testDocument("1", "", "", "Bill Type=Storage"), false},
+		{"a missing field", routeDocumentMatch{}, map[string][]string{"billType": {"Freight"}},
+			testDocument("1", "", ""), false},
+		{"a field with any value", routeDocumentMatch{}, map[string][]string{"billType": {}},
+			testDocument("1", "", ""), true},
+	} {
+		rt := &route{Name: tc.name, Document: tc.match, Fields: tc.fields}
+		if got := rt.matches(tc.doc); tc.want != got {
+			t.Errorf("%s: matched %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLoadRoutingTable(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		json string
+		want string
+	}{
+		{`{"routes":[{"destination":"http://a"},{"name":"b","destination":"http://b"}]}`, ""},
+		{`{"routes":[`, "could not parse"},
+		{`{"routes":[]}`, "has no routes"},
+		{`{"routes":[{"name":"a","destination":"http://a"},{"name":"a","destination":"http://b"}]}`,
+			"more than one route named a"},
+		{`{"routes":[{"name":"a"}]}`, "route a in"},
+		{`{"routes":[{"destination":"http://a","certFile":"cert.pem"}]}`, "route route1: a client certificate"},
+	} {
+		fn := filepath.Join(dir, "routes.json")
+		if err := os.WriteFile(fn, []byte(tc.json), 0644); nil != err {
+			t.Fatal(err)
+		}
+		table, err := loadRoutingTable(fn)
+		if "" == tc.want {
+			if nil != err || 2 != len(table.Routes) || "route1" != table.Routes[0].Name ||
+				"b" != table.Routes[1].Name {
+				t.Errorf("%s: got %+v, %v", tc.json, table, err)
+			}
+			continue
+		}
+		if nil == err || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want an error about %q", tc.json, err, tc.want)
+		}
+	}
+}
+
+func TestRoutingFanOut(t *testing.T) {
+	one, two, three := newDestination(t), newDestination(t), newDestination(t)
+	saved := xRoutes
+	defer func() { xRoutes = saved }()
+	xRoutes = &routingTable{Routes: []*route{
+		testRoute(t, "one", one.URL, "1"),
+		testRoute(t, "two", two.URL, "2"),
+		testRoute(t, "both", three.URL, "1", "2"),
+	}}
+	svc := simpleService{}
+
+	// every route that matches, in table order
+	xj := svc.Xml2Json(testBatch(t, "t-1", "1/A"))
+	if http.StatusOK != xj.Code || 2 != len(xj.Results) || "one" != xj.Results[0].Route ||
+		"both" != xj.Results[1].Route {
+		t.Fatalf("got %d %s, %+v", xj.Code, xj.Status, xj.Results)
+	}
+	if 1 != len(one.received()) || 0 != len(two.received()) || 1 != len(three.received()) {
+		t.Errorf("destinations saw %q, %q and %q", one.received(), two.received(), three.received())
+	}
+
+	xj = svc.Xml2Json(testBatch(t, "t-2", "9/B"))
+	if http.StatusUnprocessableEntity != xj.Code || ErrNoRoute.Error() != xj.Status {
+		t.Errorf("a document for no route: got %d %s", xj.Code, xj.Status)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"reflectsvc/misc"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sequenceBase36 = "base36"
+	sequenceULID   = "ulid"
+	sequenceUUIDv7 = "uuidv7"
+)
+
+// sequenceBlock is how many counter values are reserved on disk at a
+// time, so the file is written once per block rather than per document
+const sequenceBlock = 1000
+
+// sequenceGenerator hands out the P3id-Sequence ids that follow a
+// document through the logs, the delivery and the response. The
+// counter is atomic; with --sequence-file, blocks of it are reserved on
+// disk before use, so a restart never repeats a value.
+type sequenceGenerator struct {
+	format  string
+	counter int64
+	ceiling int64
+	fn      string
+	mx      sync.Mutex
+}
+
+// xSequence is the generator for this process; see --sequence-format
+var xSequence = &sequenceGenerator{format: sequenceBase36, ceiling: -1}
+
+func parseSequenceFormat(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case sequenceBase36, "":
+		return sequenceBase36, nil
+	case sequenceULID:
+		return sequenceULID, nil
+	case sequenceUUIDv7, "uuid":
+		return sequenceUUIDv7, nil
+	}
+	return "", fmt.Errorf("unknown sequence format %q (want %s, %s or %s)",
+		s, sequenceBase36, sequenceULID, sequenceUUIDv7)
+}
+
+// persist continues the counter from fn (creating it if need be) and
+// keeps it there from now on
+func (g *sequenceGenerator) persist(fn string) error {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	data, err := os.ReadFile(fn)
+	if nil != err && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	start := int64(0)
+	if nil == err {
+		if start, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); nil != err || start < 0 {
+			return fmt.Errorf("sequence file %s does not hold a counter", fn)
+		}
+	}
+	g.fn = fn
+	// everything below the stored value may have been used already
+	atomic.StoreInt64(&g.counter, start)
+	atomic.StoreInt64(&g.ceiling, start)
+	return g.reserveLocked(start)
+}
+
+// Next returns a new id in the configured format
+func (g *sequenceGenerator) Next() string {
+	n := atomic.AddInt64(&g.counter, 1) - 1
+	if misc.IsStringSet(&g.fn) && n >= atomic.LoadInt64(&g.ceiling) {
+		g.reserve(n)
+	}
+	switch g.format {
+	case sequenceULID:
+		return newULID(time.Now())
+	case sequenceUUIDv7:
+		return newUUIDv7(time.Now())
+	}
+	return strconv.FormatInt(time.Now().Unix(), 36) + "-" + strconv.FormatInt(n, 10)
+}
+
+// reserve makes sure n is below the ceiling written to disk; callers
+// past the old ceiling wait here until the new one is saved
+func (g *sequenceGenerator) reserve(n int64) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+	if n < atomic.LoadInt64(&g.ceiling) {
+		return
+	}
+	if err := g.reserveLocked(n); nil != err {
+		// keep going: a repeat after a crash is better than no delivery
+		xLog.Printf("huh? could not save sequence file %s because %s", g.fn, err.Error())
+	}
+}
+
+// reserveLocked writes a ceiling a block beyond n; g.mx is held
+func (g *sequenceGenerator) reserveLocked(n int64) error {
+	ceiling := n + sequenceBlock
+	err := misc.WriteFileAtomic(g.fn, []byte(strconv.FormatInt(ceiling, 10)+"\n"), 0644)
+	atomic.StoreInt64(&g.ceiling, ceiling)
+	return err
+}
+
+// crockford is the ULID alphabet
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID is 48 bits of milliseconds and 80 random bits, as 26
+// characters of Crockford base 32, so ids sort by time
+func newULID(now time.Time) string {
+	var id [16]byte
+	ms := uint64(now.UnixMilli())
+	binary.BigEndian.PutUint16(id[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(ms))
+	_, _ = rand.Read(id[6:])
+
+	var out [26]byte
+	// 128 bits as 26 five-bit groups, the first group holding 3 bits
+	hi := binary.BigEndian.Uint64(id[0:8])
+	lo := binary.BigEndian.Uint64(id[8:16])
+	for ix := 25; ix >= 0; ix-- {
+		out[ix] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// newUUIDv7 is an RFC 9562 version 7 UUID: milliseconds, then random bits
+func newUUIDv7(now time.Time) string {
+	var id [16]byte
+	ms := uint64(now.UnixMilli())
+	binary.BigEndian.PutUint16(id[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(ms))
+	_, _ = rand.Read(id[6:])
+	id[6] = id[6]&0x0f | 0x70
+	id[8] = id[8]&0x3f | 0x80
+
+	h := hex.EncodeToString(id[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
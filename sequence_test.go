@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSequenceFormat(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{"", sequenceBase36},
+		{"base36", sequenceBase36},
+		{"ULID", sequenceULID},
+		{"uuidv7", sequenceUUIDv7},
+		{"uuid", sequenceUUIDv7},
+		{"uuidv4", ""},
+	} {
+		got, err := parseSequenceFormat(tc.in)
+		if got != tc.want || ("" == tc.want) != (nil != err) {
+			t.Errorf("%q: got %q, %v; want %q", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+// counterOf is the counter at the end of a base36 id
+func counterOf(t *testing.T, id string) int64 {
+	t.Helper()
+	parts := strings.Split(id, "-")
+	n, err := strconv.ParseInt(parts[len(parts)-1], 10, 64)
+	if 2 != len(parts) || nil != err {
+		t.Fatalf("%q is not a base36 sequence", id)
+	}
+	if _, err = strconv.ParseInt(parts[0], 36, 64); nil != err {
+		t.Fatalf("%q is not a base36 sequence", id)
+	}
+	return n
+}
+
+func TestSequencePersisted(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "sequence")
+	stored := func() string {
+		data, err := os.ReadFile(fn)
+		if nil != err {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(data))
+	}
+
+	g := &sequenceGenerator{format: sequenceBase36}
+	if err := g.persist(fn); nil != err {
+		t.Fatal(err)
+	}
+	if "1000" != stored() {
+		t.Errorf("a new file holds %q; want the first block reserved", stored())
+	}
+	for want := int64(0); want < 3; want++ {
+		if got := counterOf(t, g.Next()); got != want {
+			t.Errorf("got %d, want %d", got, want)
+		}
+	}
+
+	// a restart carries on past everything that may have been used
+	g = &sequenceGenerator{format: sequenceBase36}
+	if err := g.persist(fn); nil != err {
+		t.Fatal(err)
+	}
+	if got := counterOf(t, g.Next()); 1000 != got {
+		t.Errorf("after a restart: got %d, want 1000", got)
+	}
+	if "2000" != stored() {
+		t.Errorf("the file holds %q after a restart", stored())
+	}
+	// the next block is reserved once this one is used up
+	for ix := 1; ix < sequenceBlock; ix++ {
+		g.Next()
+	}
+	if got := counterOf(t, g.Next()); 2000 != got || "3000" != stored() {
+		t.Errorf("past the block: got %d with %q stored", got, stored())
+	}
+
+	for _, bad := range []string{"twelve\n", "-5\n"} {
+		if err := os.WriteFile(fn, []byte(bad), 0644); nil != err {
+			t.Fatal(err)
+		}
+		if err := (&sequenceGenerator{}).persist(fn); nil == err {
+			t.Errorf("a file of %q was read", bad)
+		}
+	}
+}
+
+func TestULID(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_123)
+	id := newULID(now)
+	if !regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{26}$`).MatchString(id) || id[0] > '7' {
+		t.Fatalf("%q is not a ULID", id)
+	}
+	// the first ten characters are the milliseconds
+	var ms int64
+	for _, c := range id[:10] {
+		ms = ms<<5 | int64(strings.IndexRune(crockford, c))
+	}
+	if now.UnixMilli() != ms {
+		t.Errorf("%q is of %d ms, want %d", id, ms, now.UnixMilli())
+	}
+	if id == newULID(now) {
+		t.Errorf("two ULIDs of the same time are %q", id)
+	}
+	ids := []string{newULID(now.Add(time.Hour)), newULID(now), newULID(now.Add(time.Millisecond))}
+	if !sort.StringsAreSorted([]string{ids[1], ids[2], ids[0]}) {
+		t.Errorf("ULIDs do not sort by time: %q", ids)
+	}
+}
+
+func TestUUIDv7(t *testing.T) {
+	now := time.UnixMilli(1_700_000_000_123)
+	id := newUUIDv7(now)
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Fatalf("%q is not a version 7 UUID", id)
+	}
+	ms, err := strconv.ParseInt(strings.ReplaceAll(id[:13], "-", ""), 16, 64)
+	if nil != err || now.UnixMilli() != ms {
+		t.Errorf("%q is of %d ms, want %d", id, ms, now.UnixMilli())
+	}
+	if id == newUUIDv7(now) {
+		t.Errorf("two UUIDs of the same time are %q", id)
+	}
+}
+
+func TestSequenceFormats(t *testing.T) {
+	for format, pattern := range map[string]string{
+		sequenceBase36: `^[0-9a-z]+-\d+$`,
+		sequenceULID:   `^[0-9A-Z]{26}$`,
+		sequenceUUIDv7: `^[0-9a-f]{8}-[0-9a-f]{4}-7`,
+	} {
+		g := &sequenceGenerator{format: format, ceiling: -1}
+		if id := g.Next(); !regexp.MustCompile(pattern).MatchString(id) {
+			t.Errorf("%s: got %q", format, id)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflectsvc/misc"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigHMACSHA256 = "hmac-sha256"
+	sigEd25519    = "ed25519"
+)
+
+// signingKey is one entry in the --sign-keys keyring. HMAC keys need a
+// secret (file or environment); Ed25519 keys need a private key to sign
+// and a public key (or the private key) to verify. Both are PEM files.
+type signingKey struct {
+	ID             string `json:"id"`
+	Algorithm      string `json:"algorithm"`
+	SecretFile     string `json:"secretFile,omitempty"`
+	SecretEnv      string `json:"secretEnv,omitempty"`
+	PrivateKeyFile string `json:"privateKeyFile,omitempty"`
+	PublicKeyFile  string `json:"publicKeyFile,omitempty"`
+
+	secret  []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+type signingKeyring struct {
+	Keys []*signingKey `json:"keys"`
+	byID map[string]*signingKey
+}
+
+// xKeyring is nil unless --sign-keys is set; xSigners are the keys
+// named by --sign-key-id, used to sign every delivery
+var xKeyring *signingKeyring
+var xSigners []*signingKey
+
+func loadKeyring(fn string) (*signingKeyring, error) {
+	data, err := os.ReadFile(fn)
+	if nil != err {
+		return nil, err
+	}
+	var kr signingKeyring
+	if err = json.Unmarshal(data, &kr); nil != err {
+		return nil, fmt.Errorf("could not parse keyring %s because %w", fn, err)
+	}
+	kr.byID = make(map[string]*signingKey, len(kr.Keys))
+	for _, key := range kr.Keys {
+		if !misc.IsStringSet(&key.ID) || strings.ContainsAny(key.ID, ",;= ") {
+			return nil, fmt.Errorf("keyring %s: key ids must be set and may not contain ',;= '", fn)
+		}
+		if _, dup := kr.byID[key.ID]; dup {
+			return nil, fmt.Errorf("keyring %s: key id %s appears more than once", fn, key.ID)
+		}
+		if err = key.load(); nil != err {
+			return nil, fmt.Errorf("keyring %s: key %s: %w", fn, key.ID, err)
+		}
+		kr.byID[key.ID] = key
+	}
+	return &kr, nil
+}
+
+func (key *signingKey) load() error {
+	switch strings.ToLower(key.Algorithm) {
+	case sigHMACSHA256:
+		key.Algorithm = sigHMACSHA256
+		if misc.IsStringSet(&key.SecretEnv) {
+			val, ok := os.LookupEnv(key.SecretEnv)
+			if !ok {
+				return fmt.Errorf("secret variable %s is not set", key.SecretEnv)
+			}
+			key.secret = []byte(val)
+		} else if misc.IsStringSet(&key.SecretFile) {
+			data, err := os.ReadFile(key.SecretFile)
+			if nil != err {
+				return err
+			}
+			key.secret = []byte(strings.TrimSpace(string(data)))
+		}
+		if len(key.secret) < 16 {
+			return errors.New("hmac secrets must be at least 16 bytes")
+		}
+	case sigEd25519:
+		key.Algorithm = sigEd25519
+		if misc.IsStringSet(&key.PrivateKeyFile) {
+			parsed, err := readPEMKey(key.PrivateKeyFile, x509.ParsePKCS8PrivateKey)
+			if nil != err {
+				return err
+			}
+			ok := false
+			if key.private, ok = parsed.(ed25519.PrivateKey); !ok {
+				return fmt.Errorf("%s is not an ed25519 private key", key.PrivateKeyFile)
+			}
+			key.public = key.private.Public().(ed25519.PublicKey)
+		}
+		if misc.IsStringSet(&key.PublicKeyFile) {
+			parsed, err := readPEMKey(key.PublicKeyFile, x509.ParsePKIXPublicKey)
+			if nil != err {
+				return err
+			}
+			ok := false
+			if key.public, ok = parsed.(ed25519.PublicKey); !ok {
+				return fmt.Errorf("%s is not an ed25519 public key", key.PublicKeyFile)
+			}
+		}
+		if nil == key.public {
+			return errors.New("ed25519 keys need a privateKeyFile or a publicKeyFile")
+		}
+	default:
+		return fmt.Errorf("unknown algorithm %q (want %s or %s)", key.Algorithm, sigHMACSHA256, sigEd25519)
+	}
+	return nil
+}
+
+func readPEMKey(fn string, parse func([]byte) (interface{}, error)) (interface{}, error) {
+	data, err := os.ReadFile(fn)
+	if nil != err {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if nil == block {
+		return nil, fmt.Errorf("no PEM data found in %s", fn)
+	}
+	return parse(block.Bytes)
+}
+
+// signedMessage binds the timestamp to the body, so a captured
+// signature cannot be replayed later with a new timestamp
+func signedMessage(timestamp string, body []byte) []byte {
+	msg := make([]byte, 0, len(timestamp)+1+len(body))
+	msg = append(msg, timestamp...)
+	msg = append(msg, '.')
+	return append(msg, body...)
+}
+
+func (key *signingKey) sign(msg []byte) (string, error) {
+	var sig []byte
+	switch key.Algorithm {
+	case sigHMACSHA256:
+		mac := hmac.New(sha256.New, key.secret)
+		mac.Write(msg)
+		sig = mac.Sum(nil)
+	case sigEd25519:
+		if nil == key.private {
+			return "", fmt.Errorf("key %s has no private key to sign with", key.ID)
+		}
+		var err error
+		if sig, err = key.private.Sign(nil, msg, crypto.Hash(0)); nil != err {
+			return "", err
+		}
+	}
+	return base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func (key *signingKey) verify(msg []byte, sig []byte) bool {
+	switch key.Algorithm {
+	case sigHMACSHA256:
+		mac := hmac.New(sha256.New, key.secret)
+		mac.Write(msg)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case sigEd25519:
+		return ed25519.Verify(key.public, msg, sig)
+	}
+	return false
+}
+
+// signRequest sets the timestamp and signature headers for body. With
+// more than one --sign-key-id, every key signs, which lets receivers
+// move to a new key while the old one is still accepted.
+func signRequest(header http.Header, body []byte) error {
+	if len(xSigners) == 0 {
+		return nil
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	msg := signedMessage(timestamp, body)
+	sigs := make([]string, 0, len(xSigners))
+	for _, key := range xSigners {
+		sig, err := key.sign(msg)
+		if nil != err {
+			return err
+		}
+		sigs = append(sigs, "keyId="+key.ID+";alg="+key.Algorithm+";sig="+sig)
+	}
+	header.Set(FlagSignTimestampHeader, timestamp)
+	header.Set(FlagSignHeader, strings.Join(sigs, ", "))
+	return nil
+}
+
+// verifySignature accepts the body if any one of its signatures is
+// made by a key in the keyring, and the timestamp is recent enough.
+// Go-kit reports its errors as 401.
+func (kr *signingKeyring) verifySignature(timestamp string, signatures string, body []byte,
+	maxAge time.Duration) (keyID string, err error) {
+
+	if !misc.IsStringSet(&timestamp) || !misc.IsStringSet(&signatures) {
+		return "", statusError{errors.New("request is not signed"), http.StatusUnauthorized}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if nil != err {
+		return "", statusError{fmt.Errorf("bad signature timestamp %q", timestamp), http.StatusUnauthorized}
+	}
+	if maxAge > 0 {
+		age := time.Since(time.Unix(seconds, 0))
+		if age > maxAge || age < -maxAge {
+			return "", statusError{fmt.Errorf("signature timestamp is %s away from now",
+				age.Round(time.Second)), http.StatusUnauthorized}
+		}
+	}
+
+	msg := signedMessage(timestamp, body)
+	for _, one := range strings.Split(signatures, ",") {
+		var id, alg, sig string
+		for _, part := range strings.Split(strings.TrimSpace(one), ";") {
+			name, value, _ := strings.Cut(part, "=")
+			switch strings.TrimSpace(name) {
+			case "keyId":
+				id = value
+			case "alg":
+				alg = value
+			case "sig":
+				sig = value
+			}
+		}
+		key, ok := kr.byID[id]
+		if !ok || key.Algorithm != alg {
+			continue
+		}
+		raw, err := base64.RawURLEncoding.DecodeString(sig)
+		if nil != err {
+			continue
+		}
+		if key.verify(msg, raw) {
+			return id, nil
+		}
+	}
+	return "", statusError{errors.New("no valid signature from a known key"), http.StatusUnauthorized}
+}
+
+// verifySignatureCommand implements
+// `reflectsvc verify-signature <timestamp> <signature> <body file>`
+func verifySignatureCommand(args []string) int {
+	if nil == xKeyring {
+		_, _ = fmt.Fprintln(os.Stderr, "verify-signature needs --sign-keys")
+		return 2
+	}
+	if len(args) != 3 {
+		_, _ = fmt.Fprintf(os.Stderr, "usage: reflectsvc --sign-keys <keyring> verify-signature "+
+			"<%s value> <%s value> <body file>\n", FlagSignTimestampHeader, FlagSignHeader)
+		return 2
+	}
+	body, err := os.ReadFile(args[2])
+	if nil != err {
+		_, _ = fmt.Fprintf(os.Stderr, "could not read %s because %s\n", args[2], err.Error())
+		return 1
+	}
+	// the timestamp is reported, not enforced, when checking by hand
+	keyID, err := xKeyring.verifySignature(args[0], args[1], body, 0)
+	if nil != err {
+		_, _ = fmt.Fprintf(os.Stdout, "INVALID: %s\n", err.Error())
+		return 1
+	}
+	seconds, _ := strconv.ParseInt(args[0], 10, 64)
+	_, _ = fmt.Fprintf(os.Stdout, "valid: signed by key %s at %s\n",
+		keyID, time.Unix(seconds, 0).UTC().Format(time.RFC3339))
+	return 0
+}
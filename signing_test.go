@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeEd25519 writes a new ed25519 key pair as PEM files, returning
+// their names
+func writeEd25519(t *testing.T, dir string, name string) (private string, public string) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if nil != err {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if nil != err {
+		t.Fatal(err)
+	}
+	private, public = filepath.Join(dir, name+".key"), filepath.Join(dir, name+".pub")
+	for fn, block := range map[string]*pem.Block{private: {Type: "PRIVATE KEY", Bytes: privDER},
+		public: {Type: "PUBLIC KEY", Bytes: pubDER}} {
+		if err = os.WriteFile(fn, pem.EncodeToMemory(block), 0600); nil != err {
+			t.Fatal(err)
+		}
+	}
+	return private, public
+}
+
+// testKeyring loads a keyring of the keys given as JSON
+func testKeyring(t *testing.T, keys ...string) (*signingKeyring, error) {
+	t.Helper()
+	fn := filepath.Join(t.TempDir(), "keyring.json")
+	if err := os.WriteFile(fn, []byte(`{"keys":[`+strings.Join(keys, ",")+`]}`), 0600); nil != err {
+		t.Fatal(err)
+	}
+	return loadKeyring(fn)
+}
+
+// signedBy signs body with the keys of kr named, the way deliveries are
+func signedBy(t *testing.T, kr *signingKeyring, body []byte, ids ...string) (timestamp string, signature string) {
+	t.Helper()
+	saved := xSigners
+	defer func() { xSigners = saved }()
+	xSigners = nil
+	for _, id := range ids {
+		xSigners = append(xSigners, kr.byID[id])
+	}
+	header := make(http.Header)
+	if err := signRequest(header, body); nil != err {
+		t.Fatal(err)
+	}
+	return header.Get(FlagSignTimestampHeader), header.Get(FlagSignHeader)
+}
+
+func TestSignAndVerify(t *testing.T) {
+	dir := t.TempDir()
+	private, public := writeEd25519(t, dir, "ed")
+	t.Setenv("TEST_SIGN_SECRET", "0123456789abcdef0123")
+	hmacKey := `{"id":"h1","algorithm":"HMAC-SHA256","secretEnv":"TEST_SIGN_SECRET"}`
+	signer, err := testKeyring(t, hmacKey,
+		fmt.Sprintf(`{"id":"e1","algorithm":"ed25519","privateKeyFile":%q}`, private))
+	if nil != err {
+		t.Fatal(err)
+	}
+	// the receiver has the public key only
+	verifier, err := testKeyring(t, hmacKey,
+		fmt.Sprintf(`{"id":"e1","algorithm":"ed25519","publicKeyFile":%q}`, public))
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	body := []byte(`{"documentId":"A"}`)
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	for _, id := range []string{"h1", "e1"} {
+		ts, sig := signedBy(t, signer, body, id)
+		if got, err := verifier.verifySignature(ts, sig, body, time.Minute); nil != err || id != got {
+			t.Errorf("%s: verified as %q, %v", id, got, err)
+		}
+		for name, tc := range map[string][3]string{
+			"another body":      {ts, sig, `{"documentId":"B"}`},
+			"another timestamp": {strconv.FormatInt(time.Now().Unix()+1, 10), sig, string(body)},
+			"an old timestamp":  {old, sig, string(body)},
+			"no timestamp":      {"", sig, string(body)},
+			"no signature":      {ts, "", string(body)},
+			"another algorithm": {ts, strings.Replace(sig, "alg=", "alg=x", 1), string(body)},
+		} {
+			if _, err := verifier.verifySignature(tc[0], tc[1], []byte(tc[2]), time.Minute); nil == err {
+				t.Errorf("%s: %s verified", id, name)
+			} else if se, ok := err.(statusError); !ok || http.StatusUnauthorized != se.StatusCode() {
+				t.Errorf("%s: %s: got %v, want a 401", id, name, err)
+			}
+		}
+	}
+
+	// an ed25519 key without its private half cannot sign
+	if _, err = verifier.byID["e1"].sign(body); nil == err {
+		t.Error("signed with a public key")
+	}
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	t.Setenv("TEST_OLD_SECRET", "old-secret-0123456789")
+	t.Setenv("TEST_NEW_SECRET", "new-secret-0123456789")
+	oldKey := `{"id":"old","algorithm":"hmac-sha256","secretEnv":"TEST_OLD_SECRET"}`
+	newKey := `{"id":"new","algorithm":"hmac-sha256","secretEnv":"TEST_NEW_SECRET"}`
+	both, err := testKeyring(t, oldKey, newKey)
+	if nil != err {
+		t.Fatal(err)
+	}
+	body := []byte(`{}`)
+	ts, sig := signedBy(t, both, body, "old", "new")
+	if !strings.Contains(sig, "keyId=old;") || !strings.Contains(sig, ", keyId=new;") {
+		t.Fatalf("signed as %s", sig)
+	}
+
+	// a receiver that knows either key accepts it while they move over
+	for _, tc := range []struct {
+		keys []string
+		want string
+	}{
+		{[]string{oldKey}, "old"},
+		{[]string{newKey}, "new"},
+		{[]string{strings.Replace(newKey, "TEST_NEW_SECRET", "TEST_OLD_SECRET", 1)}, ""},
+	} {
+		kr, err := testKeyring(t, tc.keys...)
+		if nil != err {
+			t.Fatal(err)
+		}
+		got, err := kr.verifySignature(ts, sig, body, 0)
+		if got != tc.want || ("" == tc.want) != (nil != err) {
+			t.Errorf("%s: verified by %q, %v; want %q", tc.keys, got, err, tc.want)
+		}
+	}
+}
+
+func TestLoadKeyringErrors(t *testing.T) {
+	dir := t.TempDir()
+	_, public := writeEd25519(t, dir, "ed")
+	short := filepath.Join(dir, "short")
+	if err := os.WriteFile(short, []byte("too short\n"), 0600); nil != err {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		key  string
+		want string
+	}{
+		{`{"id":"","algorithm":"hmac-sha256"}`, "key ids must be set"},
+		{`{"id":"a b","algorithm":"hmac-sha256"}`, "key ids must be set"},
+		{`{"id":"a","algorithm":"rsa"}`, "unknown algorithm"},
+		{`{"id":"a","algorithm":"hmac-sha256","secretEnv":"TEST_UNSET_SECRET"}`, "is not set"},
+		{fmt.Sprintf(`{"id":"a","algorithm":"hmac-sha256","secretFile":%q}`, short), "at least 16 bytes"},
+		{`{"id":"a","algorithm":"ed25519"}`, "need a privateKeyFile or a publicKeyFile"},
+		{fmt.Sprintf(`{"id":"a","algorithm":"ed25519","privateKeyFile":%q}`, public), "key a:"},
+		{fmt.Sprintf(`{"id":"a","algorithm":"ed25519","publicKeyFile":%q}`, short), "no PEM data"},
+		{fmt.Sprintf(`{"id":"a","algorithm":"ed25519","publicKeyFile":%q},`+
+			`{"id":"a","algorithm":"ed25519","publicKeyFile":%q}`, public, public), "appears more than once"},
+	} {
+		if _, err := testKeyring(t, tc.key); nil == err || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want an error about %q", tc.key, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// subcommand runs with the positional arguments that follow its
+// name (flags have already been parsed) and returns the exit code.
+type subcommand func(args []string) int
+
+var subcommands = map[string]subcommand{
+	"bench":            benchCommand,
+	"deadletter":       deadLetterCommand,
+	"json2xml":         json2xmlCommand,
+	"mapping":          mappingCommand,
+	"queue":            queueCommand,
+	"verify-signature": verifySignatureCommand,
+}
+
+// isSubcommand reports whether the parsed command line names a
+// subcommand, so main can keep the service log file intact while one
+// runs.
+func isSubcommand() bool {
+	if nFlags.NArg() == 0 {
+		return false
+	}
+	_, ok := subcommands[nFlags.Arg(0)]
+	return ok
+}
+
+// runSubcommand dispatches the positional command line arguments
+func runSubcommand(args []string) int {
+	cmd, ok := subcommands[args[0]]
+	if !ok {
+		names := make([]string, 0, len(subcommands))
+		for name := range subcommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		_, _ = fmt.Fprintf(os.Stderr, "unknown command %q (known commands: %s)\n",
+			args[0], strings.Join(names, ", "))
+		return 2
+	}
+	return cmd(args[1:])
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"reflectsvc/misc"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyPairReloader hands out a client certificate, re-reading the
+// certificate and key files whenever either one changes on disk, so
+// a renewed certificate is picked up without a restart.
+type keyPairReloader struct {
+	certFile string
+	keyFile  string
+	mx       sync.Mutex
+	modTime  time.Time
+	cert     *tls.Certificate
+}
+
+func newKeyPairReloader(certFile string, keyFile string) (*keyPairReloader, error) {
+	r := &keyPairReloader{certFile: certFile, keyFile: keyFile}
+	_, err := r.get()
+	return r, err
+}
+
+func (r *keyPairReloader) get() (*tls.Certificate, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	modTime, err := latestModTime(r.certFile, r.keyFile)
+	if nil != err {
+		if nil != r.cert {
+			xLog.Printf("could not check client certificate %s because %s -- using the one loaded %s",
+				r.certFile, err.Error(), r.modTime.Format(time.RFC3339))
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	if nil != r.cert && !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if nil != err {
+		if nil != r.cert {
+			// probably caught mid-rotation; keep the old pair for now
+			xLog.Printf("could not reload client certificate %s because %s -- keeping the old one",
+				r.certFile, err.Error())
+			return r.cert, nil
+		}
+		return nil, fmt.Errorf("could not load client certificate %s / %s because %w",
+			r.certFile, r.keyFile, err)
+	}
+	if nil != r.cert {
+		xLog.Printf("reloaded client certificate %s", r.certFile)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return r.cert, nil
+}
+
+// caReloader is a bundle of trusted CA certificates, re-read when the
+// bundle file changes on disk.
+type caReloader struct {
+	caFile  string
+	mx      sync.Mutex
+	modTime time.Time
+	pool    *x509.CertPool
+}
+
+func newCAReloader(caFile string) (*caReloader, error) {
+	r := &caReloader{caFile: caFile}
+	_, err := r.get()
+	return r, err
+}
+
+func (r *caReloader) get() (*x509.CertPool, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	modTime, err := latestModTime(r.caFile)
+	if nil != err {
+		if nil != r.pool {
+			return r.pool, nil
+		}
+		return nil, err
+	}
+	if nil != r.pool && !modTime.After(r.modTime) {
+		return r.pool, nil
+	}
+	pem, err := os.ReadFile(r.caFile)
+	if nil == err {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			err = fmt.Errorf("no certificates found in CA bundle %s", r.caFile)
+		} else {
+			if nil != r.pool {
+				xLog.Printf("reloaded CA bundle %s", r.caFile)
+			}
+			r.pool = pool
+			r.modTime = modTime
+		}
+	}
+	if nil != err {
+		if nil != r.pool {
+			xLog.Printf("could not reload CA bundle %s because %s -- keeping the old one",
+				r.caFile, err.Error())
+			return r.pool, nil
+		}
+		return nil, err
+	}
+	return r.pool, nil
+}
+
+// verifier checks the server's chain against the current bundle, and
+// that it is serverName's (if set). The tls.Config skips its own
+// verification (RootCAs cannot be swapped once a transport is built),
+// so this is the only check made.
+func (r *caReloader) verifier(serverName string) func(cs tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("destination presented no certificate")
+		}
+		pool, err := r.get()
+		if nil != err {
+			return err
+		}
+		opts := x509.VerifyOptions{
+			Roots:         pool,
+			DNSName:       cs.ServerName,
+			Intermediates: x509.NewCertPool(),
+		}
+		if misc.IsStringSet(&serverName) {
+			opts.DNSName = serverName
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err = cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+}
+
+func latestModTime(files ...string) (latest time.Time, err error) {
+	for _, fn := range files {
+		fi, err := os.Stat(fn)
+		if nil != err {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// parseTLSVersion understands "1.0" through "1.3" (and "" for Go's default)
+func parseTLSVersion(s string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(s), "tls") {
+	case "":
+		return 0, nil
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q (want 1.0, 1.1, 1.2 or 1.3)", s)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA signs the certificates of a test
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue makes a certificate for name (a server's DNS name, or a
+// client's common name), returning its certificate and key as PEM
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) (certPEM []byte, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if nil != err {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	if x509.ExtKeyUsageServerAuth == usage {
+		tmpl.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeNewer writes a file, dated after anything written before so the
+// reloaders see it has changed
+func writeNewer(t *testing.T, fn string, data []byte, age int) {
+	t.Helper()
+	if err := os.WriteFile(fn, data, 0600); nil != err {
+		t.Fatal(err)
+	}
+	when := time.Now().Add(time.Duration(age) * time.Minute)
+	if err := os.Chtimes(fn, when, when); nil != err {
+		t.Fatal(err)
+	}
+}
+
+// mtlsServer starts a server for dest.example that requires a client
+// certificate from ca, and answers with the client's common name
+func mtlsServer(t *testing.T, serverCA *testCA, clientCA *testCA) *httptest.Server {
+	t.Helper()
+	certPEM, keyPEM := serverCA.issue(t, "dest.example", x509.ExtKeyUsageServerAuth)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if nil != err {
+		t.Fatal(err)
+	}
+	clients := x509.NewCertPool()
+	clients.AddCert(clientCA.cert)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	// refused handshakes are what some of the tests are after
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clients,
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// mtlsGet fetches from srv through the route's TLS settings, returning
+// what the server says the client's common name is
+func mtlsGet(rt *route, srv *httptest.Server) (string, error) {
+	client := &http.Client{Transport: newOutboundTransport(rt.tlsConfig()), Timeout: 5 * time.Second}
+	defer client.CloseIdleConnections()
+	rsp, err := client.Get(srv.URL)
+	if nil != err {
+		return "", err
+	}
+	defer func() { _ = rsp.Body.Close() }()
+	cn, err := io.ReadAll(rsp.Body)
+	return string(cn), err
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverCA := newTestCA(t, "server CA")
+	clientCA := newTestCA(t, "client CA")
+	srv := mtlsServer(t, serverCA, clientCA)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	writeNewer(t, caFile, serverCA.pem, 0)
+	certPEM, keyPEM := clientCA.issue(t, "client-one", x509.ExtKeyUsageClientAuth)
+	writeNewer(t, certFile, certPEM, 0)
+	writeNewer(t, keyFile, keyPEM, 0)
+
+	rt := &route{Name: "mtls", Destination: srv.URL, CAFile: caFile, CertFile: certFile,
+		KeyFile: keyFile, ServerName: "dest.example"}
+	if err := rt.prepareTLS(); nil != err {
+		t.Fatal(err)
+	}
+
+	t.Run("handshake", func(t *testing.T) {
+		cn, err := mtlsGet(rt, srv)
+		if nil != err {
+			t.Fatalf("handshake failed: %s", err)
+		}
+		if "client-one" != cn {
+			t.Errorf("server saw client %q, want client-one", cn)
+		}
+	})
+
+	t.Run("no client certificate", func(t *testing.T) {
+		anon := &route{Name: "anon", Destination: srv.URL, CAFile: caFile, ServerName: "dest.example"}
+		if err := anon.prepareTLS(); nil != err {
+			t.Fatal(err)
+		}
+		if _, err := mtlsGet(anon, srv); nil == err {
+			t.Error("a server requiring a client certificate accepted none")
+		}
+	})
+
+	t.Run("server name pinning", func(t *testing.T) {
+		for _, tc := range []struct {
+			serverName string
+			ok         bool
+		}{
+			{"dest.example", true},
+			{"other.example", false},
+			// the certificate does not name 127.0.0.1
+			{"", false},
+		} {
+			pinned := &route{Name: "pinned", Destination: srv.URL, CAFile: caFile, CertFile: certFile,
+				KeyFile: keyFile, ServerName: tc.serverName}
+			if err := pinned.prepareTLS(); nil != err {
+				t.Fatal(err)
+			}
+			if _, err := mtlsGet(pinned, srv); (nil == err) != tc.ok {
+				t.Errorf("server name %q: got error %v, want success %t", tc.serverName, err, tc.ok)
+			}
+		}
+	})
+
+	t.Run("certificate reload", func(t *testing.T) {
+		certPEM, keyPEM := clientCA.issue(t, "client-two", x509.ExtKeyUsageClientAuth)
+		writeNewer(t, certFile, certPEM, 1)
+		writeNewer(t, keyFile, keyPEM, 1)
+		cn, err := mtlsGet(rt, srv)
+		if nil != err {
+			t.Fatalf("handshake after rotation failed: %s", err)
+		}
+		if "client-two" != cn {
+			t.Errorf("server saw client %q after rotation, want client-two", cn)
+		}
+	})
+
+	t.Run("half-written certificate keeps the old one", func(t *testing.T) {
+		writeNewer(t, keyFile, []byte("not a key"), 2)
+		cn, err := mtlsGet(rt, srv)
+		if nil != err {
+			t.Fatalf("handshake with a bad key on disk failed: %s", err)
+		}
+		if "client-two" != cn {
+			t.Errorf("server saw client %q, want the old client-two", cn)
+		}
+	})
+
+	t.Run("CA bundle reload", func(t *testing.T) {
+		writeNewer(t, caFile, newTestCA(t, "another CA").pem, 3)
+		if _, err := mtlsGet(rt, srv); nil == err {
+			t.Error("the server was trusted after its CA left the bundle")
+		}
+		writeNewer(t, caFile, serverCA.pem, 4)
+		if _, err := mtlsGet(rt, srv); nil != err {
+			t.Errorf("the server was not trusted once its CA was back: %s", err)
+		}
+	})
+}
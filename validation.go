@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// fieldRules are the validation options of a field in the mapping file.
+// A document that breaks any of them is refused by /xml2json (422) and
+// reported by /convert.
+type fieldRules struct {
+	Required  bool
+	MustBe    []string
+	Pattern   *regexp.Regexp
+	MinLength int
+	MaxLength int
+	Min       *big.Rat
+	Max       *big.Rat
+	// Compare holds the cross-field checks, e.g. gte=sPBillNetAmt
+	Compare []fieldComparison
+}
+
+// fieldComparison compares a field with another field, by JSON name
+type fieldComparison struct {
+	Op    string
+	Other string
+}
+
+var comparisonOps = map[string]string{
+	"eq":  "equal to",
+	"ne":  "different from",
+	"gt":  "greater than",
+	"gte": "at least",
+	"lt":  "less than",
+	"lte": "at most",
+}
+
+func (r *fieldRules) isSet() bool {
+	return r.Required || len(r.MustBe) > 0 || nil != r.Pattern || r.MinLength > 0 || r.MaxLength >= 0 ||
+		nil != r.Min || nil != r.Max || len(r.Compare) > 0
+}
+
+// setRuleOption applies the validation options of the mapping file
+func (r *remapField) setRuleOption(key string, value string) (err error) {
+	rules := &r.Rules
+	switch key {
+	case "required":
+		rules.Required, err = strconv.ParseBool(value)
+	case "mustbe", "enum":
+		rules.MustBe = strings.Split(value, "|")
+	case "pattern":
+		// the whole value has to match, not just part of it
+		rules.Pattern, err = regexp.Compile("^(?:" + value + ")$")
+	case "minlength":
+		rules.MinLength, err = strconv.Atoi(value)
+	case "maxlength":
+		rules.MaxLength, err = strconv.Atoi(value)
+	case "min", "max":
+		n, ok := new(big.Rat).SetString(value)
+		if !ok {
+			return fmt.Errorf("%s=%s is not a number", key, value)
+		}
+		if "min" == key {
+			rules.Min = n
+		} else {
+			rules.Max = n
+		}
+	default:
+		if _, ok := comparisonOps[key]; !ok || "" == value {
+			return fmt.Errorf("unknown option %q", key)
+		}
+		rules.Compare = append(rules.Compare, fieldComparison{Op: key, Other: value})
+	}
+	return err
+}
+
+// validate checks the document against the rules of each field of the
+// mapping. raw is the value of each field as it arrived (by XML name),
+// sent the value it was sent as (by JSON name).
+func validate(remap map[string]remapField, raw map[string]string, sent map[string]interface{}) []fieldFailure {
+	fields := make([]remapField, 0, len(remap))
+	for _, rm := range remap {
+		if rm.Rules.isSet() {
+			fields = append(fields, rm)
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Order < fields[j].Order })
+
+	var violations []fieldFailure
+	for _, rm := range fields {
+		rules := rm.Rules
+		value := strings.TrimSpace(raw[rm.XMLName])
+		broken := func(rule string, format string, args ...interface{}) {
+			violations = append(violations, fieldFailure{Field: rm.JsonName, Value: value,
+				Reason: fmt.Sprintf(format, args...), Rule: rule})
+		}
+		if "" == value {
+			if rules.Required {
+				broken("required", "is required")
+			}
+			continue
+		}
+		if len(rules.MustBe) > 0 && !oneOf(value, rules.MustBe) {
+			broken("mustBe", "must be one of %s", strings.Join(rules.MustBe, ", "))
+		}
+		if nil != rules.Pattern && !rules.Pattern.MatchString(value) {
+			broken("pattern", "does not match %s",
+				strings.TrimSuffix(strings.TrimPrefix(rules.Pattern.String(), "^(?:"), ")$"))
+		}
+		if n := utf8.RuneCountInString(value); n < rules.MinLength {
+			broken("minLength", "is shorter than %d characters", rules.MinLength)
+		} else if rules.MaxLength >= 0 && n > rules.MaxLength {
+			broken("maxLength", "is longer than %d characters", rules.MaxLength)
+		}
+		if n, ok := ratOf(sent[rm.JsonName]); ok {
+			if nil != rules.Min && n.Cmp(rules.Min) < 0 {
+				broken("min", "is less than %s", rules.Min.FloatString(decimalPlaces(rules.Min)))
+			}
+			if nil != rules.Max && n.Cmp(rules.Max) > 0 {
+				broken("max", "is more than %s", rules.Max.FloatString(decimalPlaces(rules.Max)))
+			}
+		}
+		for _, cmp := range rules.Compare {
+			other, found := sent[cmp.Other]
+			if !found || nil == other {
+				continue
+			}
+			if c, ok := compareSent(sent[rm.JsonName], other); ok && !comparisonHolds(cmp.Op, c) {
+				broken(cmp.Op, "must be %s %s (%v)", comparisonOps[cmp.Op], cmp.Other, other)
+			}
+		}
+	}
+	return violations
+}
+
+func oneOf(value string, allowed []string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
+
+func ratOf(v interface{}) (*big.Rat, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return nil, false
+	}
+	return new(big.Rat).SetString(string(n))
+}
+
+// decimalPlaces is enough places to print n exactly (it came from the
+// mapping file, so it is a terminating decimal)
+func decimalPlaces(n *big.Rat) int {
+	m, ten := new(big.Rat).Set(n), big.NewRat(10, 1)
+	places := 0
+	for ; !m.IsInt() && places < 20; places++ {
+		m.Mul(m, ten)
+	}
+	return places
+}
+
+// compareSent compares two sent values: numbers as numbers, anything
+// else as strings (ISO dates compare correctly that way)
+func compareSent(a interface{}, b interface{}) (int, bool) {
+	if x, ok := ratOf(a); ok {
+		if y, ok := ratOf(b); ok {
+			return x.Cmp(y), true
+		}
+		return 0, false
+	}
+	x, ok := a.(string)
+	y, ok2 := b.(string)
+	if !ok || !ok2 {
+		return 0, false
+	}
+	return strings.Compare(x, y), true
+}
+
+func comparisonHolds(op string, c int) bool {
+	switch op {
+	case "eq":
+		return c == 0
+	case "ne":
+		return c != 0
+	case "gt":
+		return c > 0
+	case "gte":
+		return c >= 0
+	case "lt":
+		return c < 0
+	case "lte":
+		return c <= 0
+	}
+	return true
+}
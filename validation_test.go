@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidationRules(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		mapping []string
+		fields  []string
+		// want is field:rule of each violation, in the order of the mapping
+		want string
+	}{
+		{"required", []string{"Bill;bill;string;false;required=true"}, []string{"Bill= "}, "bill:required"},
+		{"required and missing", []string{"Bill;bill;string;false;required=true"}, nil, "bill:required"},
+		{"required and there", []string{"Bill;bill;string;false;required=true"}, []string{"Bill=B1"}, ""},
+		{"an empty value breaks no other rule", []string{"Bill;bill;string;false;minLength=3;pattern=B.*"},
+			[]string{"Bill="}, ""},
+		{"one of", []string{"Status;status;string;false;mustBe=open|closed"}, []string{"Status=open"}, ""},
+		{"not one of", []string{"Status;status;string;false;enum=open|closed"}, []string{"Status=Open"},
+			"status:mustBe"},
+		{"the whole value matches", []string{"Bill;bill;string;false;pattern=[0-9]+"}, []string{"Bill=12a"},
+			"bill:pattern"},
+		{"pattern", []string{"Bill;bill;string;false;pattern=[0-9]+"}, []string{"Bill=12"}, ""},
+		{"lengths in characters", []string{"Name;name;string;false;minLength=2;maxLength=4"},
+			[]string{"Name=café"}, ""},
+		{"too short", []string{"Name;name;string;false;minLength=2"}, []string{"Name=é"}, "name:minLength"},
+		{"too long", []string{"Name;name;string;false;maxLength=4"}, []string{"Name=cafés"}, "name:maxLength"},
+		{"nothing at all", []string{"Name;name;string;false;maxLength=0"}, []string{"Name=x"}, "name:maxLength"},
+		{"within", []string{"Amount;amount;number;false;min=0;max=1540.10"}, []string{"Amount=$1,540.10"}, ""},
+		{"below", []string{"Amount;amount;number;false;min=0.01"}, []string{"Amount=0.001"}, "amount:min"},
+		{"above", []string{"Amount;amount;number;false;max=100"}, []string{"Amount=100.5"}, "amount:max"},
+		{"a number that was not sent as one", []string{"Amount;amount;number;false;min=1"},
+			[]string{"Amount=n/a"}, ""},
+		{"compared", []string{"Paid;paid;number;false;lte=total", "Total;total;number;false"},
+			[]string{"Paid=10", "Total=9.99"}, "paid:lte"},
+		{"compared as numbers", []string{"Paid;paid;number;false;lt=total", "Total;total;number;false"},
+			[]string{"Paid=9", "Total=10"}, ""},
+		{"dates compared as strings", []string{"Due;due;date;false;gte=billed", "Billed;billed;date;false"},
+			[]string{"Due=2/20/2023", "Billed=3/13/2023"}, "due:gte"},
+		{"each comparison", []string{"A;a;integer;false;ne=b;gt=b;eq=b", "B;b;integer;false"},
+			[]string{"A=1", "B=1"}, "a:ne a:gt"},
+		{"with nothing to compare", []string{"A;a;integer;false;eq=b", "B;b;integer;false"},
+			[]string{"A=1"}, ""},
+		{"a number and a string", []string{"A;a;integer;false;eq=b", "B;b;string;false"},
+			[]string{"A=1", "B=2"}, ""},
+		{"every rule broken", []string{"Bill;bill;string;false;required=true",
+			"Status;status;string;false;mustBe=open;pattern=[a-z]+;maxLength=3"},
+			[]string{"Status=CLOSED"}, "bill:required status:mustBe status:pattern status:maxLength"},
+	} {
+		remap := testMapping(t, tc.mapping...)
+		c, err := testDocument("1", "", "", tc.fields...).Convert(remap)
+		var got []string
+		for _, v := range c.Violations {
+			got = append(got, v.Field+":"+v.Rule)
+			if "" == v.Reason {
+				t.Errorf("%s: %s has no reason", tc.name, v.Field)
+			}
+		}
+		if nil != err || tc.want != strings.Join(got, " ") {
+			t.Errorf("%s: got %q, %v; want %q", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestValidationRefused(t *testing.T) {
+	remap := testMapping(t, "Amount;amount;number;false;max=100", "Bill;bill;string;false;required=true")
+	c, err := testDocument("1", "", "", "Amount=250").Convert(remap)
+	var ce conversionError
+	if err = c.refused(err); !errors.As(err, &ce) || 2 != len(ce.Failures) ||
+		"is more than 100" != ce.Failures[0].Reason || "250" != ce.Failures[0].Value {
+		t.Errorf("got %v", err)
+	}
+	if c, _ = testDocument("1", "", "", "Amount=5", "Bill=B").Convert(remap); nil != c.refused(nil) {
+		t.Errorf("a document keeping the rules was refused")
+	}
+}
+
+func TestValidationOptions(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "mapping.csv")
+	lines := []string{
+		"A;a;string;false;required=maybe",
+		"B;b;string;false;pattern=[0-9",
+		"C;c;string;false;minLength=two",
+		"D;d;number;false;min=ten",
+		"E;e;number;false;gte=",
+		"F;f;number;false;within=g",
+		"G;g;number;false;required=true;mustBe=1|2;pattern=\\d;minLength=1;maxLength=1;min=1;max=2;lt=a",
+	}
+	if err := os.WriteFile(fn, []byte(strings.Join(lines, "\n")+"\n"), 0644); nil != err {
+		t.Fatal(err)
+	}
+	_, problems, err := readFieldTranslations(fn)
+	if nil != err {
+		t.Fatal(err)
+	}
+	var got []int
+	for _, p := range problems {
+		got = append(got, p.Line)
+	}
+	if 6 != len(problems) || 6 != got[5] {
+		t.Errorf("got problems on lines %v, want 1 to 6", got)
+	}
+}
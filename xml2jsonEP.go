@@ -3,12 +3,10 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
-	"encoding/xml"
+	"encoding/json"
 	"fmt"
 	"github.com/go-kit/kit/endpoint"
 	"io"
-	"math/rand"
 	"net/http"
 	"os"
 	"reflectsvc/misc"
@@ -19,9 +17,39 @@ import (
 )
 
 type x2jProxyData struct {
-	Code   int
-	Status string
-	Body   []byte
+	Code        int
+	Status      string
+	Body        []byte
+	QueueID     string
+	Route       string
+	Destination string
+	Header      http.Header
+	Results     []x2jProxyData
+	Sequence    string
+	Elapsed     time.Duration
+	Skipped     string
+	Attempts    int
+	History     []deliveryAttempt
+	Sent        http.Header
+	Error       string
+	DeadLetter  string
+	Failures    []fieldFailure
+	// pending receives the first attempt at a document queued without
+	// waiting, for whoever follows it later
+	pending <-chan x2jProxyData
+}
+
+// x2jDestinationResult reports one destination of a routed document
+type x2jDestinationResult struct {
+	Route       string       `json:"route"`
+	Destination string       `json:"destination"`
+	Code        int          `json:"code"`
+	Status      string       `json:"status"`
+	Queued      string       `json:"queued,omitempty"`
+	Skipped     string       `json:"skipped,omitempty"`
+	DeadLetter  string       `json:"deadLetter,omitempty"`
+	Headers     http.Header  `json:"headers,omitempty"`
+	Response    *x2jEnvelope `json:"response,omitempty"`
 }
 
 func (xj x2jProxyData) String() string {
@@ -30,7 +58,28 @@ func (xj x2jProxyData) String() string {
 }
 
 // For each method, we define request and response structs
-type xml2JsonResponse x2jProxyData
+
+// xml2JsonResponse is what became of a callback: the delivery of its
+// document, the job that will deliver it (async mode), or each of its
+// events delivered one by one (--batch-events separate)
+type xml2JsonResponse struct {
+	x2jProxyData
+	Mode x2jResponseMode
+	// LowConfidence are the fields below their confidence threshold
+	LowConfidence []string
+	// JobID is the job delivering the document, in async mode
+	JobID string
+	// Events are the responses for each event of a batch
+	Events []x2jEventResponse
+}
+
+// x2jEventResponse is the response for one event of a batch; Event and
+// DocumentID say which
+type x2jEventResponse struct {
+	xml2JsonResponse
+	Event      string
+	DocumentID string
+}
 
 type xml2JsonRequest XtractaEvents
 
@@ -38,15 +87,14 @@ func (pr xml2JsonRequest) String() string {
 	return XtractaEvents(pr).String()
 }
 
-func (pr xml2JsonRequest) Json() string {
+func (pr xml2JsonRequest) Json() (string, error) {
 	return XtractaEvents(pr).Json()
 }
 
 func makeXml2JsonEndpoint(svc SimpleService) endpoint.Endpoint {
 	return func(_ context.Context, request interface{}) (interface{}, error) {
 		req := request.(xml2JsonRequest)
-		v := svc.Xml2Json(req)
-		return xml2JsonResponse(v), nil
+		return svc.Xml2Json(req), nil
 	}
 }
 
@@ -55,15 +103,16 @@ var decodeSync sync.Mutex
 
 func decodeXml2JsonRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	var req xml2JsonRequest
+	// the P3id-Sequence that follows this document from here on
+	guid := xSequence.Next()
+	req.MagicInternalGuid = guid
 
 	if FlagDebug {
-		var fn, guid string
+		var fn string
 		body, _ := io.ReadAll(r.Body)
 		_ = r.Body.Close()
 		{
 			decodeSync.Lock()
-			guid = strconv.FormatInt(rand.Int63(), 36)
-			req.MagicInternalGuid = guid
 			fn = fmt.Sprintf("%s_xmldbg%03d.log",
 				time.Now().UTC().Format(misc.DATE_POG),
 				xmlDebugCount)
@@ -76,6 +125,7 @@ func decodeXml2JsonRequest(_ context.Context, r *http.Request) (interface{}, err
 		xf, _ := os.OpenFile(fn, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 		defer misc.DeferError(xf.Close)
 		_, _ = fmt.Fprintf(xf, "path [%s]\n", r.URL.String())
+		_, _ = fmt.Fprintf(xf, "%s [%s]\n", P3IDSEQUENCEHEADER, guid)
 		_, _ = fmt.Fprintf(xf, "request %s\n\t\tHEADERS\n", fn)
 		_, _ = xf.Write(debugMapStringArrayString(r.Header))
 		_, _ = fmt.Fprintf(xf, "\n\t\tBODY\n")
@@ -88,9 +138,12 @@ func decodeXml2JsonRequest(_ context.Context, r *http.Request) (interface{}, err
 		xLog.Printf("io.ReadAll failed on decodeXml2JsonRequest because %s", err.Error())
 		return nil, err
 	}
-	err = xml.Unmarshal(body, &req)
+	events, err := readDocuments(body)
+	req = xml2JsonRequest(events)
+	req.MagicInternalGuid = guid
 
 	req.Headers = r.Header
+	req.Raw = body
 	if nil != err {
 		xLog.Printf("xml.Unmarshal failed because %s", err.Error())
 		return nil, err
@@ -99,6 +152,8 @@ func decodeXml2JsonRequest(_ context.Context, r *http.Request) (interface{}, err
 	return req, nil
 }
 
+// standardRequestHeaders and proxiedHeaders make up the default
+// header policy, used when there is no --header-policy
 var standardRequestHeaders = map[string]string{
 	"Accept-Charset": "utf-8",
 	"DNT":            "1",
@@ -106,64 +161,197 @@ var standardRequestHeaders = map[string]string{
 
 var proxiedHeaders = [...]string{"Authorization", "User-Agent", "Ocp-Apim-Subscription-Key"}
 
-var p3idSequence = int64(0)
-
 const P3IDSEQUENCEHEADER = "P3id-Sequence"
 
-func x2jProxy(header http.Header, jsonReader io.Reader) (*http.Response, error) {
-	var tr *http.Transport
+// x2jProxy posts the converted json to the route's destination,
+// forwarding headers from the original request per the header policy.
+// Transient failures are retried (see sendWithRetry); the response
+// body has already been read when this returns.
+func x2jProxy(rt *route, header http.Header, extra http.Header, jsonBody []byte) (x2jProxyData, error) {
+	return x2jDeliver(rt, x2jOutboundHeaders(rt, header, extra), jsonBody)
+}
 
-	if FlagDestInsecure {
-		tr = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-	} else {
-		tr = &http.Transport{}
+// x2jOutboundHeaders builds the headers that accompany a delivery: the
+// document's P3id-Sequence (a fresh one if extra has none), the headers the header policy injects and
+// forwards, the route's own headers and the extra headers this
+// service adds for the document (such as Idempotency-Key), less
+// anything the policy strips.
+func x2jOutboundHeaders(rt *route, header http.Header, extra http.Header) http.Header {
+	out := make(http.Header)
+	seq := extra.Get(P3IDSEQUENCEHEADER)
+	if !misc.IsStringSet(&seq) {
+		seq = xSequence.Next()
+	}
+	out.Set(P3IDSEQUENCEHEADER, seq)
+	if FlagDebug {
+		xLog.Printf("setting header %s as %s \n", P3IDSEQUENCEHEADER, seq)
 	}
 
-	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Minute)
-	defer cancelFunc()
+	out.Set("Content-Type", "application/json")
+	out.Set("Accept", "application/json")
+	xHeaderPolicy.apply(header, out)
 
-	hReq, err := http.NewRequestWithContext(ctx, http.MethodPost, FlagDest, jsonReader)
-	if nil != err {
-		xLog.Printf("huh? Could not create an httpRequest because %s", err.Error())
-		return nil, err
+	for key, val := range rt.Headers {
+		out.Set(key, val)
 	}
+	for key, values := range extra {
+		out[key] = values
+	}
+	xHeaderPolicy.strip(out)
+	return out
+}
 
-	{
-		var sb strings.Builder
-		sb.WriteString(strconv.FormatInt(time.Now().Unix(), 36))
-		sb.WriteRune('-')
-		sb.WriteString(strconv.FormatInt(p3idSequence, 10))
-		hReq.Header.Set(P3IDSEQUENCEHEADER, sb.String())
-		p3idSequence++
+// x2jDeliver posts jsonBody to the route's destination with exactly
+// the given headers.
+func x2jDeliver(rt *route, header http.Header, jsonBody []byte) (x2jProxyData, error) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), FlagDestTimeout)
+	defer cancelFunc()
+
+	var sentToken string
+	attempts := 0
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		attempts++
+		hReq, err := http.NewRequestWithContext(ctx, http.MethodPost, rt.Destination, bytes.NewReader(jsonBody))
+		if nil != err {
+			xLog.Printf("huh? Could not create an httpRequest because %s", err.Error())
+			return nil, err
+		}
+		for key, values := range header {
+			hReq.Header[key] = values
+		}
+		if nil != rt.tokens {
+			token, err := rt.tokens.Token(ctx)
+			if nil != err {
+				xLog.Printf("could not get an oauth token for %s because %s", rt.Destination, err.Error())
+				return nil, err
+			}
+			hReq.Header.Set("Authorization", "Bearer "+token)
+			sentToken = token
+		}
+		// signed per attempt, so a retried or queued delivery has a fresh timestamp
+		if err = signRequest(hReq.Header, jsonBody); nil != err {
+			xLog.Printf("huh? could not sign the delivery to %s because %s", rt.Destination, err.Error())
+			return nil, err
+		}
 		if FlagDebug {
-			xLog.Printf("setting header %s as %s \n", P3IDSEQUENCEHEADER, sb.String())
+			logHeaders(hReq.Header)
 		}
+		return hReq, nil
 	}
 
-	hReq.Header.Set("Content-Type", "application/json")
-	hReq.Header.Set("Accept", "application/json")
-	for key, val := range standardRequestHeaders {
-		hReq.Header.Set(key, val)
+	start := time.Now()
+	xj, err := sendWithRetry(ctx, rt.Destination, outboundClient(rt), newRequest)
+	if nil != rt.tokens && xj.Code == http.StatusUnauthorized {
+		// the token may have been revoked early: get a new one, try once more
+		xLog.Printf("destination %s refused our oauth token -- fetching a new one and resending",
+			rt.Destination)
+		rt.tokens.Invalidate(sentToken)
+		history := xj.History
+		xj, err = sendWithRetry(ctx, rt.Destination, outboundClient(rt), newRequest)
+		xj.History = append(history, xj.History...)
 	}
+	xj.Sequence = header.Get(P3IDSEQUENCEHEADER)
+	xj.Elapsed = time.Since(start)
+	xj.Attempts = attempts
+	xj.Sent = header
+	if nil != err {
+		xj.Error = err.Error()
+	}
+	return xj, err
+}
 
-	for _, ph := range proxiedHeaders {
-		values, ok := header[ph]
-		if ok {
-			hReq.Header[ph] = values
+// queueXml2Json queues the document for the route; ledger is what the
+// idempotency ledger records once it is delivered
+func queueXml2Json(rt *route, header http.Header, extra http.Header, rawXML []byte, jsonBody string,
+	async bool, ledger []*deliveryRecord) (xjProxy x2jProxyData) {
+	id, result, err := xQueue.Enqueue(queuedDelivery{
+		Route:       rt.Name,
+		Destination: rt.Destination,
+		Headers:     x2jOutboundHeaders(rt, header, extra),
+		Body:        jsonBody,
+		XML:         string(rawXML),
+		Ledger:      ledger,
+	}, true)
+	if nil != err {
+		if nil != xLedger {
+			for _, rec := range ledger {
+				xLedger.settle(rec, false)
+			}
 		}
+		xLog.Printf("could not queue json request to %s because %s", rt.Destination, err.Error())
+		xjProxy.Code = http.StatusInternalServerError
+		xjProxy.Status = "could not queue request"
+		return xjProxy
 	}
 
-	if FlagDebug {
-		logHeaders(hReq.Header)
+	accepted := x2jProxyData{
+		Code:    http.StatusAccepted,
+		Status:  "202 Accepted",
+		Body:    []byte(jsonBody),
+		QueueID: id,
+	}
+	if async {
+		accepted.pending = result
+		return accepted
+	}
+	return awaitQueued(accepted, result)
+}
+
+// awaitQueued waits up to --queue-sync-wait for the first attempt at a
+// queued document, and otherwise returns accepted
+func awaitQueued(accepted x2jProxyData, result <-chan x2jProxyData) (xjProxy x2jProxyData) {
+	timer := time.NewTimer(FlagQueueSyncWait)
+	defer timer.Stop()
+	select {
+	case xjProxy = <-result:
+		if xjProxy.Code <= 0 {
+			xjProxy.Status = "No response from remote server"
+		}
+		xjProxy.Route = accepted.Route
+		xjProxy.Destination = accepted.Destination
+		return xjProxy
+	case <-timer.C:
+		xQueue.Forget(accepted.QueueID)
+		accepted.pending = nil
+		return accepted
 	}
+}
 
-	httpClient := &http.Client{
-		Transport: tr,
+// followQueued waits, as awaitQueued does, on each document queued by
+// xml2JsonDeliver without waiting
+func followQueued(queued x2jProxyData) x2jProxyData {
+	if nil == queued.Results {
+		if nil == queued.pending {
+			return queued
+		}
+		return awaitQueued(queued, queued.pending)
+	}
+	var wg sync.WaitGroup
+	for ix := range queued.Results {
+		if nil == queued.Results[ix].pending {
+			continue
+		}
+		wg.Add(1)
+		go func(ix int) {
+			defer wg.Done()
+			queued.Results[ix] = awaitQueued(queued.Results[ix], queued.Results[ix].pending)
+		}(ix)
 	}
+	wg.Wait()
+	queued.summarize()
+	return queued
+}
 
-	return httpClient.Do(hReq)
+// prefersAsync looks for the RFC 7240 "Prefer: respond-async" preference
+func prefersAsync(header http.Header) bool {
+	for _, value := range header.Values("Prefer") {
+		for _, pref := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(pref), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func logHeaders(h http.Header) {
@@ -184,37 +372,111 @@ func logHeaders(h http.Header) {
 
 func x2jEncodeResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
 	var responseBody string
+	var code int
+	var err error
 	if FlagDebug {
 		xLog.Printf("enter x2jEncodeResponse")
 	}
 
 	v, ok := response.(xml2JsonResponse)
+	if ok && misc.IsStringSet(&v.Sequence) {
+		w.Header().Set(P3IDSEQUENCEHEADER, v.Sequence)
+	}
 
-	if FlagProxySuccess {
-		w.WriteHeader(http.StatusOK)
+	if ok && nil != v.Header {
+		xHeaderPolicy.returned(v.Header, w.Header())
+	}
+	if ok && len(v.LowConfidence) > 0 {
+		w.Header().Set(LOWCONFIDENCEHEADER, strconv.Itoa(len(v.LowConfidence)))
 	}
 
-	if !ok || nil == v.Body || len(v.Body) <= 0 {
-		responseBody = fmt.Sprintf("{\"error\":\"%s\"}", v.Status)
-		if !FlagProxySuccess {
-			w.WriteHeader(http.StatusInternalServerError)
+	if ok && len(v.Events) > 0 {
+		// a batch of events, each delivered by itself: report each one
+		responseBody, err = x2jEventsBody(v)
+		if nil != err {
+			xLog.Printf("huh? could not marshal the per-event results because %s", err.Error())
+			return err
 		}
-		_, err := w.Write([]byte(responseBody))
+		w.Header().Set("Content-Type", "application/json")
+		code = v.Code
+	} else if ok && misc.IsStringSet(&v.JobID) {
+		// async: delivery has not started yet
+		w.Header().Set("Location", "/jobs/"+v.JobID)
+		responseBody = "{\"success\":true,\"job\":" + strconv.Quote(v.JobID) + "}"
+		code = v.Code
+	} else if ok && len(v.Results) > 0 {
+		// routed to one or more destinations: report each one
+		responseBody, err = x2jFanOutBody(v)
 		if nil != err {
-			xLog.Printf("could not write header to response because %s", err.Error())
+			xLog.Printf("huh? could not marshal the per-destination results because %s", err.Error())
 			return err
 		}
-	} else {
-		if !FlagProxySuccess {
-			w.WriteHeader(v.Code)
+		w.Header().Set("Content-Type", "application/json")
+		code = v.Code
+	} else if ok && misc.IsStringSet(&v.Skipped) {
+		// delivered before (or superseded): acknowledged, not forwarded
+		responseBody = "{\"success\":true,\"skipped\":" + strconv.Quote(v.Skipped) + "}"
+		code = v.Code
+	} else if !ok || (len(v.Body) <= 0 && (v.Code < 200 || v.Code >= 300)) {
+		// failed, and the destination (if it answered) said nothing
+		responseBody = fmt.Sprintf("{\"error\":%s}", jsonQuote(v.Status))
+		if misc.IsStringSet(&v.QueueID) {
+			// the delivery failed, but it is still queued and will be retried
+			responseBody = fmt.Sprintf("{\"error\":%s,\"queued\":%s}",
+				jsonQuote(v.Status), strconv.Quote(v.QueueID))
+		} else if misc.IsStringSet(&v.DeadLetter) {
+			responseBody = fmt.Sprintf("{\"error\":%s,\"deadLetter\":%s}",
+				jsonQuote(v.Status), strconv.Quote(v.DeadLetter))
+		} else if len(v.Failures) > 0 {
+			// refused before delivery: say which fields were at fault
+			failures, _ := marshalJson(v.Failures)
+			responseBody = fmt.Sprintf("{\"error\":%s,\"fields\":%s}",
+				jsonQuote(v.Status), failures)
 		}
-		//_. err := w.Write(v.Body)
-		responseBody = "{\"success\":true}"
-		_, err := w.Write([]byte(responseBody))
+		if v.Code >= 400 {
+			code = v.Code
+		} else {
+			code = http.StatusInternalServerError
+		}
+	} else if v.Mode != responseSummary && !misc.IsStringSet(&v.QueueID) {
+		// passthrough and envelope hand back what the destination said
+		var contentType string
+		responseBody, contentType, err = x2jModeBody(v)
 		if nil != err {
-			xLog.Printf("could not write header to response because %s", err.Error())
+			xLog.Printf("huh? could not build the %s response because %s", v.Mode, err.Error())
 			return err
 		}
+		if misc.IsStringSet(&contentType) {
+			w.Header().Set("Content-Type", contentType)
+		}
+		code = v.Code
+	} else {
+		responseBody = "{\"success\":true}"
+		if misc.IsStringSet(&v.QueueID) {
+			responseBody = "{\"success\":true,\"queued\":" + strconv.Quote(v.QueueID) + "}"
+		}
+		if len(v.LowConfidence) > 0 {
+			responseBody = strings.TrimSuffix(responseBody, "}") +
+				",\"lowConfidence\":" + strconv.Itoa(len(v.LowConfidence)) + "}"
+		}
+		code = v.Code
+	}
+
+	if http.StatusNoContent == code && len(responseBody) > 0 {
+		// a 204 cannot carry the body we have to say
+		code = http.StatusOK
+	}
+	// --proxy-success forces the status, whatever the body says
+	if FlagProxySuccess {
+		code = http.StatusOK
+	}
+	w.WriteHeader(code)
+	if len(responseBody) > 0 {
+		_, err = w.Write([]byte(responseBody))
+	}
+	if nil != err {
+		xLog.Printf("could not write header to response because %s", err.Error())
+		return err
 	}
 
 	if FlagDebug {
@@ -224,6 +486,7 @@ func x2jEncodeResponse(_ context.Context, w http.ResponseWriter, response interf
 			xmlDebugCount)
 		xf, _ := os.OpenFile(fn, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 		_, _ = fmt.Fprintf(xf, "request %s\n", fn)
+		_, _ = fmt.Fprintf(xf, "%s [%s]\n", P3IDSEQUENCEHEADER, v.Sequence)
 		_, _ = xf.Write(debugMapStringArrayString(w.Header()))
 		_, _ = xf.WriteString("\n")
 		_, _ = xf.Write([]byte(responseBody))
@@ -235,6 +498,94 @@ func x2jEncodeResponse(_ context.Context, w http.ResponseWriter, response interf
 	return nil
 }
 
+func x2jFanOutBody(v xml2JsonResponse) (string, error) {
+	body := struct {
+		Success      bool                   `json:"success"`
+		Destinations []x2jDestinationResult `json:"destinations"`
+	}{
+		Success:      v.Code >= 200 && v.Code < 300,
+		Destinations: x2jDestinations(v.Results, v.Mode),
+	}
+	data, err := json.Marshal(body)
+	return string(data), err
+}
+
+// x2jDestinations reports each destination a routed document went to
+func x2jDestinations(results []x2jProxyData, mode x2jResponseMode) []x2jDestinationResult {
+	destinations := make([]x2jDestinationResult, 0, len(results))
+	for _, r := range results {
+		result := x2jDestinationResult{
+			Route:       r.Route,
+			Destination: r.Destination,
+			Code:        r.Code,
+			Status:      r.Status,
+			Queued:      r.QueueID,
+			Skipped:     r.Skipped,
+			DeadLetter:  r.DeadLetter,
+			Headers:     xHeaderPolicy.returnedOf(r.Header),
+		}
+		if mode != responseSummary && len(r.Body) > 0 && !misc.IsStringSet(&r.QueueID) {
+			envelope := makeEnvelope(r)
+			result.Response = &envelope
+		}
+		destinations = append(destinations, result)
+	}
+	return destinations
+}
+
+// x2jEventResult reports one event of a batch; sequence and document_id
+// are the event's own, as Xtracta sent them
+type x2jEventResult struct {
+	Sequence      string                 `json:"sequence"`
+	DocumentID    string                 `json:"document_id"`
+	P3idSequence  string                 `json:"p3idSequence"`
+	Code          int                    `json:"code"`
+	Status        string                 `json:"status"`
+	Job           string                 `json:"job,omitempty"`
+	Queued        string                 `json:"queued,omitempty"`
+	Skipped       string                 `json:"skipped,omitempty"`
+	DeadLetter    string                 `json:"deadLetter,omitempty"`
+	LowConfidence int                    `json:"lowConfidence,omitempty"`
+	Fields        []fieldFailure         `json:"fields,omitempty"`
+	Headers       http.Header            `json:"headers,omitempty"`
+	Response      *x2jEnvelope           `json:"response,omitempty"`
+	Destinations  []x2jDestinationResult `json:"destinations,omitempty"`
+}
+
+func x2jEventsBody(v xml2JsonResponse) (string, error) {
+	body := struct {
+		Success bool             `json:"success"`
+		Events  []x2jEventResult `json:"events"`
+	}{
+		Success: v.Code >= 200 && v.Code < 300,
+		Events:  make([]x2jEventResult, 0, len(v.Events)),
+	}
+	for _, r := range v.Events {
+		result := x2jEventResult{
+			Sequence:      r.Event,
+			DocumentID:    r.DocumentID,
+			P3idSequence:  r.Sequence,
+			Code:          r.Code,
+			Status:        r.Status,
+			Job:           r.JobID,
+			Queued:        r.QueueID,
+			Skipped:       r.Skipped,
+			DeadLetter:    r.DeadLetter,
+			LowConfidence: len(r.LowConfidence),
+			Fields:        r.Failures,
+		}
+		if len(r.Results) > 0 {
+			result.Destinations = x2jDestinations(r.Results, r.Mode)
+		} else if result.Headers = xHeaderPolicy.returnedOf(r.Header); r.Mode != responseSummary && len(r.Body) > 0 && !misc.IsStringSet(&r.QueueID) {
+			envelope := makeEnvelope(r.x2jProxyData)
+			result.Response = &envelope
+		}
+		body.Events = append(body.Events, result)
+	}
+	data, err := json.Marshal(body)
+	return string(data), err
+}
+
 func debugMapStringArrayString(m map[string][]string) []byte {
 	var sb strings.Builder
 
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReturnedHeadersPerResult(t *testing.T) {
+	saved := xHeaderPolicy
+	defer func() { xHeaderPolicy = saved }()
+	xHeaderPolicy = &headerPolicy{Return: []string{"Location"}}
+	from := func(location string) http.Header {
+		h := http.Header{"Server": {"dest"}}
+		if "" != location {
+			h.Set("Location", location)
+		}
+		return h
+	}
+
+	for _, tc := range []struct {
+		name string
+		rsp  xml2JsonResponse
+		// headers is how many results have any
+		headers int
+		want    []string
+	}{
+		{"one destination", xml2JsonResponse{x2jProxyData: x2jProxyData{Code: 201, Status: "201 Created",
+			Header: from("/bills/1")}}, 0, nil},
+		{"fan-out", xml2JsonResponse{x2jProxyData: x2jProxyData{Code: 201, Results: []x2jProxyData{
+			{Route: "a", Code: 201, Status: "201 Created", Header: from("/a/1")},
+			{Route: "b", Code: 200, Status: "200 OK", Header: from("")}}}},
+			1, []string{`"route":"a"`, `"headers":{"Location":["/a/1"]}`}},
+		{"batch", xml2JsonResponse{x2jProxyData: x2jProxyData{Code: 201}, Events: []x2jEventResponse{
+			{Event: "1", xml2JsonResponse: xml2JsonResponse{x2jProxyData: x2jProxyData{Code: 201,
+				Status: "201 Created", Header: from("/bills/1")}}},
+			{Event: "2", xml2JsonResponse: xml2JsonResponse{x2jProxyData: x2jProxyData{Code: 201,
+				Status: "201 Created", Header: from("/bills/2")}}}}},
+			2, []string{`"headers":{"Location":["/bills/1"]}`, `"headers":{"Location":["/bills/2"]}`}},
+	} {
+		w := httptest.NewRecorder()
+		if err := x2jEncodeResponse(context.Background(), w, tc.rsp); nil != err {
+			t.Fatal(err)
+		}
+		body := w.Body.String()
+		if nil == tc.want {
+			// a single destination's are the response's own
+			if "/bills/1" != w.Header().Get("Location") || "" != w.Header().Get("Server") ||
+				strings.Contains(body, "headers") {
+				t.Errorf("%s: got headers %v and %s", tc.name, w.Header(), body)
+			}
+			continue
+		}
+		if "" != w.Header().Get("Location") || strings.Count(body, `"headers"`) != tc.headers ||
+			strings.Contains(body, "Server") {
+			t.Errorf("%s: got headers %v and %s", tc.name, w.Header(), body)
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: %s has no %s", tc.name, body, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// xmlNode is a node of an XML document read by parseXmlTree: the
+// document itself, an element or a run of text. Selectors also make
+// attribute nodes, which are not part of the tree.
+type xmlNode struct {
+	Kind     xmlNodeKind
+	Name     xml.Name // as written; Space is the prefix, not the namespace
+	Attr     []xml.Attr
+	Text     string // of text and attribute nodes
+	Children []*xmlNode
+	Parent   *xmlNode
+}
+
+type xmlNodeKind int
+
+const (
+	xmlDocumentNode xmlNodeKind = iota
+	xmlElementNode
+	xmlTextNode
+	xmlAttrNode
+)
+
+// parseXmlTree reads a whole XML document. Comments, processing
+// instructions and directives are dropped.
+func parseXmlTree(data []byte) (*xmlNode, error) {
+	doc := &xmlNode{Kind: xmlDocumentNode}
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = true
+	at := doc
+	for {
+		tok, err := d.RawToken()
+		if io.EOF == err {
+			break
+		} else if nil != err {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if at == doc && len(doc.elements()) > 0 {
+				return nil, errors.New("XML document has more than one root element")
+			}
+			el := &xmlNode{Kind: xmlElementNode, Name: t.Name, Attr: t.Copy().Attr, Parent: at}
+			at.Children = append(at.Children, el)
+			at = el
+		case xml.EndElement:
+			if at == doc || at.Name != t.Name {
+				return nil, fmt.Errorf("XML syntax error: unexpected </%s>", qualifiedName(t.Name))
+			}
+			at = at.Parent
+		case xml.CharData:
+			if at != doc {
+				at.Children = append(at.Children, &xmlNode{Kind: xmlTextNode, Text: string(t), Parent: at})
+			}
+		}
+	}
+	if at != doc {
+		return nil, fmt.Errorf("XML syntax error: <%s> is not closed", qualifiedName(at.Name))
+	}
+	if len(doc.elements()) == 0 {
+		return nil, errors.New("XML document has no root element")
+	}
+	return doc, nil
+}
+
+func qualifiedName(n xml.Name) string {
+	if "" == n.Space {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
+
+// elements are the child elements of the node
+func (n *xmlNode) elements() []*xmlNode {
+	var els []*xmlNode
+	for _, c := range n.Children {
+		if xmlElementNode == c.Kind {
+			els = append(els, c)
+		}
+	}
+	return els
+}
+
+// root is the document the node is part of
+func (n *xmlNode) root() *xmlNode {
+	for nil != n.Parent {
+		n = n.Parent
+	}
+	return n
+}
+
+// String is the text of the node: all the text in it, in order
+func (n *xmlNode) String() string {
+	if xmlTextNode == n.Kind || xmlAttrNode == n.Kind {
+		return n.Text
+	}
+	var sb strings.Builder
+	var walk func(*xmlNode)
+	walk = func(n *xmlNode) {
+		for _, c := range n.Children {
+			if xmlTextNode == c.Kind {
+				sb.WriteString(c.Text)
+			} else {
+				walk(c)
+			}
+		}
+	}
+	walk(n)
+	return sb.String()
+}
+
+// Marshal writes the node back out as XML; a document gains an XML
+// declaration
+func (n *xmlNode) Marshal() []byte {
+	var buf bytes.Buffer
+	var write func(*xmlNode)
+	write = func(n *xmlNode) {
+		switch n.Kind {
+		case xmlTextNode:
+			buf.WriteString(xmlTextEscaper.Replace(n.Text))
+		case xmlElementNode:
+			buf.WriteByte('<')
+			buf.WriteString(qualifiedName(n.Name))
+			for _, a := range n.Attr {
+				buf.WriteByte(' ')
+				buf.WriteString(qualifiedName(a.Name))
+				buf.WriteString(`="`)
+				buf.WriteString(xmlAttrEscaper.Replace(a.Value))
+				buf.WriteByte('"')
+			}
+			if len(n.Children) == 0 {
+				buf.WriteString("/>")
+				return
+			}
+			buf.WriteByte('>')
+			for _, c := range n.Children {
+				write(c)
+			}
+			buf.WriteString("</")
+			buf.WriteString(qualifiedName(n.Name))
+			buf.WriteByte('>')
+		default:
+			buf.WriteString(xml.Header)
+			for _, c := range n.Children {
+				write(c)
+			}
+		}
+	}
+	write(n)
+	return buf.Bytes()
+}
+
+// xml.EscapeText also escapes newlines and tabs, which keeps them in an
+// attribute but makes text unreadable
+var xmlTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+var xmlAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;",
+	"\n", "&#xA;", "\t", "&#x9;", "\r", "&#xD;")
+
+// without copies the tree of n, leaving out the elements in drop (and
+// everything in them). copies, if not nil, gains the copy of each node.
+func (n *xmlNode) without(drop map[*xmlNode]bool, parent *xmlNode, copies map[*xmlNode]*xmlNode) *xmlNode {
+	c := *n
+	c.Parent = parent
+	c.Children = make([]*xmlNode, 0, len(n.Children))
+	for _, child := range n.Children {
+		if !drop[child] {
+			c.Children = append(c.Children, child.without(drop, &c, copies))
+		}
+	}
+	if nil != copies {
+		copies[n] = &c
+	}
+	return &c
+}
+
+// xpath is a compiled selector. It is the part of XPath 1.0 that picks
+// values out of a document:
+//
+//	/invoice/header/number       a path from the root element
+//	//line/amount                anywhere in the document
+//	header/number, ./number      relative to the document being read
+//	.., *, @currency, @*, text() parent, any element, attributes, text
+//	line[2], line[last()]        by position (from 1)
+//	line[@type='freight']        by the value of an attribute, or of a
+//	field[field_name="Auditor"]  child element (= or !=; and joins tests)
+//	line[amount]                 by having one
+//
+// Namespace prefixes are ignored: names match on their local part.
+type xpath struct {
+	expr     string
+	absolute bool
+	steps    []xpathStep
+}
+
+type xpathStep struct {
+	// deep is set for a step after //, which looks at every element
+	// below the context rather than only its children
+	deep  bool
+	kind  xpathStepKind
+	name  string // "*" is any
+	preds []xpathPred
+}
+
+type xpathStepKind int
+
+const (
+	xpathChild xpathStepKind = iota
+	xpathAttr
+	xpathText
+	xpathSelf
+	xpathParent
+)
+
+// xpathPred is a test in [...]: a position, or all of the tests
+type xpathPred struct {
+	position int // 1 and up; -1 is last()
+	tests    []xpathTest
+}
+
+// xpathTest is `path`, true if it selects anything, or `path op value`,
+// true if anything it selects compares that way
+type xpathTest struct {
+	path   *xpath
+	op     string
+	value  string
+	number bool
+}
+
+func compileXPath(expr string) (*xpath, error) {
+	x := &xpath{expr: expr}
+	s := strings.TrimSpace(expr)
+	if "" == s {
+		return nil, errors.New("empty selector")
+	}
+	deep := false
+	if strings.HasPrefix(s, "//") {
+		x.absolute, deep, s = true, true, s[2:]
+	} else if strings.HasPrefix(s, "/") {
+		x.absolute, s = true, s[1:]
+	}
+	for {
+		end, err := xpathStepEnd(s)
+		if nil != err {
+			return nil, fmt.Errorf("selector %q: %s", expr, err.Error())
+		}
+		step, err := compileXPathStep(s[:end])
+		if nil != err {
+			return nil, fmt.Errorf("selector %q: %s", expr, err.Error())
+		}
+		step.deep = deep
+		x.steps = append(x.steps, step)
+		s = s[end:]
+		if "" == s {
+			return x, nil
+		}
+		deep = strings.HasPrefix(s, "//")
+		s = strings.TrimPrefix(s[1:], "/")
+	}
+}
+
+// xpathStepEnd finds the / that ends the first step of s, skipping
+// over predicates and the quoted strings in them
+func xpathStepEnd(s string) (int, error) {
+	depth := 0
+	var quote rune
+	for ix, c := range s {
+		switch {
+		case 0 != quote:
+			if c == quote {
+				quote = 0
+			}
+		case '\'' == c || '"' == c:
+			quote = c
+		case '[' == c:
+			depth++
+		case ']' == c:
+			if depth--; depth < 0 {
+				return 0, errors.New("unexpected ]")
+			}
+		case '/' == c && 0 == depth:
+			return ix, nil
+		}
+	}
+	if 0 != quote || 0 != depth {
+		return 0, errors.New("unclosed [ or quote")
+	}
+	return len(s), nil
+}
+
+func compileXPathStep(s string) (step xpathStep, err error) {
+	name := s
+	if ix := strings.IndexByte(s, '['); ix >= 0 {
+		name = s[:ix]
+		if step.preds, err = compileXPathPreds(s[ix:]); nil != err {
+			return step, err
+		}
+	}
+	switch name = strings.TrimSpace(name); {
+	case "" == name:
+		return step, errors.New("empty step")
+	case "." == name:
+		step.kind = xpathSelf
+	case ".." == name:
+		step.kind = xpathParent
+	case "text()" == name:
+		step.kind = xpathText
+	case strings.HasPrefix(name, "@"):
+		step.kind, step.name = xpathAttr, localName(name[1:])
+	default:
+		step.kind, step.name = xpathChild, localName(name)
+	}
+	if xpathAttr == step.kind || xpathChild == step.kind {
+		if "" == step.name || strings.ContainsAny(step.name, "()@=!'\" ") {
+			return step, fmt.Errorf("bad name %q", name)
+		}
+	}
+	if len(step.preds) > 0 && (xpathSelf == step.kind || xpathParent == step.kind) {
+		return step, fmt.Errorf("%s cannot have a [test]", name)
+	}
+	return step, nil
+}
+
+func localName(name string) string {
+	if ix := strings.IndexByte(name, ':'); ix >= 0 {
+		return name[ix+1:]
+	}
+	return name
+}
+
+// compileXPathPreds reads one or more [...] in a row
+func compileXPathPreds(s string) ([]xpathPred, error) {
+	var preds []xpathPred
+	for s = strings.TrimSpace(s); "" != s; s = strings.TrimSpace(s) {
+		if '[' != s[0] {
+			return nil, fmt.Errorf("unexpected %q", s)
+		}
+		end, err := xpathPredEnd(s)
+		if nil != err {
+			return nil, err
+		}
+		pred, err := compileXPathPred(strings.TrimSpace(s[1:end]))
+		if nil != err {
+			return nil, err
+		}
+		preds = append(preds, pred)
+		s = s[end+1:]
+	}
+	return preds, nil
+}
+
+func xpathPredEnd(s string) (int, error) {
+	depth := 0
+	var quote rune
+	for ix, c := range s {
+		switch {
+		case 0 != quote:
+			if c == quote {
+				quote = 0
+			}
+		case '\'' == c || '"' == c:
+			quote = c
+		case '[' == c:
+			depth++
+		case ']' == c:
+			if depth--; 0 == depth {
+				return ix, nil
+			}
+		}
+	}
+	return 0, errors.New("unclosed [")
+}
+
+func compileXPathPred(s string) (pred xpathPred, err error) {
+	if "last()" == s {
+		pred.position = -1
+		return pred, nil
+	}
+	if n, err := strconv.Atoi(s); nil == err {
+		if n < 1 {
+			return pred, fmt.Errorf("position [%d] (they start at 1)", n)
+		}
+		pred.position = n
+		return pred, nil
+	}
+	for _, part := range splitOutsideQuotes(s, " and ") {
+		var test xpathTest
+		operand := strings.TrimSpace(part)
+		if ix := indexOutsideQuotes(operand, "="); ix > 0 {
+			test.op, test.value = "=", strings.TrimSpace(operand[ix+1:])
+			if '!' == operand[ix-1] {
+				test.op, ix = "!=", ix-1
+			}
+			operand = strings.TrimSpace(operand[:ix])
+			if test.value, test.number, err = xpathLiteral(test.value); nil != err {
+				return pred, err
+			}
+		}
+		if test.path, err = compileXPath(operand); nil != err {
+			return pred, err
+		}
+		if test.path.absolute {
+			return pred, fmt.Errorf("[%s] has to be relative", operand)
+		}
+		pred.tests = append(pred.tests, test)
+	}
+	return pred, nil
+}
+
+// xpathLiteral reads 'text', "text" or a number
+func xpathLiteral(s string) (string, bool, error) {
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1], false, nil
+	}
+	if _, err := strconv.ParseFloat(s, 64); nil == err {
+		return s, true, nil
+	}
+	return "", false, fmt.Errorf("%q is not a quoted string or a number", s)
+}
+
+func indexOutsideQuotes(s string, sep string) int {
+	var quote byte
+	for ix := 0; ix < len(s); ix++ {
+		switch c := s[ix]; {
+		case 0 != quote:
+			if c == quote {
+				quote = 0
+			}
+		case '\'' == c || '"' == c:
+			quote = c
+		case strings.HasPrefix(s[ix:], sep):
+			return ix
+		}
+	}
+	return -1
+}
+
+func splitOutsideQuotes(s string, sep string) []string {
+	var parts []string
+	for ix := indexOutsideQuotes(s, sep); ix >= 0; ix = indexOutsideQuotes(s, sep) {
+		parts = append(parts, s[:ix])
+		s = s[ix+len(sep):]
+	}
+	return append(parts, s)
+}
+
+func (x *xpath) String() string {
+	return x.expr
+}
+
+// Select is every node the selector picks out, reading from ctx
+func (x *xpath) Select(ctx *xmlNode) []*xmlNode {
+	nodes := []*xmlNode{ctx}
+	if x.absolute {
+		nodes = []*xmlNode{ctx.root()}
+	}
+	for _, step := range x.steps {
+		var next []*xmlNode
+		seen := make(map[*xmlNode]bool)
+		for _, n := range nodes {
+			from := []*xmlNode{n}
+			if step.deep {
+				from = descendantsOrSelf(n)
+			}
+			for _, f := range from {
+				for _, m := range step.apply(f) {
+					if !seen[m] {
+						seen[m] = true
+						next = append(next, m)
+					}
+				}
+			}
+		}
+		nodes = next
+	}
+	return nodes
+}
+
+// Strings is the text of each node the selector picks out, trimmed
+func (x *xpath) Strings(ctx *xmlNode) []string {
+	nodes := x.Select(ctx)
+	values := make([]string, len(nodes))
+	for ix, n := range nodes {
+		values[ix] = strings.TrimSpace(n.String())
+	}
+	return values
+}
+
+func descendantsOrSelf(n *xmlNode) []*xmlNode {
+	all := []*xmlNode{n}
+	for _, c := range n.Children {
+		if xmlElementNode == c.Kind {
+			all = append(all, descendantsOrSelf(c)...)
+		}
+	}
+	return all
+}
+
+// apply is the step from one node: its candidates, then each test
+func (s *xpathStep) apply(n *xmlNode) []*xmlNode {
+	var found []*xmlNode
+	switch s.kind {
+	case xpathSelf:
+		return []*xmlNode{n}
+	case xpathParent:
+		if nil == n.Parent {
+			return nil
+		}
+		return []*xmlNode{n.Parent}
+	case xpathAttr:
+		for _, a := range n.Attr {
+			if "*" == s.name || a.Name.Local == s.name {
+				found = append(found, &xmlNode{Kind: xmlAttrNode, Name: a.Name, Text: a.Value, Parent: n})
+			}
+		}
+	case xpathText:
+		for _, c := range n.Children {
+			if xmlTextNode == c.Kind {
+				found = append(found, c)
+			}
+		}
+	default:
+		for _, c := range n.Children {
+			if xmlElementNode == c.Kind && ("*" == s.name || c.Name.Local == s.name) {
+				found = append(found, c)
+			}
+		}
+	}
+	for _, pred := range s.preds {
+		found = pred.filter(found)
+	}
+	return found
+}
+
+func (p *xpathPred) filter(nodes []*xmlNode) []*xmlNode {
+	if -1 == p.position {
+		if len(nodes) == 0 {
+			return nil
+		}
+		return nodes[len(nodes)-1:]
+	} else if p.position > 0 {
+		if p.position > len(nodes) {
+			return nil
+		}
+		return nodes[p.position-1 : p.position]
+	}
+	var kept []*xmlNode
+	for _, n := range nodes {
+		if p.holds(n) {
+			kept = append(kept, n)
+		}
+	}
+	return kept
+}
+
+func (p *xpathPred) holds(n *xmlNode) bool {
+	for _, t := range p.tests {
+		if !t.holds(n) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *xpathTest) holds(n *xmlNode) bool {
+	for _, m := range t.path.Select(n) {
+		if "" == t.op {
+			return true
+		}
+		value := strings.TrimSpace(m.String())
+		equal := value == t.value
+		if t.number {
+			a, err := strconv.ParseFloat(value, 64)
+			b, _ := strconv.ParseFloat(t.value, 64)
+			equal = nil == err && a == b
+		}
+		if equal == ("=" == t.op) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testInvoicesXML = `<?xml version="1.0"?>
+<invoices batch="7" xmlns:v="urn:example">
+	<invoice id="1">
+		<header><number>100</number><date>3/1/2023</date></header>
+		<line type="freight"><amount>10.50</amount></line>
+		<line type="goods"><amount>99</amount><qty>0</qty></line>
+		<v:note>hi <b>there</b></v:note>
+	</invoice>
+	<invoice id="2">
+		<header><number>200</number></header>
+		<line type="freight"><amount>7</amount></line>
+	</invoice>
+</invoices>`
+
+func parseTestXML(t *testing.T, data string) *xmlNode {
+	t.Helper()
+	tree, err := parseXmlTree([]byte(data))
+	if nil != err {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestCompileXPathErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"  ",
+		"a[",
+		"a]",
+		"a[1",
+		"a[0]",
+		"a[-1]",
+		"a['x]",
+		"a//",
+		"a/[1]",
+		"..[1]",
+		".[@x]",
+		"a[@x=freight]",
+		"a[/b]",
+		"@",
+		"a b",
+		"f(x)",
+	} {
+		if x, err := compileXPath(expr); nil == err {
+			t.Errorf("%q compiled (to %d steps), want an error", expr, len(x.steps))
+		}
+	}
+}
+
+func TestXPathSelect(t *testing.T) {
+	tree := parseTestXML(t, testInvoicesXML)
+	second := tree.elements()[0].elements()[1]
+	for _, tc := range []struct {
+		expr string
+		ctx  *xmlNode
+		want []string
+	}{
+		{"/invoices/invoice/header/number", tree, []string{"100", "200"}},
+		{"//number", tree, []string{"100", "200"}},
+		{"/invoices/@batch", tree, []string{"7"}},
+		{"//invoice/@*", tree, []string{"1", "2"}},
+		{"//line[@type='freight']/amount", tree, []string{"10.50", "7"}},
+		{`//line[@type!="freight"]/amount`, tree, []string{"99"}},
+		{"//line[2]/amount", tree, []string{"99"}},
+		{"//line[last()]/amount", tree, []string{"99", "7"}},
+		{"/invoices/invoice[last()]/@id", tree, []string{"2"}},
+		{"/invoices/invoice[3]/@id", tree, []string{}},
+		{"//line[amount and qty=0]/@type", tree, []string{"goods"}},
+		{"//line[qty]/amount", tree, []string{"99"}},
+		{"//line[amount=10.5]/@type", tree, []string{"freight"}},
+		{"//line[amount='10.5']/@type", tree, []string{}},
+		{"//line[@type='freight'][2]/amount", tree, []string{}},
+		{"//line[@type='freight' and amount=7]/../@id", tree, []string{"2"}},
+		{"//number/../../@id", tree, []string{"1", "2"}},
+		// namespace prefixes are ignored; the text of an element is all
+		// the text in it
+		{"//v:note", tree, []string{"hi there"}},
+		{"//note/text()", tree, []string{"hi"}},
+		{"/invoices/invoice/*/date", tree, []string{"3/1/2023"}},
+		// relative to a document, and absolute from anywhere
+		{"header/number", second, []string{"200"}},
+		{"./line/amount", second, []string{"7"}},
+		{".", second.elements()[0].elements()[0], []string{"200"}},
+		{"//amount", second, []string{"10.50", "99", "7"}},
+		{"/invoices/@batch", second, []string{"7"}},
+		{"@id", second, []string{"2"}},
+		{"missing", second, []string{}},
+	} {
+		x, err := compileXPath(tc.expr)
+		if nil != err {
+			t.Errorf("%q: %s", tc.expr, err)
+			continue
+		}
+		if got := x.Strings(tc.ctx); strings.Join(got, "|") != strings.Join(tc.want, "|") {
+			t.Errorf("%q selected %q, want %q", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestParseXmlTreeErrors(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"just text",
+		"<a>",
+		"<a></b>",
+		"<a/><b/>",
+	} {
+		if _, err := parseXmlTree([]byte(data)); nil == err {
+			t.Errorf("%q parsed, want an error", data)
+		}
+	}
+}
+
+func TestXmlTreeMarshal(t *testing.T) {
+	in := `<a x="1 &amp; &lt;2&gt;" y="line&#xA;two"><b>x &lt; y &amp;&amp; "q"</b><c/>` +
+		`<!-- dropped --><d>tab	kept</d></a>`
+	want := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		`<a x="1 &amp; &lt;2&gt;" y="line&#xA;two"><b>x &lt; y &amp;&amp; "q"</b><c/><d>tab	kept</d></a>`
+	tree := parseTestXML(t, in)
+	if got := string(tree.Marshal()); want != got {
+		t.Fatalf("got  %s\nwant %s", got, want)
+	}
+	// and it reads back the same
+	if again := string(parseTestXML(t, want).Marshal()); want != again {
+		t.Errorf("read back as %s", again)
+	}
+}
+
+func TestXmlTreeWithout(t *testing.T) {
+	tree := parseTestXML(t, testInvoicesXML)
+	invoices := tree.elements()[0].elements()
+	copies := make(map[*xmlNode]*xmlNode)
+	cut := tree.without(map[*xmlNode]bool{invoices[0]: true}, nil, copies)
+
+	if got := string(cut.Marshal()); strings.Contains(got, `id="1"`) || !strings.Contains(got, `id="2"`) {
+		t.Errorf("cutting invoice 1 left %s", got)
+	}
+	if _, ok := copies[invoices[0]]; ok {
+		t.Error("the invoice that was cut has a copy")
+	}
+	kept, ok := copies[invoices[1]]
+	if !ok || kept == invoices[1] || kept.root() != cut || "2" != kept.Attr[0].Value {
+		t.Fatalf("invoice 2 was not copied into the cut tree")
+	}
+	if cut != copies[tree] {
+		t.Error("the copy of the document is not the cut tree")
+	}
+	// the original is untouched
+	if len(tree.elements()[0].elements()) != 2 || invoices[1].root() != tree {
+		t.Error("cutting changed the original tree")
+	}
+}
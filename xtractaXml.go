@@ -2,23 +2,128 @@ package main
 
 import (
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"net/http"
 	"reflectsvc/misc"
+	"sort"
 	"strconv"
 	"strings"
-	"time"
 )
 
-const XmlDateLayout = "_2/1/2006"
-const JsonDateLayout = "2006-02-01"
+// XmlDateLayout is how Xtracta writes dates (US, month first), and
+// xmlDateLayoutDayFirst the other way such a date can be read
+const XmlDateLayout = "1/2/2006"
+const xmlDateLayoutDayFirst = "2/1/2006"
+const JsonDateLayout = "2006-01-02"
 
 type XtractaEvents struct {
 	MagicInternalGuid string
 	XMLName           xml.Name     `xml:"events"`
 	Text              string       `xml:",chardata"`
 	Event             XtractaEvent `xml:"event"`
-	Headers           http.Header
+	Headers           http.Header  `xml:"-"`
+	Raw               []byte       `xml:"-"`
+	// More are the events after the first, when Xtracta batches
+	// several into one callback
+	More []XtractaEvent `xml:"-"`
+
+	// profile is the --xml-profile the XML was read with (nil for an
+	// Xtracta callback), and raws the XML of each of its documents
+	profile *xmlProfile
+	raws    [][]byte
+}
+
+// UnmarshalXML reads every <event> of the callback: the first into
+// Event, so a callback of one event looks the way it always has, and
+// the rest into More. encoding/xml alone keeps only the first.
+func (x *XtractaEvents) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	if "events" != start.Name.Local {
+		return fmt.Errorf("expected element type <events> but have <%s>", start.Name.Local)
+	}
+	var batch struct {
+		Text   string         `xml:",chardata"`
+		Events []XtractaEvent `xml:"event"`
+	}
+	if err := d.DecodeElement(&batch, &start); nil != err {
+		return err
+	}
+	x.XMLName, x.Text = start.Name, batch.Text
+	x.Event, x.More = XtractaEvent{}, nil
+	if len(batch.Events) > 0 {
+		x.Event, x.More = batch.Events[0], batch.Events[1:]
+	}
+	return nil
+}
+
+// Split makes a callback of each event. For a batch, each one's Raw is
+// rebuilt to hold only its own event, so a queued or dead-lettered
+// event can be converted again by itself.
+func (x XtractaEvents) Split() []XtractaEvents {
+	if len(x.More) == 0 {
+		return []XtractaEvents{x}
+	}
+	split := x.eachEvent()
+	for ix := range split {
+		if len(x.raws) == len(split) {
+			split[ix].Raw = x.raws[ix]
+			continue
+		}
+		split[ix].Raw = eventsXML(split[ix].Event)
+	}
+	return split
+}
+
+// eachEvent is Split without the XML of each event, for looking at
+// the events rather than sending them
+func (x XtractaEvents) eachEvent() []XtractaEvents {
+	if len(x.More) == 0 {
+		return []XtractaEvents{x}
+	}
+	events := append([]XtractaEvent{x.Event}, x.More...)
+	each := make([]XtractaEvents, len(events))
+	for ix, e := range events {
+		each[ix] = x
+		each[ix].Event, each[ix].More, each[ix].raws, each[ix].Raw = e, nil, nil, nil
+	}
+	return each
+}
+
+// Subset is the callback of the events of x at the positions in keep
+// (in order). An Xtracta batch gets XML of only those events; a
+// --xml-profile document keeps the XML it arrived as.
+func (x XtractaEvents) Subset(keep []int) XtractaEvents {
+	events := append([]XtractaEvent{x.Event}, x.More...)
+	sub := x
+	sub.Event, sub.More, sub.raws = events[keep[0]], nil, nil
+	for _, ix := range keep[1:] {
+		sub.More = append(sub.More, events[ix])
+	}
+	if len(x.raws) == len(events) {
+		for _, ix := range keep {
+			sub.raws = append(sub.raws, x.raws[ix])
+		}
+		return sub
+	}
+	kept := make([]XtractaEvent, 0, len(keep))
+	for _, ix := range keep {
+		kept = append(kept, events[ix])
+	}
+	sub.Raw = eventsXML(kept...)
+	return sub
+}
+
+// eventsXML is an Xtracta callback of the events
+func eventsXML(events ...XtractaEvent) []byte {
+	raw, err := xml.Marshal(struct {
+		XMLName xml.Name       `xml:"events"`
+		Events  []XtractaEvent `xml:"event"`
+	}{Events: events})
+	if nil != err {
+		xLog.Printf("huh? could not rebuild the XML of event %s because %s", events[0].Sequence, err.Error())
+		return nil
+	}
+	return append([]byte(xml.Header), raw...)
 }
 
 func (x XtractaEvents) String() string {
@@ -108,6 +213,9 @@ type XtractaField struct {
 	FieldName                 string `xml:"field_name"`
 	FieldValue                string `xml:"field_value"`
 	FieldExtractionConfidence string `xml:"field_extraction_confidence"`
+	// Values are everything a selector ending in [] found (see
+	// isSelector), sent as a JSON array
+	Values []string `xml:"-"`
 }
 
 func (x XtractaField) String() string {
@@ -119,88 +227,373 @@ func (x XtractaField) String() string {
 // --fieldNames permits remapping XML field names to new JSON field names.
 // --omitEmpty means that XML fields without field values are omitted.
 
-func (x XtractaEvents) Json() string {
-	var sbCap = 1024
+func (x XtractaEvents) Json() (string, error) {
+	return x.JsonWith(FlagRemapMap)
+}
+
+// fieldFailure is a mapped field whose value did not convert to its
+// type, or (with Rule set) broke one of its validation rules
+type fieldFailure struct {
+	Field  string `json:"field"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+	Rule   string `json:"rule,omitempty"`
+}
+
+// conversionError refuses a document that has fields under the reject
+// policy (see --conversion-failure) which did not convert, or that
+// breaks the validation rules of the mapping
+type conversionError struct {
+	Failures []fieldFailure
+}
+
+func (e conversionError) Error() string {
 	var sb strings.Builder
-	sb.Grow(sbCap)
-	sb.WriteRune('{')
-	var EMPTYSTRING = ""
+	sb.WriteString(fmt.Sprintf("%d problem(s) with the document's fields:", len(e.Failures)))
+	for ix, f := range e.Failures {
+		if ix > 0 {
+			sb.WriteRune(',')
+		}
+		sb.WriteString(fmt.Sprintf(" %s (%s)", f.Field, f.Reason))
+	}
+	return sb.String()
+}
 
-	{ // insert documentUrl param
-		sb.WriteString("\"documentLink\":\"")
-		if misc.IsStringSet(&x.Event.Document.DocumentURL) {
-			sb.WriteString(x.Event.Document.DocumentURL)
+func (e conversionError) StatusCode() int { return http.StatusUnprocessableEntity }
+
+// JsonWith converts using the given field mapping in place of --fieldNames.
+// documentLink comes first, then the mapped fields in the order of the
+// mapping file, then any unmapped fields (as strings) in the order they
+// arrived.
+func (x XtractaEvents) JsonWith(remap map[string]remapField) (string, error) {
+	c, err := x.Convert(remap)
+	return c.Body, err
+}
+
+// ConvertAll is Convert for every event of the callback. A batch of
+// events becomes a JSON array of documents; the fields of its failures
+// and violations are prefixed with the position of their event ([1].).
+func (x XtractaEvents) ConvertAll(remap map[string]remapField) (conversion, error) {
+	if len(x.More) == 0 {
+		return x.Convert(remap)
+	}
+	var all conversion
+	var failures []fieldFailure
+	bodies := make([]string, 0, len(x.More)+1)
+	for ix, one := range x.Split() {
+		prefix := "[" + strconv.Itoa(ix) + "]."
+		c, err := one.Convert(remap)
+		var ce conversionError
+		if nil != err && !errors.As(err, &ce) {
+			return all, err
+		}
+		for _, f := range ce.Failures {
+			f.Field = prefix + f.Field
+			failures = append(failures, f)
+		}
+		for _, f := range c.Violations {
+			f.Field = prefix + f.Field
+			all.Violations = append(all.Violations, f)
+		}
+		for _, name := range c.LowConfidence {
+			all.LowConfidence = append(all.LowConfidence, prefix+name)
 		}
+		bodies = append(bodies, c.Body)
 	}
-	sb.WriteRune('"')
+	if len(failures) > 0 {
+		return all, conversionError{Failures: failures}
+	}
+	all.Body = "[" + strings.Join(bodies, ",") + "]"
+	return all, nil
+}
 
-	for _, fld := range x.Event.Document.FieldData.Field {
+// conversion is a document converted to JSON, and what was noticed on
+// the way
+type conversion struct {
+	Body string
+	// LowConfidence are the JSON names of the fields below their
+	// extraction confidence threshold
+	LowConfidence []string
+	// Violations are the validation rules of the mapping the document
+	// breaks
+	Violations []fieldFailure
+}
+
+// refused is the error of a conversion that is not to be sent: err, or
+// the validation rules it breaks, with every problem at once so the
+// sender can fix them together
+func (c conversion) refused(err error) error {
+	var ce conversionError
+	if errors.As(err, &ce) || (nil == err && len(c.Violations) > 0) {
+		ce.Failures = append(ce.Failures, c.Violations...)
+		return ce
+	}
+	return err
+}
 
-		val := &EMPTYSTRING
-		rm, ok := FlagRemapMap[fld.FieldName]
-		if !ok {
-			if misc.IsStringSet(&fld.FieldValue) {
-				val = &fld.FieldValue
+// Convert is JsonWith, reporting the low confidence fields as well
+func (x XtractaEvents) Convert(remap map[string]remapField) (c conversion, err error) {
+	type mappedField struct {
+		rm         remapField
+		name       string
+		values     []string
+		list       bool
+		confidence string
+	}
+	mapped := make([]mappedField, 0, len(x.Event.Document.FieldData.Field))
+	unmapped := make([]mappedField, 0, 8)
+	for _, fld := range x.Event.Document.FieldData.Field {
+		if rm, ok := remap[fld.FieldName]; ok {
+			if nil != fld.Values {
+				mapped = append(mapped, mappedField{rm, fld.FieldName, fld.Values, true, ""})
+				continue
 			}
-			data := fmt.Sprintf(",\"%s\":\"%s\"", fld.FieldName, *val)
-			sb.WriteString(data)
+			mapped = append(mapped, mappedField{rm, fld.FieldName, []string{fld.FieldValue}, false,
+				fld.FieldExtractionConfidence})
+		} else if isSelector(fld.FieldName) {
+			// selected for the mapping of another route
+			continue
+		} else {
+			// sent as a string under its XML name
+			rm = remapField{XMLName: fld.FieldName, JsonName: fld.FieldName, FieldType: JsonString,
+				Path: []jsonStep{{Key: fld.FieldName, Index: -1}}, MinConfidence: -1}
+			unmapped = append(unmapped, mappedField{rm, fld.FieldName, []string{fld.FieldValue}, false,
+				fld.FieldExtractionConfidence})
 			if FlagDebug {
 				xLog.Printf("found an untranslated name/value pair [\"%s\":\"%s\"] - saving as string\n",
-					fld.FieldName, *val)
+					fld.FieldName, fld.FieldValue)
 			}
-		} else {
-			if !misc.IsStringSet(&fld.FieldValue) {
-				if rm.OmitEmpty {
+		}
+	}
+	for name, values := range x.metadata() {
+		if rm, ok := remap[name]; ok {
+			mapped = append(mapped, mappedField{rm, name, values, strings.HasSuffix(name, "[]"), ""})
+		}
+	}
+	sort.SliceStable(mapped, func(i, j int) bool {
+		return mapped[i].rm.Order < mapped[j].rm.Order
+	})
+	mapped = append(mapped, unmapped...)
+
+	obj := newJsonObject()
+	set := func(path []jsonStep, value interface{}) {
+		if _, dup := obj.Get(path[0].Key); dup && len(path) == 1 {
+			xLog.Printf("huh? more than one field is sent as %s -- keeping the last one", path[0].Key)
+		}
+		if err := obj.SetPath(path, value); nil != err {
+			xLog.Printf("huh? could not set a field in the JSON because %s", err.Error())
+		}
+	}
+	flat := func(name string) []jsonStep {
+		return []jsonStep{{Key: name, Index: -1}}
+	}
+	if _, ok := remap["@document_url"]; !ok && nil == x.profile {
+		// sent ahead of everything, unless the mapping says otherwise
+		set(flat("documentLink"), x.Event.Document.DocumentURL)
+	}
+
+	var failures []fieldFailure
+	// convert applies the field's type, OmitEmpty and failure policy to
+	// one value; keep is false when nothing is to be sent for it
+	convert := func(name string, rm *remapField, val string) (value interface{}, currency string, keep bool) {
+		if !misc.IsStringSet(&val) {
+			if rm.OmitEmpty {
+				return nil, "", false
+			}
+			if JsonString == rm.FieldType {
+				return "", "", true
+			}
+			return nil, "", true
+		}
+		value, currency, err := convertFieldValue(rm, val)
+		if errors.Is(err, errUnknownFieldType) {
+			xLog.Printf("Huh? remap FieldType has unrecognized value %d for "+
+				"FieldName %s (value %s) -- skipping this record",
+				int(rm.FieldType), name, val)
+			return nil, "", false
+		} else if nil != err {
+			policy := rm.onError()
+			xLog.Printf("huh? Field %s (%s) has value %q, which %s -- %s",
+				name, rm.JsonName, val, err.Error(), policy)
+			switch policy {
+			case policyOmit:
+				return nil, "", false
+			case policyString:
+				value = val
+			case policyReject:
+				failures = append(failures, fieldFailure{Field: rm.JsonName, Value: val, Reason: err.Error()})
+				return nil, "", false
+			default:
+				value = nil
+			}
+		}
+		return value, currency, true
+	}
+
+	lowFlagged, confidences := newJsonObject(), newJsonObject()
+	// for validate: values as they arrived, and as they were sent
+	raw := make(map[string]string, len(mapped))
+	sent := make(map[string]interface{}, len(mapped))
+	for _, m := range mapped {
+		rm := m.rm
+		raw[rm.XMLName] = strings.Join(m.values, " ")
+		if nil == rm.Path {
+			// mapped to "-": not sent
+			continue
+		}
+		if confidence, ok := parseConfidence(m.confidence); ok {
+			if misc.IsStringSet(&FlagConfidenceField) {
+				confidences.Set(rm.JsonName, confidence)
+			}
+			if threshold := rm.minConfidence(); threshold > 0 && confidence < threshold {
+				c.LowConfidence = append(c.LowConfidence, rm.JsonName)
+				policy := rm.onLowConfidence()
+				xLog.Printf("Field %s (%s) has extraction confidence %g, below %g -- %s",
+					m.name, rm.JsonName, confidence, threshold, policy)
+				switch policy {
+				case lowDrop:
+					continue
+				case lowNull:
+					set(rm.Path, nil)
+					sent[rm.JsonName] = nil
 					continue
+				case lowReject:
+					failures = append(failures, fieldFailure{Field: rm.JsonName, Value: m.values[0],
+						Reason: fmt.Sprintf("extraction confidence %g is below %g", confidence, threshold)})
+					continue
+				default:
+					lowFlagged.Set(rm.JsonName, confidence)
 				}
-			} else {
-				val = &fld.FieldValue
 			}
-			switch rm.FieldType {
-			case JsonString:
-				sb.WriteString(fmt.Sprintf(",\"%s\":\"%s\"", rm.JsonName, *val))
-			case JsonInteger, JsonNumeric:
-				num, err := strconv.ParseFloat(*val, 64)
-				if nil != err {
-					xLog.Printf("huh? Field %s is supposed be numeric, but was %s\n",
-						rm.JsonName, *val)
-				}
-				sb.WriteString(fmt.Sprintf(",\"%s\":%f", rm.JsonName, num))
-			case JsonBoolean:
-				booleanVal := false
-				truthStatus := strings.ToLower(fld.FieldValue)
-				if "true" == truthStatus {
-					booleanVal = true
-				} else if "false" != truthStatus {
-					xLog.Printf("huh? Field %s is supposed to be boolean, but has value %s\n",
-						rm.JsonName, fld.FieldValue)
-				}
-				sb.WriteString(fmt.Sprintf(",\"%s\":%t", rm.JsonName, booleanVal))
-			case JsonDate:
-				dt, err := time.Parse(XmlDateLayout, fld.FieldValue)
-				if nil != err {
-					xLog.Printf("huh? Date string [%s] not recognized because %s",
-						fld.FieldName, err.Error())
-					sb.WriteString(fmt.Sprintf(",\"%s\":\"\"", rm.JsonName))
-				} else {
-					sb.WriteString(fmt.Sprintf(",\"%s\":\"%s\"", rm.JsonName,
-						dt.Format(JsonDateLayout)))
+		}
+		if m.list {
+			list := make([]interface{}, 0, len(m.values))
+			for _, val := range m.values {
+				if value, _, keep := convert(m.name, &rm, val); keep {
+					list = append(list, value)
 				}
-			default:
-				xLog.Printf("Huh? remap FieldType has unrecognized value %d for "+
-					"FieldName %s (value %s) -- skipping this record",
-					int(rm.FieldType), fld.FieldName, fld.FieldValue)
-				continue
 			}
+			if len(list) > 0 || !rm.OmitEmpty {
+				set(rm.Path, list)
+				sent[rm.JsonName] = list
+			}
+			continue
+		}
+		value, currency, keep := convert(m.name, &rm, m.values[0])
+		if !keep {
+			continue
 		}
+		set(rm.Path, value)
+		sent[rm.JsonName] = value
+		if misc.IsStringSet(&rm.Currency) {
+			if !misc.IsStringSet(&currency) {
+				currency = rm.CurrencyDefault
+			}
+			if misc.IsStringSet(&currency) {
+				set(rm.CurrencyPath, currency)
+			}
+		}
+	}
+	c.Violations = validate(remap, raw, sent)
+	if len(failures) > 0 {
+		return c, conversionError{Failures: failures}
+	}
+	if lowFlagged.Len() > 0 {
+		set(flat(FlagLowConfidenceField), lowFlagged)
+	}
+	if confidences.Len() > 0 {
+		set(flat(FlagConfidenceField), confidences)
 	}
-	sb.WriteRune('}')
 
+	data, err := marshalJson(obj)
+	if nil != err {
+		return c, err
+	}
 	if FlagDebug {
-		xLog.Printf("xml data is %d bytes (capacity %d)\n", sb.Len(), sb.Cap())
+		xLog.Printf("json data is %d bytes\n", len(data))
 	}
-	if sb.Len() >= sbCap {
-		sbCap = sb.Len() + 512
+	c.Body = string(data)
+	return c, nil
+}
+
+// xtractaMetadata are the names, each beginning with @, under which the
+// mapping file can map what Xtracta sends besides field_data. A name
+// ending in [] is a list, sent as a JSON array.
+var xtractaMetadata = map[string]func(x *XtractaEvents) []string{
+	"@workflow_id":           func(x *XtractaEvents) []string { return []string{x.Event.Document.WorkflowID} },
+	"@document_id":           func(x *XtractaEvents) []string { return []string{x.Event.Document.DocumentID} },
+	"@revision":              func(x *XtractaEvents) []string { return []string{x.Event.Document.Revision} },
+	"@document_status":       func(x *XtractaEvents) []string { return []string{x.Event.Document.DocumentStatus} },
+	"@number_of_pages":       func(x *XtractaEvents) []string { return []string{x.Event.Document.NumberOfPages} },
+	"@api_download_status":   func(x *XtractaEvents) []string { return []string{x.Event.Document.ApiDownloadStatus} },
+	"@free_form":             func(x *XtractaEvents) []string { return []string{x.Event.Document.FreeForm} },
+	"@classification":        func(x *XtractaEvents) []string { return []string{x.Event.Document.Classification} },
+	"@classification_class":  func(x *XtractaEvents) []string { return []string{x.Event.Document.ClassificationClass} },
+	"@classification_design": func(x *XtractaEvents) []string { return []string{x.Event.Document.ClassificationDesign} },
+	"@document_url":          func(x *XtractaEvents) []string { return []string{x.Event.Document.DocumentURL} },
+	"@image_url":             func(x *XtractaEvents) []string { return []string{firstOf(x.Event.Document.ImageURL)} },
+	"@image_url[]":           func(x *XtractaEvents) []string { return x.Event.Document.ImageURL },
+	"@sequence":              func(x *XtractaEvents) []string { return []string{x.Event.Sequence} },
+	"@generated":             func(x *XtractaEvents) []string { return []string{x.Event.Generated} },
+	"@p3id_sequence":         func(x *XtractaEvents) []string { return []string{x.MagicInternalGuid} },
+}
+
+func firstOf(s []string) string {
+	if len(s) == 0 {
+		return ""
 	}
-	return sb.String()
+	return s[0]
+}
+
+// metadata is the value of each of the xtractaMetadata names
+func (x XtractaEvents) metadata() map[string][]string {
+	m := make(map[string][]string, len(xtractaMetadata))
+	for name, value := range xtractaMetadata {
+		m[name] = value(&x)
+	}
+	return m
+}
+
+var errUnknownFieldType = errors.New("has no known type")
+
+// convertFieldValue turns a (non-empty) field value into the JSON value
+// for its type, or says why it cannot. Numbers may be written with
+// currency and thousands separators (see parseAmount); the currency is
+// returned as well.
+func convertFieldValue(rm *remapField, val string) (value interface{}, currency string, err error) {
+	switch rm.FieldType {
+	case JsonString:
+		return val, "", nil
+	case JsonInteger, JsonNumeric:
+		var amount string
+		amount, currency, err = parseAmount(val, rm.Decimal, rm.CurrencyDefault)
+		if nil != err {
+			return nil, currency, err
+		}
+		if JsonInteger == rm.FieldType {
+			if n, ok := jsonInteger(amount); ok {
+				return n, currency, nil
+			}
+			return nil, currency, errors.New("is not an integer")
+		}
+		if n, ok := jsonDecimal(amount); ok {
+			return n, currency, nil
+		}
+		return nil, currency, errNotAnAmount
+	case JsonBoolean:
+		switch strings.ToLower(strings.TrimSpace(val)) {
+		case "true":
+			return true, "", nil
+		case "false":
+			return false, "", nil
+		}
+		return nil, "", errors.New("is not true or false")
+	case JsonDate, JsonDateTime:
+		when, err := convertDate(rm, val)
+		if nil != err {
+			return nil, "", err
+		}
+		return when, "", nil
+	}
+	return nil, "", errUnknownFieldType
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata from the current output")
+
+// convertGolden converts xmlFile with the mapping in mappingFile under
+// the --conversion-failure policy, and compares the JSON (or, for a
+// refused document, its failures) with testdata/xml2json/golden
+func convertGolden(t *testing.T, xmlFile string, mappingFile string, policy conversionPolicy, golden string) {
+	t.Helper()
+	saved := FlagConversionFailure
+	FlagConversionFailure = string(policy)
+	defer func() { FlagConversionFailure = saved }()
+
+	data, err := os.ReadFile(xmlFile)
+	if nil != err {
+		t.Fatal(err)
+	}
+	events, err := readDocuments(data)
+	if nil != err {
+		t.Fatal(err)
+	}
+	remap, problems, err := readFieldTranslations(mappingFile)
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("mapping %s", p.String())
+	}
+
+	c, err := events.ConvertAll(remap)
+	var got []byte
+	var ce conversionError
+	if errors.As(err, &ce) {
+		if got, err = marshalJson(ce.Failures); nil != err {
+			t.Fatal(err)
+		}
+	} else if nil != err {
+		t.Fatal(err)
+	} else {
+		got = []byte(c.Body)
+	}
+	got = append(got, '\n')
+
+	fn := filepath.Join("testdata", "xml2json", golden)
+	if *updateGolden {
+		if err = os.WriteFile(fn, got, 0644); nil != err {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(fn)
+	if nil != err {
+		t.Fatalf("%s (go test -run %s -update writes it)", err, t.Name())
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("%s converted under %s differs from %s\n got: %s\nwant: %s",
+			xmlFile, policy, fn, got, want)
+	}
+}
+
+func TestXml2JsonGolden(t *testing.T) {
+	edgeXML := filepath.Join("testdata", "xml2json", "edge.xml")
+	edgeMapping := filepath.Join("testdata", "xml2json", "edge.csv")
+	for _, tc := range []struct {
+		name    string
+		xml     string
+		mapping string
+		policy  conversionPolicy
+		golden  string
+	}{
+		// the sample callback, with the sample mapping
+		{"body", "body.xml", "fieldnames.csv", policyNull, "body.json"},
+		// escaping, precision, and each failure policy; Kept says
+		// onError=string whatever the policy
+		{"null", edgeXML, edgeMapping, policyNull, "edge.null.json"},
+		{"omit", edgeXML, edgeMapping, policyOmit, "edge.omit.json"},
+		{"string", edgeXML, edgeMapping, policyString, "edge.string.json"},
+		{"reject", edgeXML, edgeMapping, policyReject, "edge.reject.json"},
+		// every @ name, with the document link mapped away
+		{"metadata", filepath.Join("testdata", "xml2json", "metadata.xml"),
+			filepath.Join("testdata", "xml2json", "metadata.csv"), policyNull, "metadata.json"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			convertGolden(t, tc.xml, tc.mapping, tc.policy, tc.golden)
+		})
+	}
+}
+
+func TestConvertMetadata(t *testing.T) {
+	// the sequence of the delivery, and the batch of the document
+	remap := testMapping(t, "@p3id_sequence;trace;string;false", "@document_id;id;string;false",
+		"@image_url[];images;string;true", "@image_url;image;string;true")
+	x := testDocument("1", "", "")
+	x.MagicInternalGuid = "seq-1"
+	c, err := x.Convert(remap)
+	want := `{"documentLink":"","trace":"seq-1","id":"D"}`
+	if nil != err || want != c.Body {
+		t.Errorf("got %s, %v\nwant %s", c.Body, err, want)
+	}
+
+	fn := filepath.Join(t.TempDir(), "mapping.csv")
+	if err = os.WriteFile(fn, []byte("@document_id;id;string;false\n@page_count;pages;integer;false\n"),
+		0644); nil != err {
+		t.Fatal(err)
+	}
+	_, problems, err := readFieldTranslations(fn)
+	if nil != err || 1 != len(problems) || 2 != problems[0].Line || problems[0].Warning {
+		t.Errorf("an unknown @ name: got %v, %+v", err, problems)
+	}
+}